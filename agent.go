@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
@@ -28,30 +29,44 @@ type AgentData struct {
 	client         pb.AssimilatorClient
 	commandRunner  CommandRunner
 	failureReports map[string]string
+	state          *AgentState
+	configRevision string // The config repo commit the server last served
+	offline        bool   // Whether this cycle is applying the last known config because the server is unreachable
+
+	serverPollInterval time.Duration     // The check interval the server asked for. 0 means use UpdateCheckInterval
+	failedChecks       int               // How many checks in a row couldn't reach the server
+	maxRemovals        int               // The most removed packages the server lets this agent uninstall per check
+	control            *agentControl     // What the control socket sees and changes. nil for one-off runs
+	skippedRootSteps   string            // The root steps an unprivileged agent last warned it can't run
+	skippedSteps       []*pb.SkippedStep // The steps the server left out because their when: is false
 }
 
 var agentData *AgentData
 
-// Check the server for updates
-func (a *AgentData) assimilationCheck(ctx context.Context) {
+// Check the server for updates. The returned error is the server's, so the
+// agent loop can back off while the server is unreachable. If onlyPackage is
+// set, only that package runs, regardless of when it last ran.
+func (a *AgentData) assimilationCheck(ctx context.Context, onlyPackage string) (checkErr error) {
 	Info("Starting assimilation check...")
+	a.control.startCycle(0)
+	defer func() { a.control.finishCycle(checkErr) }()
 	// 1. Open the connection for the entire sync cycle here
-	address := a.appConfig.ServerIP + ":" + fmt.Sprint(a.appConfig.ServerPort)
-	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := a.connect()
 	if err != nil {
 		Unhandled("Failed to start NewClient: ", err)
-		return
+		return err
 	}
 	defer conn.Close() // This will now stay open until all downloads finish
 
-	// 2. Initialize the client for this cycle
-	a.client = pb.NewAssimilatorClient(conn)
-
-	// 3. Fetch the config
-	machineConfig, err := a.getPackageInfoFromServer(ctx)
-	if err != nil {
-		Error("error getting package info from server: ", err)
-		return
+	// 3. Fetch the config, falling back to the last known one if the server is unreachable
+	a.offline = false
+	machineConfig, serverErr := a.getPackageInfoFromServer(ctx)
+	if serverErr != nil {
+		machineConfig, err = a.offlineConfig(serverErr)
+		if err != nil {
+			Error("error getting package info from server: ", err)
+			return serverErr
+		}
 	}
 
 	for packageName, packageConfig := range machineConfig {
@@ -61,20 +76,59 @@ func (a *AgentData) assimilationCheck(ctx context.Context) {
 	// 4. Filter packages by user then sort them, and list them
 	filteredNames, filteredPackages := PackagesForUser(machineConfig)
 	// listPackages(filteredNames, machineConfig)
+	a.warnRootSteps(machineConfig)
+	if onlyPackage != "" {
+		p, ok := filteredPackages[onlyPackage]
+		if !ok {
+			Error("Cannot run package ", onlyPackage, ": it isn't in this machine's config for user ", appConfig.RunAsUser)
+			return serverErr
+		}
+		p.forced = true
+		filteredNames = []string{onlyPackage}
+	}
+	a.control.startCycle(len(filteredNames))
 
 	// 5. Processes the packages
 	a.failureReports = make(map[string]string, len(machineConfig))
 	for _, packageName := range filteredNames {
+		if ctx.Err() != nil {
+			Info("Assimilation check canceled. Skipping the remaining packages.")
+			return serverErr
+		}
 		p := filteredPackages[packageName]
-		err := p.ProcessPackage(a)
+		a.control.startPackage(packageName, p.action)
+		err := p.ProcessPackage(ctx, a)
+		p.status = scriptStatus(err)
 		if err != nil {
-			a.failureReports[p.action+" "+packageName] = fmt.Sprintf("error processing %s package's %s action: %s ", packageName, p.action, err)
-			Error("error processing package: ", err)
+			a.failureReports[p.action+" "+packageName] = fmt.Sprintf("%s: error processing %s package's %s action: %s ", p.status, packageName, p.action, err)
+			Error("error processing package (", p.status, "): ", err)
 		}
+		a.control.finishPackage()
+	}
+
+	// 6. Uninstall the packages that were removed from the config
+	if !a.offline && onlyPackage == "" {
+		a.uninstallRemovedPackages(ctx)
 	}
 
 	// printReports(filteredNames, a.failureReports)
+	if a.offline {
+		Info("Completed assimilation check (OFFLINE).")
+		return serverErr
+	}
 	Info("Completed assimilation check.")
+	return nil
+}
+
+// connect opens a connection to the server and initializes the client for this cycle
+func (a *AgentData) connect() (*grpc.ClientConn, error) {
+	address := a.appConfig.ServerIP + ":" + fmt.Sprint(a.appConfig.ServerPort)
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	a.client = pb.NewAssimilatorClient(conn)
+	return conn, nil
 }
 
 func PackagesForUser(packages map[string]*pb.PackageConfig) ([]string, map[string]*packageInfo) {
@@ -96,9 +150,10 @@ func PackagesForUser(packages map[string]*pb.PackageConfig) ([]string, map[strin
 		}
 	}
 	slices.Sort(sortedNames)
-	if sortedNames == nil {
-		Error("No packages found for user: ", appConfig.RunAsUser)
-		os.Exit(1)
+	// Every step can be skipped by its when:, left out offline or run as
+	// another user. That's not fatal: removed packages are still uninstalled.
+	if len(sortedNames) == 0 {
+		Info("No package steps to run for user: ", appConfig.RunAsUser)
 	}
 	return sortedNames, filteredPackages
 }
@@ -146,6 +201,10 @@ func listPackages(namesSorted []string, packages map[string]*pb.PackageConfig) {
 	for _, packageName := range namesSorted {
 		Debug("- ", packageName)
 		for _, packageData := range packages[packageName].PackageSteps {
+			if packageData.GetHasSecrets() {
+				Debug("  - ", packageData.Action, " as user ", packageData.Runasuser, " with arguments holding secrets")
+				continue
+			}
 			if len(packageData.Arguments) > 0 {
 				Debug("  - ", packageData.Action, " as user ", packageData.Runasuser, " with arguments:")
 				for _, argument := range packageData.Arguments {
@@ -161,11 +220,14 @@ func listPackages(namesSorted []string, packages map[string]*pb.PackageConfig) {
 // Get the machine config from the server
 func (a *AgentData) getPackageInfoFromServer(ctx context.Context) (map[string]*assctl.PackageConfig, error) {
 	Debug("Attempting to fetch config from server...")
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	reqCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
 
-	req := &pb.GetSpecificConfigRequest{MachineName: a.appConfig.Hostname}
-	resp, err := a.client.GetSpecificConfig(ctx, req)
+	req := &pb.GetSpecificConfigRequest{
+		MachineName: a.appConfig.Hostname,
+		Facts:       collectFacts(),
+	}
+	resp, err := a.client.GetSpecificConfig(reqCtx, req)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			asslog.Trace("pingServer was canceled by shutdown signal.")
@@ -188,12 +250,27 @@ func (a *AgentData) getPackageInfoFromServer(ctx context.Context) (map[string]*a
 		return nil, err
 	}
 
-	err = checkForVersionMismatch(resp)
+	err = a.checkForVersionMismatch(ctx, resp)
 	if err != nil {
 		return nil, err
 	}
+	a.configRevision = resp.GetConfigRevision()
+	a.serverPollInterval = time.Duration(resp.GetNextPollInterval()) * time.Second
+	a.maxRemovals = maxRemovals(resp)
+	a.skippedSteps = resp.GetSkippedSteps()
+	if err := a.state.recordCheckIn(resp.GetVersion().GetVersion(), a.configRevision, resp.GetPackages()); err != nil {
+		Error("failed to record the check-in in the agent state: ", err)
+	}
+	if !a.state.readOnly {
+		if err := saveConfigSnapshot(resp); err != nil {
+			Error("failed to save the config snapshot for offline mode: ", err)
+		}
+	}
 
 	Info("Successfully got config for machine: ", a.appConfig.Hostname)
+	for _, step := range a.skippedSteps {
+		Info("Skipping the ", step.GetAction(), " step of ", step.GetPackage(), ": ", step.GetReason())
+	}
 	if len(resp.GetPackages()) == 0 {
 		Error("No packages to install. Double-check config.yaml for ", a.appConfig.Hostname)
 		return nil, err
@@ -233,10 +310,24 @@ func convertToPackageInfo(packageName string, packageData *pb.PackageSteps, chec
 		action:         packageData.GetAction(),
 		runAsUser:      runAsUser,
 		updateInterval: appConfig.PackageUpdateInterval,
+		timeout:        packageData.GetTimeout(),
+		env:            stepEnv(packageData.GetEnv()),
+		hasSecrets:     packageData.GetHasSecrets(),
+
+		uninstallOnRemoval: packageData.GetUninstallOnRemoval(),
 	}
 	return pkg
 }
 
+// stepEnv turns a step's env into KEY=value pairs, sorted so the order is stable
+func stepEnv(env map[string]string) []string {
+	pairs := make([]string, 0, len(env))
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		pairs = append(pairs, key+"="+env[key])
+	}
+	return pairs
+}
+
 // func getMachineConfig(ctx context.Context, conn *grpc.ClientConn) (*pb.GetSpecificConfigResponse, error) {
 // 	client := pb.NewAssimilatorClient(conn)
 // 	agentData.client = client
@@ -252,22 +343,39 @@ func convertToPackageInfo(packageName string, packageData *pb.PackageSteps, chec
 // 	return resp, nil
 // }
 
-func checkForVersionMismatch(resp *pb.GetSpecificConfigResponse) error {
+// checkForVersionMismatch updates the agent when the server is newer. A failed
+// self-update is logged and the current version keeps running.
+func (a *AgentData) checkForVersionMismatch(ctx context.Context, resp *pb.GetSpecificConfigResponse) error {
 	Trace("setting respVersion to ", resp.Version.Version)
 	respVersion, err := version.NewVersion(resp.Version.Version)
-	Trace("setting configVersion to ", agentData.appConfig.version)
-	configVersion, _ := version.NewVersion(agentData.appConfig.version)
+	Trace("setting configVersion to ", a.appConfig.version)
+	configVersion, _ := version.NewVersion(a.appConfig.version)
 
 	Trace("comparing ", configVersion, " to ", respVersion)
-	if err == nil && configVersion.LessThan(respVersion) {
-		Info("version mismatch. Server version: ", respVersion, " Local version: ", agentData.appConfig.version)
-		if !appConfig.TestMode {
+	if err == nil && configVersion != nil && configVersion.LessThan(respVersion) {
+		Info("version mismatch. Server version: ", respVersion, " Local version: ", a.appConfig.version)
+		switch {
+		case appConfig.TestMode || appConfig.Plan:
+		case !appConfig.SelfUpdate:
+			// Leave the update to the launcher and the distro repo
 			Info("Restarting to update...")
-			asslog.Close()
-			os.Exit(0)
+			exitToUpdate()
+		default:
+			publicKey, executable, err := a.selfUpdateTarget()
+			if err != nil {
+				Warning("Unable to update the agent itself, restarting to update instead: ", err)
+				exitToUpdate()
+				return nil
+			}
+			if err := a.selfUpdate(ctx, configVersion, publicKey, executable); err != nil {
+				Error("self-update failed, continuing with version ", a.appConfig.version, ": ", err)
+				return nil
+			}
+			restartAgent(executable)
 		}
+		return nil
 	}
-	Info("Agent version (", agentData.appConfig.version, ") matches server version (", resp.Version.Version, ").")
+	Info("Agent version (", a.appConfig.version, ") matches server version (", resp.Version.Version, ").")
 	return nil
 }
 
@@ -311,17 +419,37 @@ func Agent(commandRunner CommandRunner) {
 	Info("Agent starting up...")
 	Trace(appConfig.Hostname)
 
+	state, err := loadAgentState(appConfig.StateDir, appConfig.CacheDir, false)
+	if err != nil {
+		Fatal(1, "error loading agent state: ", err)
+	}
+	agentData.state = state
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start the ticker which activates the agent subroutines
-	ticker := time.NewTicker(time.Duration(appConfig.UpdateCheckInterval) * time.Second)
+	// Cancel the context on shutdown so running scripts and their process groups are killed
+	shutdownSignal := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignal, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-shutdownSignal
+		Debug("Shutdown signal received, canceling running scripts...")
+		cancel()
+	}()
 
-	// Create a "done" channel to signal when we want to stop the pinger
+	// Create a "done" channel to signal when we want to stop the agent loop
 	done := make(chan bool)
 
+	// The control socket only makes sense for an agent that keeps running
+	if !appConfig.RunOnce {
+		agentData.control = newAgentControl()
+		if err := agentData.control.listen(ctx, appConfig.ControlSocket, appConfig.AdminGroup); err != nil {
+			Error("control socket unavailable, run-now, pause and resume won't work: ", err)
+		}
+	}
+
 	// Run the first assimilation check
-	agentData.assimilationCheck(ctx)
+	checkErr := agentData.assimilationCheck(ctx, "")
 	// if (appConfig.RunAsUser != "" && appConfig.RunAsUser != "root") || appConfig.RunOnce {
 	if appConfig.RunOnce {
 		Info("Everything is updated. Shutting down.")
@@ -329,33 +457,46 @@ func Agent(commandRunner CommandRunner) {
 		return
 	}
 
-	// Start a goutine to run that check again at the specified interval
+	// Start a goutine to run that check again after a delay decided by nextCheckDelay
+	timer := time.NewTimer(0)
+	resetTimer := func() {
+		delay := agentData.nextCheckDelay(checkErr)
+		agentData.control.setNextCheck(delay)
+		timer.Reset(delay)
+	}
+	resetTimer()
 	go func(ctx context.Context) {
 		Debug("Agent loop started.")
 		for {
 			select {
 			case <-done:
 				return
-			case <-ticker.C:
+			case <-timer.C:
 				Trace("tick! ", time.Now())
-				ticker.Stop()
-				agentData.assimilationCheck(ctx)
-				ticker = time.NewTicker(time.Duration(appConfig.UpdateCheckInterval) * time.Second)
-				Info("Waiting ", time.Duration(appConfig.UpdateCheckInterval)*time.Second, " seconds before next check.")
+				if agentData.control.isPaused() {
+					Info("Agent is paused. Skipping this check.")
+				} else {
+					checkErr = agentData.assimilationCheck(ctx, "")
+				}
+				resetTimer()
+			case packageName := <-agentData.control.runNow:
+				if packageName != "" {
+					agentData.assimilationCheck(ctx, packageName)
+					continue
+				}
+				timer.Stop()
+				checkErr = agentData.assimilationCheck(ctx, "")
+				resetTimer()
 			}
 		}
 	}(ctx)
 
-	shutdownSignal := make(chan os.Signal, 1)
-	signal.Notify(shutdownSignal, syscall.SIGINT, syscall.SIGTERM)
-
 	// This line blocks the goroutine until a signal arrives
-	<-shutdownSignal
+	<-ctx.Done()
 
 	// Signal received, now clean up.
-	Debug("Shutdown signal received, telling agent loop to stop...")
-	ticker.Stop()
-	cancel()
+	Debug("Telling agent loop to stop...")
+	timer.Stop()
 	done <- true
 	Debug("Agent shutting down...")
 }
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	agentStateVersion  = 1
+	agentStateFilename = "state.json"
+	stateKeyFilename   = "state.key"
+	stateKeySize       = 32
+	lastRunTimeSuffix  = "_lastRunTime.txt"
+)
+
+// AgentState is everything the agent remembers between runs. It is stored as
+// JSON in <StateDir>/state.json and rewritten atomically after every change.
+type AgentState struct {
+	mu       sync.Mutex
+	path     string
+	readOnly bool
+	// Keys the hashes of step arguments and env, from state.key
+	hashKey  []byte
+	Version  int                      `json:"version"`
+	Packages map[string]*PackageState `json:"packages"`
+
+	LastCheckIn    time.Time `json:"last_check_in"`   // The last time the server returned a config
+	ServerVersion  string    `json:"server_version"`  // The server version seen at the last check-in
+	ConfigRevision string    `json:"config_revision"` // The config repo commit seen at the last check-in
+}
+
+type PackageState struct {
+	Assigned       bool   `json:"assigned"`        // Whether the last served config included the package
+	ServerChecksum string `json:"server_checksum"` // The package checksum seen at the last check-in
+	// Steps are keyed by stepKey(action, runAsUser), or adHocStepKey for
+	// runs from `assimilator install`
+	Steps map[string]*StepState `json:"steps"`
+}
+
+type StepState struct {
+	Action          string    `json:"action"`
+	RunAsUser       string    `json:"runasuser"`
+	LastRunTime     time.Time `json:"last_run_time"`     // The last time the step's script ran, successful or not
+	LastSuccessTime time.Time `json:"last_success_time"` // The last time the step's script succeeded
+	Checksum        string    `json:"checksum"`          // The checksum of the tarball that was run
+	ArgumentsHash   string    `json:"arguments_hash"`
+	Status          string    `json:"status"`               // One of the script status constants
+	Compliance      string    `json:"compliance,omitempty"` // What check.sh found, if the package has one
+	ExitCode        int       `json:"exit_code"`
+	DurationMs      int64     `json:"duration_ms"`
+	ConfigRevision  string    `json:"config_revision"`   // The config repo commit the server served
+	Offline         bool      `json:"offline,omitempty"` // Whether the run used the last known config while the server was unreachable
+	AdHoc           bool      `json:"ad_hoc,omitempty"`  // Whether it was a one-off run from `assimilator install`
+
+	UninstallOnRemoval bool `json:"uninstall_on_removal,omitempty"` // Whether to run uninstall.sh once the package is removed from the config
+
+	// Applied is what the step last ran with successfully
+	Applied stepFingerprint `json:"applied"`
+}
+
+func stepKey(action string, runAsUser string) string {
+	return action + "/" + runAsUser
+}
+
+// adHocStepKey keeps ad-hoc runs apart from the assigned step, so they don't
+// change what the config's step last ran with or when
+func adHocStepKey(action string, runAsUser string) string {
+	return "adhoc:" + stepKey(action, runAsUser)
+}
+
+// hashStrings returns a stable hash of a list of strings. Arguments and env
+// can hold secrets, so they're hashed with an HMAC keyed by the agent's own
+// state.key, which only the agent can read, rather than a plain SHA256 anyone
+// reading state.json could check guesses against. A nil key gives the plain
+// SHA256 that state from before keys holds.
+func hashStrings(key []byte, values []string) string {
+	hash := sha256.New()
+	if key != nil {
+		hash = hmac.New(sha256.New, key)
+	}
+	for _, value := range values {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// loadAgentState reads the state file from stateDir. If it doesn't exist yet,
+// any lastRunTime.txt files left in cacheDir are migrated into a new one.
+// A readOnly state is migrated in memory only and never saved.
+func loadAgentState(stateDir string, cacheDir string, readOnly bool) (*AgentState, error) {
+	state := &AgentState{
+		path:     filepath.Join(stateDir, agentStateFilename),
+		readOnly: readOnly,
+		Version:  agentStateVersion,
+		Packages: make(map[string]*PackageState),
+	}
+
+	var err error
+	if state.hashKey, err = loadStateKey(stateDir, readOnly); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(state.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && readOnly:
+		state.migrateLastRunFiles(cacheDir, false)
+		return state, nil
+	case errors.Is(err, os.ErrNotExist):
+		Info("Agent state file does not exist. Making one at ", state.path)
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create state directory: %w", err)
+		}
+		state.migrateLastRunFiles(cacheDir, true)
+		return state, state.save()
+	case err != nil:
+		return nil, fmt.Errorf("failed to read agent state: %w", err)
+	}
+
+	if err := state.parse(data); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// loadStateKey reads the agent's state.key, creating it if it doesn't exist
+// yet. A read-only state, e.g. for status, does without it if it can't be
+// read.
+func loadStateKey(stateDir string, readOnly bool) ([]byte, error) {
+	keyPath := filepath.Join(stateDir, stateKeyFilename)
+	for {
+		key, err := os.ReadFile(keyPath)
+		switch {
+		case err == nil && len(key) == stateKeySize:
+			return key, nil
+		case err == nil:
+			return nil, fmt.Errorf("%s is not a %d byte key", keyPath, stateKeySize)
+		case readOnly:
+			return nil, nil
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("failed to read the agent state key: %w", err)
+		}
+
+		key = make([]byte, stateKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate the agent state key: %w", err)
+		}
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create state directory: %w", err)
+		}
+		// Exclusive, so `assimilator install` and the agent can't both create one
+		keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the agent state key: %w", err)
+		}
+		_, err = keyFile.Write(key)
+		if closeErr := keyFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(keyPath)
+			return nil, fmt.Errorf("failed to write the agent state key: %w", err)
+		}
+		return key, nil
+	}
+}
+
+// fingerprint returns p's fingerprint hashed the same way as applied, so the
+// two compare. Fingerprints from before state.key existed are plain SHA256.
+// Without the key, as for a read-only state that can't read it, the hashes
+// can't be compared, so they count as unchanged.
+func (s *AgentState) fingerprint(p *packageInfo, applied stepFingerprint) stepFingerprint {
+	switch {
+	case !applied.Keyed:
+		return p.fingerprint(nil)
+	case s.hashKey == nil:
+		fingerprint := p.fingerprint(nil)
+		fingerprint.ArgumentsHash, fingerprint.EnvHash, fingerprint.Keyed = applied.ArgumentsHash, applied.EnvHash, true
+		return fingerprint
+	}
+	return p.fingerprint(s.hashKey)
+}
+
+// parse replaces the state with what's in data
+func (s *AgentState) parse(data []byte) error {
+	var parsed AgentState
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("failed to parse agent state %s: %w", s.path, err)
+	}
+	if parsed.Version > agentStateVersion {
+		return fmt.Errorf("agent state %s is version %d, but this agent only understands up to version %d", s.path, parsed.Version, agentStateVersion)
+	}
+	if parsed.Packages == nil {
+		parsed.Packages = make(map[string]*PackageState)
+	}
+	s.Version = parsed.Version
+	s.Packages = parsed.Packages
+	s.LastCheckIn = parsed.LastCheckIn
+	s.ServerVersion = parsed.ServerVersion
+	s.ConfigRevision = parsed.ConfigRevision
+	return nil
+}
+
+// update applies change and saves the state. `assimilator install` and a
+// running agent write the same file, so change is applied to what's on disk,
+// with the file locked until it's saved.
+func (s *AgentState) update(change func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		change()
+		return nil
+	}
+	lockFile, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the agent state lock: %w", err)
+	}
+	// Closing the file releases the lock
+	defer lockFile.Close()
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock the agent state: %w", err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to read agent state: %w", err)
+	default:
+		if err := s.parse(data); err != nil {
+			return err
+		}
+	}
+	change()
+	return s.save()
+}
+
+// save writes the state to a temporary file and renames it over the real one
+func (s *AgentState) save() error {
+	if s.readOnly {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal agent state: %w", err)
+	}
+	tempPath := s.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write agent state: %w", err)
+	}
+	if err := os.Rename(tempPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace agent state: %w", err)
+	}
+	return nil
+}
+
+// step returns a copy of the recorded state for a package step, or nil if it never ran
+func (s *AgentState) step(packageName string, action string, runAsUser string) *StepState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packageState, ok := s.Packages[packageName]
+	if !ok {
+		return nil
+	}
+	step, ok := packageState.Steps[stepKey(action, runAsUser)]
+	if !ok {
+		return nil
+	}
+	stepCopy := *step
+	return &stepCopy
+}
+
+// previousStep returns a copy of the step that last succeeded with action
+// as any user, or nil if there's none. A step whose runasuser changed is
+// stored under a new key, so this finds what it ran with before.
+func (s *AgentState) previousStep(packageName string, action string) *StepState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packageState, ok := s.Packages[packageName]
+	if !ok {
+		return nil
+	}
+	var previous *StepState
+	for _, step := range packageState.Steps {
+		if step.Action != action || step.AdHoc || step.LastSuccessTime.IsZero() {
+			continue
+		}
+		if previous == nil || step.LastSuccessTime.After(previous.LastSuccessTime) {
+			previous = step
+		}
+	}
+	if previous == nil {
+		return nil
+	}
+	stepCopy := *previous
+	return &stepCopy
+}
+
+// recordCheckIn stores what the server returned and which packages it assigned
+func (s *AgentState) recordCheckIn(serverVersion string, configRevision string, packages map[string]*pb.PackageConfig) error {
+	return s.update(func() {
+		s.applyCheckIn(serverVersion, configRevision, packages)
+	})
+}
+
+func (s *AgentState) applyCheckIn(serverVersion string, configRevision string, packages map[string]*pb.PackageConfig) {
+	s.LastCheckIn = time.Now()
+	s.ServerVersion = serverVersion
+	s.ConfigRevision = configRevision
+	for _, packageState := range s.Packages {
+		packageState.Assigned = false
+	}
+	for packageName, packageConfig := range packages {
+		packageState, ok := s.Packages[packageName]
+		if !ok {
+			packageState = &PackageState{Steps: make(map[string]*StepState)}
+			s.Packages[packageName] = packageState
+		}
+		packageState.Assigned = true
+		packageState.ServerChecksum = packageConfig.GetChecksum()
+
+		// Opting in or out of uninstalling applies without waiting for the step to run again
+		for _, packageStep := range packageConfig.GetPackageSteps() {
+			runAsUser := packageStep.GetRunasuser()
+			if runAsUser == "_all" {
+				runAsUser = appConfig.RunAsUser
+			}
+			if step, ok := packageState.Steps[stepKey(packageStep.GetAction(), runAsUser)]; ok {
+				step.UninstallOnRemoval = packageStep.GetUninstallOnRemoval()
+			}
+		}
+	}
+}
+
+// recordRun stores the result of running a package's script and saves the state
+func (s *AgentState) recordRun(p *packageInfo, status string, configRevision string, offline bool) error {
+	return s.update(func() {
+		s.applyRun(p, status, configRevision, offline)
+	})
+}
+
+func (s *AgentState) applyRun(p *packageInfo, status string, configRevision string, offline bool) {
+	packageState, ok := s.Packages[p.name]
+	if !ok {
+		packageState = &PackageState{Steps: make(map[string]*StepState)}
+		s.Packages[p.name] = packageState
+	}
+	key := stepKey(p.action, p.runAsUser)
+	if p.adhoc {
+		key = adHocStepKey(p.action, p.runAsUser)
+	}
+	step, ok := packageState.Steps[key]
+	if !ok {
+		step = &StepState{Action: p.action, RunAsUser: p.runAsUser}
+		packageState.Steps[key] = step
+	}
+
+	step.LastRunTime = p.startTime
+	if status == scriptStatusSuccess {
+		step.LastSuccessTime = p.startTime
+		step.Applied = p.fingerprint(s.hashKey)
+	}
+	step.Checksum = p.serverChecksum
+	step.ArgumentsHash = hashStrings(s.hashKey, p.arguments)
+	step.Status = status
+	step.Compliance = p.compliance
+	step.ExitCode = p.exitCode
+	step.DurationMs = p.duration.Milliseconds()
+	step.ConfigRevision = configRevision
+	step.Offline = offline
+	step.AdHoc = p.adhoc
+	if p.adhoc && !packageState.Assigned {
+		// Nothing else records the checksum of a package outside the config
+		packageState.ServerChecksum = p.serverChecksum
+	}
+	step.UninstallOnRemoval = p.uninstallOnRemoval
+}
+
+// forgetPackage removes everything recorded about a package
+func (s *AgentState) forgetPackage(packageName string) error {
+	return s.update(func() {
+		delete(s.Packages, packageName)
+	})
+}
+
+// migrateLastRunFiles moves <cacheDir>/<pkg>/<action>_<user>_lastRunTime.txt
+// files into the state, removing them if removeOld is set
+func (s *AgentState) migrateLastRunFiles(cacheDir string, removeOld bool) {
+	lastRunPaths, err := filepath.Glob(filepath.Join(cacheDir, "*", "*"+lastRunTimeSuffix))
+	if err != nil || len(lastRunPaths) == 0 {
+		return
+	}
+	Info("Migrating ", len(lastRunPaths), " lastRunTime files into the agent state")
+	for _, lastRunPath := range lastRunPaths {
+		packageName := filepath.Base(filepath.Dir(lastRunPath))
+		action, runAsUser, ok := splitLastRunFilename(filepath.Base(lastRunPath))
+		if !ok {
+			Warning("Cannot work out the action and user of ", lastRunPath, ". Skipping it.")
+			continue
+		}
+		content, err := os.ReadFile(lastRunPath)
+		if err != nil {
+			Error("error opening ", lastRunPath, ": ", err)
+			continue
+		}
+		epoch, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			Error("error parsing ", lastRunPath, " as Epoch int: ", err)
+			continue
+		}
+
+		packageState, ok := s.Packages[packageName]
+		if !ok {
+			packageState = &PackageState{Steps: make(map[string]*StepState)}
+			s.Packages[packageName] = packageState
+		}
+		// The old files were only written after a successful run
+		lastRunTime := time.Unix(epoch, 0)
+		packageState.Steps[stepKey(action, runAsUser)] = &StepState{
+			Action:          action,
+			RunAsUser:       runAsUser,
+			LastRunTime:     lastRunTime,
+			LastSuccessTime: lastRunTime,
+			Status:          scriptStatusSuccess,
+		}
+		Debug("Migrated ", lastRunPath)
+		if !removeOld {
+			continue
+		}
+		if err := os.Remove(lastRunPath); err != nil {
+			Error("failed to remove ", lastRunPath, ": ", err)
+		}
+	}
+}
+
+// splitLastRunFilename splits "<action>_<user>_lastRunTime.txt". Both parts may
+// contain underscores, so the split that names an existing user wins.
+func splitLastRunFilename(filename string) (string, string, bool) {
+	name := strings.TrimSuffix(filename, lastRunTimeSuffix)
+	fallback := strings.LastIndex(name, "_")
+	if fallback <= 0 || fallback == len(name)-1 {
+		return "", "", false
+	}
+	for i := range len(name) {
+		if name[i] != '_' || i == 0 || i == len(name)-1 {
+			continue
+		}
+		if _, err := user.Lookup(name[i+1:]); err == nil {
+			return name[:i], name[i+1:], true
+		}
+	}
+	return name[:fallback], name[fallback+1:], true
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+func TestLoadAgentState(t *testing.T) {
+	testCases := []struct {
+		name      string
+		stateFile string // Written to state.json first, unless empty
+		lastRuns  map[string]string
+		readOnly  bool
+
+		expectErr          bool
+		expectedSteps      map[string]string // package -> step key
+		expectStateFile    bool
+		expectLastRunFiles bool
+	}{
+		{
+			name:            "New state",
+			expectStateFile: true,
+		},
+		{
+			name:               "Migrates lastRunTime files",
+			lastRuns:           map[string]string{"vim/install_root_lastRunTime.txt": "1700000000"},
+			expectedSteps:      map[string]string{"vim": "install/root"},
+			expectStateFile:    true,
+			expectLastRunFiles: false,
+		},
+		{
+			name:               "Read-only migration leaves everything in place",
+			lastRuns:           map[string]string{"vim/install_root_lastRunTime.txt": "1700000000"},
+			readOnly:           true,
+			expectedSteps:      map[string]string{"vim": "install/root"},
+			expectStateFile:    false,
+			expectLastRunFiles: true,
+		},
+		{
+			name:            "Existing state",
+			stateFile:       `{"version": 1, "packages": {"git": {"assigned": true, "steps": {"install/root": {"action": "install", "runasuser": "root"}}}}}`,
+			expectedSteps:   map[string]string{"git": "install/root"},
+			expectStateFile: true,
+		},
+		{
+			name:      "Newer version",
+			stateFile: `{"version": 99}`,
+			expectErr: true,
+		},
+		{
+			name:      "Corrupt state",
+			stateFile: `{`,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			stateDir := filepath.Join(t.TempDir(), "state")
+			cacheDir := t.TempDir()
+			if tc.stateFile != "" {
+				os.MkdirAll(stateDir, 0755)
+				os.WriteFile(filepath.Join(stateDir, agentStateFilename), []byte(tc.stateFile), 0644)
+			}
+			for name, content := range tc.lastRuns {
+				os.MkdirAll(filepath.Join(cacheDir, filepath.Dir(name)), 0755)
+				os.WriteFile(filepath.Join(cacheDir, name), []byte(content), 0644)
+			}
+
+			// --- Act ---
+			state, err := loadAgentState(stateDir, cacheDir, tc.readOnly)
+
+			// --- Assert ---
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			for packageName, key := range tc.expectedSteps {
+				if _, ok := state.Packages[packageName].Steps[key]; !ok {
+					t.Errorf("Expected step %s of %s, but got %+v", key, packageName, state.Packages[packageName])
+				}
+			}
+			if fileExists(filepath.Join(stateDir, agentStateFilename)) != tc.expectStateFile {
+				t.Errorf("Expected the state file to exist: %v", tc.expectStateFile)
+			}
+			for name := range tc.lastRuns {
+				if fileExists(filepath.Join(cacheDir, name)) != tc.expectLastRunFiles {
+					t.Errorf("Expected %s to exist: %v", name, tc.expectLastRunFiles)
+				}
+			}
+		})
+	}
+}
+
+func TestAgentStateRoundTrip(t *testing.T) {
+	stateDir := t.TempDir()
+	state, err := loadAgentState(stateDir, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packageInfo{name: "vim", action: "install", runAsUser: "root", serverChecksum: "abc", startTime: time.Unix(1700000000, 0), exitCode: 0}
+	if err := state.recordRun(p, scriptStatusSuccess, "rev1", false); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadAgentState(stateDir, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := reloaded.step("vim", "install", "root")
+	if step == nil {
+		t.Fatalf("Expected the step to be saved")
+	}
+	if step.Status != scriptStatusSuccess || step.Checksum != "abc" || step.ConfigRevision != "rev1" || !step.LastSuccessTime.Equal(p.startTime) {
+		t.Errorf("Unexpected step after reloading: %+v", step)
+	}
+	if step.Applied != p.fingerprint(reloaded.hashKey) {
+		t.Errorf("Expected the applied fingerprint to be saved, but got %+v", step.Applied)
+	}
+	if fileExists(filepath.Join(stateDir, agentStateFilename+".tmp")) {
+		t.Errorf("Expected the temporary file to be renamed away")
+	}
+}
+
+func TestSplitLastRunFilename(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name           string
+		filename       string
+		expectedAction string
+		expectedUser   string
+		expectOk       bool
+	}{
+		{name: "Simple", filename: "install_nosuchuser_lastRunTime.txt", expectedAction: "install", expectedUser: "nosuchuser", expectOk: true},
+		{name: "Underscore falls back to the last one", filename: "post_install_nosuchuser_lastRunTime.txt", expectedAction: "post_install", expectedUser: "nosuchuser", expectOk: true},
+		{name: "Existing user wins", filename: "post_install_" + currentUser.Username + "_lastRunTime.txt", expectedAction: "post_install", expectedUser: currentUser.Username, expectOk: true},
+		{name: "No user", filename: "install_lastRunTime.txt"},
+		{name: "Trailing underscore", filename: "install__lastRunTime.txt"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			action, runAsUser, ok := splitLastRunFilename(tc.filename)
+			if ok != tc.expectOk {
+				t.Fatalf("Expected ok %v, but got %v", tc.expectOk, ok)
+			}
+			if ok && (action != tc.expectedAction || runAsUser != tc.expectedUser) {
+				t.Errorf("Expected %s and %s, but got %s and %s", tc.expectedAction, tc.expectedUser, action, runAsUser)
+			}
+		})
+	}
+}
+
+func TestAgentStateSharedWithInstall(t *testing.T) {
+	stateDir, cacheDir := t.TempDir(), t.TempDir()
+	agent, err := loadAgentState(stateDir, cacheDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	install, err := loadAgentState(stateDir, cacheDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent and `assimilator install` each write after the other loaded
+	if err := agent.recordCheckIn("1.0.0", "rev1", map[string]*pb.PackageConfig{"vim": {Checksum: "abc"}}); err != nil {
+		t.Fatal(err)
+	}
+	adhoc := &packageInfo{name: "htop", action: "install", runAsUser: "root", adhoc: true, startTime: time.Now()}
+	if err := install.recordRun(adhoc, scriptStatusSuccess, "rev1", false); err != nil {
+		t.Fatal(err)
+	}
+	assigned := &packageInfo{name: "vim", action: "install", runAsUser: "root", startTime: time.Now()}
+	if err := agent.recordRun(assigned, scriptStatusSuccess, "rev1", false); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := loadAgentState(stateDir, cacheDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved.Packages["htop"].Steps[adHocStepKey("install", "root")]; !ok {
+		t.Errorf("Expected the agent to keep the ad-hoc run, but got %+v", saved.Packages)
+	}
+	if vim := saved.Packages["vim"]; vim == nil || !vim.Assigned || vim.Steps[stepKey("install", "root")] == nil {
+		t.Errorf("Expected vim's check-in and run, but got %+v", vim)
+	}
+}
+
+func TestAgentStateConcurrentWriters(t *testing.T) {
+	stateDir, cacheDir := t.TempDir(), t.TempDir()
+	var wg sync.WaitGroup
+	for writer := range 4 {
+		state, err := loadAgentState(stateDir, cacheDir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 10 {
+				p := &packageInfo{name: fmt.Sprintf("package-%d-%d", writer, i), action: "install", runAsUser: "root", startTime: time.Now()}
+				if err := state.recordRun(p, scriptStatusSuccess, "", false); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	saved, err := loadAgentState(stateDir, cacheDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Packages) != 40 {
+		t.Errorf("Expected every writer's 10 runs, 40 in all, but got %d", len(saved.Packages))
+	}
+}
+
+func TestAdHocRunKeptApart(t *testing.T) {
+	state := newTestState()
+	assigned := &packageInfo{name: "vim", action: "install", runAsUser: "root", serverChecksum: "abc", arguments: []string{"--yes"}, startTime: time.Unix(1700000000, 0)}
+	state.recordRun(assigned, scriptStatusSuccess, "", false)
+	adhoc := &packageInfo{name: "vim", action: "install", runAsUser: "root", serverChecksum: "abc", arguments: []string{"--debug"}, adhoc: true, startTime: time.Unix(1800000000, 0)}
+	state.recordRun(adhoc, scriptStatusSuccess, "", false)
+
+	step := state.step("vim", "install", "root")
+	if step == nil || step.AdHoc || !step.LastRunTime.Equal(assigned.startTime) || step.Applied.ArgumentsHash != assigned.fingerprint(state.hashKey).ArgumentsHash {
+		t.Errorf("Expected the assigned step to be untouched by the ad-hoc run, but got %+v", step)
+	}
+	if previous := state.previousStep("vim", "install"); previous == nil || previous.AdHoc {
+		t.Errorf("Expected the assigned step, not the ad-hoc run, but got %+v", previous)
+	}
+	if len(state.Packages["vim"].Steps) != 2 {
+		t.Errorf("Expected the assigned step and the ad-hoc run, but got %v", state.Packages["vim"].Steps)
+	}
+}
+
+func TestStateKey(t *testing.T) {
+	stateDir := t.TempDir()
+	if key, err := loadStateKey(stateDir, true); err != nil || key != nil {
+		t.Errorf("Expected a read-only state to do without a key, but got %v, %v", key, err)
+	}
+
+	key, err := loadStateKey(stateDir, false)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	if len(key) != stateKeySize {
+		t.Errorf("Expected a %d byte key, but got %d bytes", stateKeySize, len(key))
+	}
+	info, err := os.Stat(filepath.Join(stateDir, stateKeyFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key to be private, but its mode is %v", info.Mode().Perm())
+	}
+
+	for _, readOnly := range []bool{false, true} {
+		if again, err := loadStateKey(stateDir, readOnly); err != nil || !bytes.Equal(again, key) {
+			t.Errorf("Expected the same key when read-only is %v, but got %v, %v", readOnly, again, err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(stateDir, stateKeyFilename), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadStateKey(stateDir, false); err == nil {
+		t.Errorf("Expected an error for a truncated key")
+	}
+}
+
+func TestStateHashesAreKeyed(t *testing.T) {
+	state, err := loadAgentState(t.TempDir(), t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packageInfo{name: "app", action: "install", runAsUser: "root", arguments: []string{"--token", "s3cr3t"}, startTime: time.Now()}
+	if err := state.recordRun(p, scriptStatusSuccess, "", false); err != nil {
+		t.Fatal(err)
+	}
+	step := state.step("app", "install", "root")
+	if plain := hashStrings(nil, p.arguments); step.ArgumentsHash == plain || step.Applied.ArgumentsHash == plain {
+		t.Errorf("Expected the saved argument hashes not to be plain SHA256")
+	}
+	if !step.Applied.Keyed {
+		t.Errorf("Expected the applied fingerprint to be keyed")
+	}
+}
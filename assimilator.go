@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
@@ -24,11 +25,6 @@ var (
 	Unhandled = asslog.Unhandled
 )
 
-// TODO
-//	- allow one-offs
-//		- assimilator install <package name>
-//	- allow not needing to be run as root
-
 func main() {
 	asslog.StartLogger()
 	defer asslog.Close()
@@ -48,10 +44,18 @@ func main() {
 	Trace("Commit: ", commit)
 	Trace("Build Date: ", buildDate)
 
-	if appConfig.IsServer {
+	if flag.NArg() > 0 {
+		asslog.Close(runSubcommand(flag.Args()))
+	}
+
+	switch {
+	case appConfig.IsServer:
 		Info("Running as server")
 		Server()
-	} else {
+	case appConfig.Plan:
+		Info("Running as agent in plan mode")
+		AgentPlan()
+	default:
 		Info("Running as agent")
 		commandRunner := LiveCommandRunner{}
 		Agent(&commandRunner)
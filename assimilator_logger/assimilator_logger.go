@@ -169,6 +169,12 @@ func Close(ExitCode ...int) {
 	os.Exit(0)
 }
 
+// Flush writes out everything logged so far and stops the logger without
+// exiting, e.g. before the process re-executes itself. Later logs are dropped.
+func Flush() {
+	globalLogger.Close()
+}
+
 func getCallerInfo(skip int) string {
 	pc, file, line, ok := runtime.Caller(skip)
 	if !ok {
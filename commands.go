@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// subcommand is a command given after the flags, e.g. `assimilator status --json`.
+// Each subcommand parses its own flags from args.
+type subcommand struct {
+	summary string
+	run     func(args []string) int
+}
+
+var subcommands = map[string]subcommand{
+	"status":   {summary: "Show the packages this agent has applied", run: statusCommand},
+	"match":    {summary: "Explain which machines: entries apply to a host", run: matchCommand},
+	"render":   {summary: "Print a machine's effective config, showing where each step came from", run: renderCommand},
+	"validate": {summary: "Check config.yaml for problems, exiting non-zero if it has any", run: validateCommand},
+	"install":  {summary: "Run a single package from the server once, even if it isn't assigned", run: installCommand},
+	"run-now":  {summary: "Make the running agent check now, or run a single package", run: controlCommand(controlRunNow)},
+	"pause":    {summary: "Stop the running agent's scheduled checks", run: controlCommand(controlPause)},
+	"resume":   {summary: "Resume the running agent's scheduled checks", run: controlCommand(controlResume)},
+}
+
+// runSubcommand runs the named subcommand and returns its exit code
+func runSubcommand(args []string) int {
+	command, ok := subcommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		printSubcommands()
+		return 2
+	}
+	Trace("Running command: ", args[0])
+	return command.run(args[1:])
+}
+
+func printSubcommands() {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, subcommands[name].summary)
+	}
+}
+
+// usage prints the flags followed by the available subcommands
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command] [command flags]\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr)
+	printSubcommands()
+}
+
+// newCommandFlags returns a flag set for a subcommand
+func newCommandFlags(name string, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] %s [command flags] %s\n\nCommand flags:\n", os.Args[0], name, args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
@@ -5,14 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/user"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/caarlos0/env/v11"
 	toml "github.com/pelletier/go-toml/v2"
-	"gopkg.in/yaml.v3"
 
 	// Import the YAML library
 	asslog "github.com/geogian28/Assimilator/assimilator_logger"
@@ -34,6 +34,7 @@ type AppConfig struct {
 	Hostname              string                `toml:"-" env:"ASSIMILATOR_HOSTNAME"`
 	packageMap            map[string]PackageMap `toml:"-" yaml:"package_map"`
 	CacheDir              string                //`toml:"cache_dir" env:"ASSIMILATOR_CACHE_DIR"`
+	StateDir              string                `toml:"state_dir" env:"ASSIMILATOR_STATE_DIR"`
 	version               string                `toml:"-"`
 	commit                string                `toml:"-"`
 	buildDate             string                `toml:"-"`
@@ -43,8 +44,24 @@ type AppConfig struct {
 	RunAsUser             string                `toml:"-" env:"ASSIMILATOR_RUN_AS_USER"`
 	CurrentUser           string                `toml:"-"`
 	RunOnce               bool                  `toml:"-"`
+	Plan                  bool                  `toml:"-"`
+	PlanFormat            string                `toml:"-"`
 	PackageUpdateInterval int64                 `toml:"package_update_interval" env:"ASSIMILATOR_PACKAGE_UPDATE_INTERVAL"`
 	UpdateCheckInterval   int64                 `toml:"update_check_interval" env:"ASSIMILATOR_UPDATE_CHECK_INTERVAL"`
+	UpdateCheckSplay      int64                 `toml:"update_check_splay" env:"ASSIMILATOR_UPDATE_CHECK_SPLAY"`
+	MaxCheckBackoff       int64                 `toml:"max_check_backoff" env:"ASSIMILATOR_MAX_CHECK_BACKOFF"`
+	AgentPollInterval     int64                 `toml:"agent_poll_interval" env:"ASSIMILATOR_AGENT_POLL_INTERVAL"`
+	MaxRemovalsPerCycle   int                   `toml:"max_removals_per_cycle" env:"ASSIMILATOR_MAX_REMOVALS_PER_CYCLE"`
+	ScriptTimeout         int64                 `toml:"script_timeout" env:"ASSIMILATOR_SCRIPT_TIMEOUT"`
+	ScriptLogRetention    int                   `toml:"script_log_retention" env:"ASSIMILATOR_SCRIPT_LOG_RETENTION"`
+	OfflineMaxAge         int64                 `toml:"offline_max_age" env:"ASSIMILATOR_OFFLINE_MAX_AGE"`
+	SelfUpdate            bool                  `toml:"self_update" env:"ASSIMILATOR_SELF_UPDATE"`
+	UpdatePublicKey       string                `toml:"update_public_key" env:"ASSIMILATOR_UPDATE_PUBLIC_KEY"`
+	UpdateSigningKey      string                `toml:"update_signing_key" env:"ASSIMILATOR_UPDATE_SIGNING_KEY"`
+	AgentBinaryDir        string                `toml:"agent_binary_dir" env:"ASSIMILATOR_AGENT_BINARY_DIR"`
+	ControlSocket         string                `toml:"control_socket" env:"ASSIMILATOR_CONTROL_SOCKET"`
+	AdminGroup            string                `toml:"admin_group" env:"ASSIMILATOR_ADMIN_GROUP"`
+	SecretsIdentity       string                `toml:"secrets_identity" env:"ASSIMILATOR_SECRETS_IDENTITY"`
 	TestMode              bool
 }
 
@@ -60,20 +77,73 @@ var appConfig = AppConfig{
 	ServerIP:              "0.0.0.0",
 	ServerPort:            2390,
 	CacheDir:              userCacheDir(),
+	StateDir:              userStateDir(),
 	CurrentUser:           runningUser(),
 	RunAsUser:             runningUser(),
 	PackageUpdateInterval: 600,
 	UpdateCheckInterval:   60,
+	UpdateCheckSplay:      30,
+	MaxCheckBackoff:       900,
+	MaxRemovalsPerCycle:   5,
+	ScriptTimeout:         3600,
+	ScriptLogRetention:    10,
+	OfflineMaxAge:         604800,
+	SelfUpdate:            true,
+	UpdatePublicKey:       filepath.Join(userConfigDir(), "update.pub"),
+	UpdateSigningKey:      filepath.Join(userConfigDir(), "update.key"),
+	AgentBinaryDir:        "/usr/lib/assimilator/agents",
+	ControlSocket:         userControlSocket(),
+	AdminGroup:            "assimilator",
+	SecretsIdentity:       filepath.Join(userConfigDir(), "secrets.key"),
 }
 
 type DesiredState struct {
-	Profiles map[string]ProfileConfig `yaml:"profiles"`
-	Machines map[string]MachineConfig `yaml:"machines"`
+	Profiles     map[string]ProfileConfig `yaml:"profiles"`
+	Machines     map[string]MachineConfig `yaml:"machines"`
+	FactProfiles []FactProfile            `yaml:"fact_profiles"`
+	AdHoc        AdHocConfig              `yaml:"adhoc"`
+	Vars         map[string]string        `yaml:"vars"`    // Variables for every machine's step arguments
+	Include      []string                 `yaml:"include"` // Globs of more config files. Only read from config.yaml
+
+	secrets *secretStore // The !secret values, which are replaced with placeholders
+
+	selectors []machineSelector // The `machines:` keys, from the least to the most specific
+}
+
+// AdHocConfig decides which packages `assimilator install` may fetch without
+// them being in a machine's config. Both lists take path.Match patterns, deny
+// wins over allow, and packages in neither are denied.
+type AdHocConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// allows reports whether packageName may be installed ad hoc
+func (c AdHocConfig) allows(packageName string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, packageName); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return matches(c.Allow) && !matches(c.Deny)
+}
+
+// FactProfile applies profiles to every machine whose facts match, e.g.
+// all arm64 Debian machines. A match is required: an empty one is rejected,
+// since it would give any hostname that checks in a config.
+type FactProfile struct {
+	Match           map[string]string `yaml:"match"`
+	AppliedProfiles []string          `yaml:"applied_profiles"`
 }
 
 type ProfileConfig struct {
-	AppConfig AppConfig                `yaml:"app_config"`
-	Packages  map[string][]PackageStep `yaml:"packages"`
+	AppConfig       AppConfig                `yaml:"app_config"`
+	AppliedProfiles []string                 `yaml:"applied_profiles"` // Profiles this one builds on, applied before it
+	Packages        map[string][]PackageStep `yaml:"packages"`
+	Vars            map[string]string        `yaml:"vars"`
 }
 
 type MachineConfig struct {
@@ -81,13 +151,32 @@ type MachineConfig struct {
 	AppliedConfig   string                   `yaml:"applied_config"`
 	AppliedProfiles []string                 `yaml:"applied_profiles"`
 	Packages        map[string][]PackageStep `yaml:"packages"`
+	ExcludePackages []string                 `yaml:"exclude_packages,omitempty"` // Packages its profiles bring in that it doesn't want
+	Vars            map[string]string        `yaml:"vars"`
+
+	ownPackages map[string][]PackageStep // Packages before its profiles were applied
+	entries     []string                 // The `machines:` entries merged into this config
+	merge       packageMerge             // How each package came to be in Packages
+	vars        map[string]string        // Vars merged from the global ones, its profiles and its entries
 }
 
 type PackageStep struct {
-	Checksum  string   `yaml:"checksum,omitempty"`
-	Action    string   `yaml:"action"`
-	Arguments []string `yaml:"arguments,omitempty"`
-	RunAsUser string   `yaml:"runasuser,omitempty"`
+	Checksum  string   `yaml:"checksum,omitempty" json:"checksum,omitempty"`
+	Action    string   `yaml:"action" json:"action"`
+	Arguments []string `yaml:"arguments,omitempty" json:"arguments,omitempty"`
+	RunAsUser string   `yaml:"runasuser,omitempty" json:"runasuser,omitempty"`
+	Timeout   int64    `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Environment variables set for the package's scripts
+	Env map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// When is a condition on the machine's facts and vars. The step is only
+	// served to machines it's true for
+	When string `yaml:"when,omitempty" json:"when,omitempty"`
+
+	UninstallOnRemoval bool `yaml:"uninstall_on_removal,omitempty" json:"uninstall_on_removal,omitempty"`
+	hasSecrets         bool // Whether revealed secrets are in its arguments or env
+	// Replace drops the steps profiles applied earlier gave this package
+	// instead of adding to them
+	Replace bool `yaml:"replace,omitempty" json:"replace,omitempty"`
 }
 
 type PackageMap struct {
@@ -106,6 +195,7 @@ type CliFlags struct {
 	LogFileLocation       string
 	RepoDir               string
 	CacheDir              string
+	StateDir              string
 	ServerIP              string
 	ServerPort            int
 	Hostname              string
@@ -114,8 +204,24 @@ type CliFlags struct {
 	ConfigFilename        string
 	RunAsUser             string
 	RunOnce               bool
+	Plan                  bool
+	PlanFormat            string
 	PackageUpdateInterval int64
 	UpdateCheckInterval   int64
+	UpdateCheckSplay      int64
+	MaxCheckBackoff       int64
+	AgentPollInterval     int64
+	MaxRemovalsPerCycle   int
+	ScriptTimeout         int64
+	ScriptLogRetention    int
+	OfflineMaxAge         int64
+	SelfUpdate            bool
+	UpdatePublicKey       string
+	UpdateSigningKey      string
+	AgentBinaryDir        string
+	ControlSocket         string
+	AdminGroup            string
+	SecretsIdentity       string
 	TestMode              bool
 }
 
@@ -136,19 +242,23 @@ func fileExists(filename string) bool {
 }
 
 func ConfigFromFile() {
+	// Root uses /etc/assimilator and everyone else their own XDG config dir
+	configDir := userConfigDir()
+	configPath := filepath.Join(configDir, "config.toml")
+
 	// 1. Ensure folder exists:
-	err := os.MkdirAll("/etc/assimilator", 0755)
+	err := os.MkdirAll(configDir, 0755)
 	if err != nil {
 		switch {
 		case errors.Is(err, os.ErrPermission):
-			Error("Cannot make /etc/assimilator directory. Try running as root.")
+			Error("Cannot make ", configDir, " directory: permission denied.")
 			return
 		default:
 			asslog.Unhandled("Error creating assimilator directory: ", err)
 		}
 	}
 	// 2. Ensure file exists
-	if !fileExists("/etc/assimilator/config.toml") {
+	if !fileExists(configPath) {
 		Info("Config file does not exist. Making one.")
 		defaultConfig, err := toml.Marshal(TomlConfigWrapper{
 			Config: AppConfig{
@@ -160,24 +270,36 @@ func ConfigFromFile() {
 				ServerPort:            2390,
 				PackageUpdateInterval: 600,
 				UpdateCheckInterval:   60,
+				UpdateCheckSplay:      30,
+				MaxCheckBackoff:       900,
+				MaxRemovalsPerCycle:   5,
+				ScriptTimeout:         3600,
+				ScriptLogRetention:    10,
+				OfflineMaxAge:         604800,
+				SelfUpdate:            true,
+				UpdatePublicKey:       filepath.Join(configDir, "update.pub"),
+				UpdateSigningKey:      filepath.Join(configDir, "update.key"),
+				AgentBinaryDir:        "/usr/lib/assimilator/agents",
+				AdminGroup:            "assimilator",
+				SecretsIdentity:       filepath.Join(configDir, "secrets.key"),
 			},
 		})
 		if err != nil {
 			Unhandled("Error marshalling default config: ", err)
 		}
-		err = os.WriteFile("/etc/assimilator/config.toml", []byte(defaultConfig), 0644)
+		err = os.WriteFile(configPath, []byte(defaultConfig), 0644)
 		if err != nil {
 			switch {
 			case errors.Is(err, os.ErrPermission):
-				Error("Received permission denied while creating config file. Try running as root.")
+				Error("Received permission denied while creating config file ", configPath, ".")
 			default:
 				Unhandled("Error creating config file: ", err)
 			}
 		}
 	}
 
-	// Load configs from /etc/assimilator
-	configFile, err := os.ReadFile("/etc/assimilator/config.toml")
+	// Load configs from the config dir
+	configFile, err := os.ReadFile(configPath)
 	if err != nil {
 		Error("Failed to open config file: ", err)
 		return
@@ -241,6 +363,7 @@ func ParseFlags() *CliFlags {
 	flag.StringVar(&flags.LogTypes, "log_types", "console file", "Set log output locations (console, file)")
 	flag.StringVar(&flags.LogFileLocation, "log_file_location", logFileLocation(), "Set log file location. Root defaults to '/var/log/assimilator.log' and non-root defaults to '~/.local/state/assimilator.log'")
 	flag.StringVar(&flags.RepoDir, "repo_dir", "", "Set repository directory")
+	flag.StringVar(&flags.StateDir, "state_dir", userStateDir(), "Set the agent state directory. Root defaults to '/var/lib/assimilator' and non-root defaults to '~/.local/state/assimilator'")
 	flag.StringVar(&flags.ServerIP, "server_ip", "0.0.0.0", "Set server IP")
 	flag.IntVar(&flags.ServerPort, "server_port", 2390, "Set server port")
 	flag.StringVar(&flags.Hostname, "hostname", "", "Set Hostname of the agent. Useful if you want to get another machine config")
@@ -248,10 +371,27 @@ func ParseFlags() *CliFlags {
 	flag.StringVar(&flags.TormonAddress, "tormon_address", "", "If set, sends failures to Tormon")
 	flag.StringVar(&flags.ConfigFilename, "config_filename", "", "Set the config filename. Defaults to config.yaml")
 	flag.BoolVar(&flags.RunOnce, "runonce", false, "Run assimilator once and exit")
+	flag.BoolVar(&flags.Plan, "plan", false, "Print what the agent would do for each package and exit without running any script")
+	flag.StringVar(&flags.PlanFormat, "plan_format", "text", "Set the plan output format (text, json)")
 	flag.Int64Var(&flags.PackageUpdateInterval, "package_update_interval", 600, "Set how often the package should be reapplied even if there's been no changes from the server. This is the package update interval in seconds. 0 means always update.")
 	flag.Int64Var(&flags.UpdateCheckInterval, "update_check_interval", 60, "How often the update check should be performed in seconds.")
+	flag.Int64Var(&flags.UpdateCheckSplay, "update_check_splay", 30, "Up to how many random seconds to add to each update check interval, so agents don't all check in at once.")
+	flag.Int64Var(&flags.MaxCheckBackoff, "max_check_backoff", 900, "The longest the agent waits in seconds between checks while the server is unreachable.")
+	flag.Int64Var(&flags.AgentPollInterval, "agent_poll_interval", 0, "Server only. The update check interval in seconds the server tells agents to use. 0 lets agents use their own.")
+	flag.IntVar(&flags.MaxRemovalsPerCycle, "max_removals_per_cycle", 5, "Server only. The most removed packages an agent may uninstall in one check. Agents refuse to uninstall anything if more were removed.")
+	flag.Int64Var(&flags.ScriptTimeout, "script_timeout", 3600, "How long a package script may run in seconds before it is killed. Steps can override this with 'timeout'.")
+	flag.IntVar(&flags.ScriptLogRetention, "script_log_retention", 10, "How many script logs to keep per package step. 0 keeps them all.")
+	flag.Int64Var(&flags.OfflineMaxAge, "offline_max_age", 604800, "How old in seconds the last known config may be to keep applying it while the server is unreachable. 0 disables offline mode.")
+	flag.BoolVar(&flags.SelfUpdate, "self_update", true, "Replace the agent binary with the server's build when the server is newer, instead of exiting. Without the update public key or write access to the binary's directory the agent exits instead.")
+	flag.StringVar(&flags.UpdatePublicKey, "update_public_key", filepath.Join(userConfigDir(), "update.pub"), "The PEM ed25519 public key the agent verifies self-updates with.")
+	flag.StringVar(&flags.UpdateSigningKey, "update_signing_key", filepath.Join(userConfigDir(), "update.key"), "Server only. The PEM ed25519 private key used to sign agent binaries for self-update.")
+	flag.StringVar(&flags.AgentBinaryDir, "agent_binary_dir", "/usr/lib/assimilator/agents", "Server only. Where agent builds for other architectures are kept, named 'assimilator-linux-<arch>'.")
+	flag.StringVar(&flags.ControlSocket, "control_socket", userControlSocket(), "The agent's control socket, used by the run-now, pause and resume commands. Root defaults to '/run/assimilator/agent.sock'")
+	flag.StringVar(&flags.AdminGroup, "admin_group", "assimilator", "The group, besides root, allowed to use the agent's control socket")
+	flag.StringVar(&flags.SecretsIdentity, "secrets_identity", filepath.Join(userConfigDir(), "secrets.key"), "Server only. The age identity file that decrypts !secret values in the config.")
 	flag.BoolVar(&flags.TestMode, "test", false, "Test mode for development purposes")
 
+	flag.Usage = usage
 	flag.Parse() // Parse them once all are defined
 	return flags
 }
@@ -306,6 +446,9 @@ func ConfigFromFlags(flags *CliFlags) {
 	if userSetFlags["cache_dir"] {
 		appConfig.CacheDir = flags.CacheDir
 	}
+	if userSetFlags["state_dir"] {
+		appConfig.StateDir = flags.StateDir
+	}
 	if userSetFlags["server_ip"] {
 		appConfig.ServerIP = flags.ServerIP
 	}
@@ -327,9 +470,57 @@ func ConfigFromFlags(flags *CliFlags) {
 	if userSetFlags["runonce"] {
 		appConfig.RunOnce = flags.RunOnce
 	}
+	if userSetFlags["plan"] {
+		appConfig.Plan = flags.Plan
+	}
+	if userSetFlags["plan_format"] {
+		appConfig.PlanFormat = flags.PlanFormat
+	}
 	if userSetFlags["package_update_interval"] {
 		appConfig.PackageUpdateInterval = int64(flags.PackageUpdateInterval)
 	}
+	if userSetFlags["update_check_splay"] {
+		appConfig.UpdateCheckSplay = flags.UpdateCheckSplay
+	}
+	if userSetFlags["max_check_backoff"] {
+		appConfig.MaxCheckBackoff = flags.MaxCheckBackoff
+	}
+	if userSetFlags["agent_poll_interval"] {
+		appConfig.AgentPollInterval = flags.AgentPollInterval
+	}
+	if userSetFlags["max_removals_per_cycle"] {
+		appConfig.MaxRemovalsPerCycle = flags.MaxRemovalsPerCycle
+	}
+	if userSetFlags["script_timeout"] {
+		appConfig.ScriptTimeout = flags.ScriptTimeout
+	}
+	if userSetFlags["script_log_retention"] {
+		appConfig.ScriptLogRetention = flags.ScriptLogRetention
+	}
+	if userSetFlags["offline_max_age"] {
+		appConfig.OfflineMaxAge = flags.OfflineMaxAge
+	}
+	if userSetFlags["self_update"] {
+		appConfig.SelfUpdate = flags.SelfUpdate
+	}
+	if userSetFlags["update_public_key"] {
+		appConfig.UpdatePublicKey = flags.UpdatePublicKey
+	}
+	if userSetFlags["update_signing_key"] {
+		appConfig.UpdateSigningKey = flags.UpdateSigningKey
+	}
+	if userSetFlags["agent_binary_dir"] {
+		appConfig.AgentBinaryDir = flags.AgentBinaryDir
+	}
+	if userSetFlags["control_socket"] {
+		appConfig.ControlSocket = flags.ControlSocket
+	}
+	if userSetFlags["admin_group"] {
+		appConfig.AdminGroup = flags.AdminGroup
+	}
+	if userSetFlags["secrets_identity"] {
+		appConfig.SecretsIdentity = flags.SecretsIdentity
+	}
 	if userSetFlags["test"] {
 		appConfig.TestMode = flags.TestMode
 	}
@@ -351,12 +542,29 @@ func traceAppConfig() {
 	Trace("- ServerPort: ", appConfig.ServerPort)
 	Trace("- Hostname: ", appConfig.Hostname)
 	Trace("- CacheDir: ", appConfig.CacheDir)
+	Trace("- StateDir: ", appConfig.StateDir)
 	Trace("- TormonAdress: ", appConfig.TormonAddress)
 	Trace("- ConfigFilename: ", appConfig.ConfigFilename)
 	Trace("- RunAsUser: ", appConfig.RunAsUser)
 	Trace("- RunOnce: ", appConfig.RunOnce)
+	Trace("- Plan: ", appConfig.Plan)
+	Trace("- PlanFormat: ", appConfig.PlanFormat)
 	Trace("- PackageUpdateInterval: ", appConfig.PackageUpdateInterval)
 	Trace("- UpdateCheckInterval: ", appConfig.UpdateCheckInterval)
+	Trace("- UpdateCheckSplay: ", appConfig.UpdateCheckSplay)
+	Trace("- MaxCheckBackoff: ", appConfig.MaxCheckBackoff)
+	Trace("- AgentPollInterval: ", appConfig.AgentPollInterval)
+	Trace("- MaxRemovalsPerCycle: ", appConfig.MaxRemovalsPerCycle)
+	Trace("- ScriptTimeout: ", appConfig.ScriptTimeout)
+	Trace("- ScriptLogRetention: ", appConfig.ScriptLogRetention)
+	Trace("- OfflineMaxAge: ", appConfig.OfflineMaxAge)
+	Trace("- SelfUpdate: ", appConfig.SelfUpdate)
+	Trace("- UpdatePublicKey: ", appConfig.UpdatePublicKey)
+	Trace("- UpdateSigningKey: ", appConfig.UpdateSigningKey)
+	Trace("- AgentBinaryDir: ", appConfig.AgentBinaryDir)
+	Trace("- ControlSocket: ", appConfig.ControlSocket)
+	Trace("- AdminGroup: ", appConfig.AdminGroup)
+	Trace("- SecretsIdentity: ", appConfig.SecretsIdentity)
 }
 
 // processFlagsAndArgs processes the command line flags and returns the
@@ -423,6 +631,12 @@ func SetupAppConfig(flags *CliFlags) {
 	if appConfig.CacheDir == "" {
 		appConfig.CacheDir = userCacheDir()
 	}
+	if appConfig.StateDir == "" {
+		appConfig.StateDir = userStateDir()
+	}
+	if appConfig.ControlSocket == "" {
+		appConfig.ControlSocket = userControlSocket()
+	}
 	if appConfig.GithubBranch == "" {
 		appConfig.GithubBranch = "main"
 	}
@@ -489,6 +703,48 @@ func userCacheDir() string {
 	return filepath.Join(baseCacheDir, "assimilator")
 }
 
+func userStateDir() string {
+	user, err := user.Current()
+	if err != nil {
+		Error("Failed to get current user: ", err)
+		os.Exit(1)
+	}
+	if user.Username == "root" {
+		return "/var/lib/assimilator"
+	}
+	return filepath.Join(xdgStateHome(user.HomeDir), "assimilator")
+}
+
+// userConfigDir is where config.toml and the update key live. Root uses
+// /etc/assimilator and everyone else $XDG_CONFIG_HOME/assimilator.
+func userConfigDir() string {
+	if isRoot() {
+		return "/etc/assimilator"
+	}
+	baseConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		Error("Failed to get user config directory: ", err)
+		os.Exit(1)
+	}
+	return filepath.Join(baseConfigDir, "assimilator")
+}
+
+// xdgStateHome returns $XDG_STATE_HOME, which defaults to ~/.local/state
+func xdgStateHome(homeDir string) string {
+	if stateHome := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(stateHome) {
+		return stateHome
+	}
+	return filepath.Join(homeDir, ".local/state")
+}
+
+func userControlSocket() string {
+	if isRoot() {
+		return "/run/assimilator/agent.sock"
+	}
+	// Unprivileged agents keep everything under $HOME
+	return filepath.Join(userStateDir(), "agent.sock")
+}
+
 func logFileLocation() string {
 	user, err := user.Current()
 	if err != nil {
@@ -499,75 +755,147 @@ func logFileLocation() string {
 		return "/var/log/assimilator.log"
 	}
 
-	mkdir := exec.Command("mkdir", "-p", filepath.Join(user.HomeDir, ".local/state"))
-	if err := mkdir.Run(); err != nil {
+	stateHome := xdgStateHome(user.HomeDir)
+	if err := os.MkdirAll(stateHome, 0755); err != nil {
 		Error("Failed to create log directory: ", err)
 		os.Exit(1)
 	}
-	return filepath.Join(user.HomeDir, ".local/state/assimilator.log")
+	return filepath.Join(stateHome, "assimilator.log")
 }
 
-// LoadDesiredState reads the YAML file from the given path and unmarshals it into the AppConfig struct.
+// LoadDesiredState reads the YAML file from the given path, and the files it
+// brings in from its directory, and unmarshals them into the DesiredState struct.
 func LoadDesiredState(filePath string) (*DesiredState, error) {
-	Trace("Reading config file: ", filePath)
-	data, err := os.ReadFile(filePath)
+	return loadDesiredState(dirSource(filepath.Dir(filePath)), filepath.Base(filePath))
+}
+
+// loadDesiredState loads the desired state from rootFile in a checkout or a git commit
+func loadDesiredState(source configSource, rootFile string) (*DesiredState, error) {
+	files, err := loadConfigFiles(source, rootFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file '%s': %w", filePath, err)
+		return nil, err
 	}
-	var desiredState DesiredState
-	err = yaml.Unmarshal(data, &desiredState)
+	return desiredStateFromFiles(files)
+}
+
+// desiredStateFromFiles merges the config files and applies their profiles
+func desiredStateFromFiles(files []configFile) (*DesiredState, error) {
+	desiredState, err := mergeConfigFiles(files)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal YAML from '%s': %w", filePath, err)
+		return nil, err
 	}
+	filePath := files[0].path
 
 	// Apply profiles to machines and users
-	applyProfiles(&desiredState)
-	return &desiredState, nil
+	if err := applyProfiles(desiredState); err != nil {
+		return nil, fmt.Errorf("invalid profiles in '%s': %w", filePath, err)
+	}
+	if err := desiredState.parseMachineSelectors(); err != nil {
+		return nil, fmt.Errorf("invalid machines in '%s': %w", filePath, err)
+	}
+	if err := desiredState.checkFactProfiles(); err != nil {
+		return nil, fmt.Errorf("invalid fact_profiles in '%s': %w", filePath, err)
+	}
+	if err := desiredState.checkTemplates(); err != nil {
+		return nil, fmt.Errorf("invalid arguments in '%s': %w", filePath, err)
+	}
+	return desiredState, nil
 }
 
-func applyProfiles(desiredState *DesiredState) {
+// applyProfiles merges each machine's profiles into its packages. A machine's
+// applied_profiles are replaced with the resolved list, including the profiles
+// they build on.
+func applyProfiles(desiredState *DesiredState) error {
 	var ProfileNames []string
 	for profileName := range desiredState.Profiles {
 		ProfileNames = append(ProfileNames, profileName)
 	}
+	slices.Sort(ProfileNames)
 	Debug("Available profiles: ", strings.Join(ProfileNames, ", "))
 
-	for machineName, machineConfig := range desiredState.Machines {
-		mergedPackages := make(map[string][]PackageStep)
-
-		for _, profileName := range machineConfig.AppliedProfiles {
-			profile, ok := desiredState.Profiles[profileName]
-			if !ok {
-				Error("Cannot apply profile: ", profileName, " to machine: ", machineName, ": profile not found: ")
-				continue
-			}
+	// Check every profile for cycles, including ones no machine uses yet
+	if _, err := desiredState.resolveProfiles(ProfileNames); err != nil {
+		return err
+	}
 
-			Trace(fmt.Sprintf(`Copying packages from profile "%s" to machine: %s`, profileName, machineName))
-			combinePackageSteps(mergedPackages, profile.Packages)
-			// maps.Copy(machineConfig.Packages, profile.Packages)
+	for machineName, machineConfig := range desiredState.Machines {
+		resolvedProfiles, err := desiredState.resolveProfiles(machineConfig.AppliedProfiles)
+		if err != nil {
+			return fmt.Errorf("machine %s: %w", machineName, err)
 		}
-
-		Trace(fmt.Sprintf(`Applying specific overrides for machine: %s`, machineName))
-		combinePackageSteps(mergedPackages, machineConfig.Packages)
-		verifyPackages(mergedPackages)
-
-		machineConfig.Packages = mergedPackages
+		machineConfig.AppliedProfiles = resolvedProfiles
+		machineConfig.ownPackages = machineConfig.Packages
+		machineConfig.entries = []string{machineName}
 		desiredState.Machines[machineName] = machineConfig
 	}
+	for machineName, machineConfig := range desiredState.Machines {
+		machineConfig.Packages, machineConfig.merge = desiredState.mergePackages(machineName, machineConfig.AppliedProfiles, machineConfig.entries)
+		machineConfig.vars = desiredState.mergeVars(machineConfig.AppliedProfiles, machineConfig.entries)
+		desiredState.Machines[machineName] = machineConfig
+	}
+	return nil
 }
 
-func combinePackageSteps(target, source map[string][]PackageStep) {
-	for pkgName, pkgSteps := range source {
-		target[pkgName] = append(target[pkgName], pkgSteps...)
+// resolveProfiles expands profile names with the profiles they build on,
+// depth first, so a profile's own applied_profiles come before it. A profile
+// pulled in more than once only appears the first time. Profiles that don't
+// exist are kept so applying them reports the error.
+func (d *DesiredState) resolveProfiles(profileNames []string) ([]string, error) {
+	var resolved []string
+	var visit func(profileName string, chain []string) error
+	visit = func(profileName string, chain []string) error {
+		if i := slices.Index(chain, profileName); i >= 0 {
+			return fmt.Errorf("profile cycle: %s", strings.Join(append(chain[i:], profileName), " -> "))
+		}
+		if slices.Contains(resolved, profileName) {
+			return nil
+		}
+		chain = append(slices.Clone(chain), profileName)
+		for _, parent := range d.Profiles[profileName].AppliedProfiles {
+			if err := visit(parent, chain); err != nil {
+				return err
+			}
+		}
+		resolved = append(resolved, profileName)
+		return nil
+	}
+	for _, profileName := range profileNames {
+		if err := visit(profileName, nil); err != nil {
+			return nil, err
+		}
 	}
+	return resolved, nil
 }
 
-func verifyPackages(packages map[string][]PackageStep) {
-	for pkgName, pkgSteps := range packages {
-		for i, pkgStep := range pkgSteps {
-			if pkgStep.RunAsUser == "" {
-				packages[pkgName][i].RunAsUser = "root"
+// machineConfigFor returns the machine's config with the profiles its facts
+// match added in front of its own. Machines missing from `machines:` still
+// get a config if their facts match a fact profile.
+func (d *DesiredState) machineConfigFor(machineName string, facts map[string][]string) (MachineConfig, bool) {
+	machine, found := d.matchedMachineConfig(machineName, facts)
+	var factProfiles []string
+	for _, factProfile := range d.FactProfiles {
+		if !factsMatch(factProfile.Match, facts) {
+			continue
+		}
+		resolvedProfiles, err := d.resolveProfiles(factProfile.AppliedProfiles)
+		if err != nil {
+			// Cycles are reported when the config loads, so this can't happen
+			Error("Cannot apply fact profiles to machine: ", machineName, ": ", err)
+			continue
+		}
+		for _, profileName := range resolvedProfiles {
+			if !slices.Contains(machine.AppliedProfiles, profileName) && !slices.Contains(factProfiles, profileName) {
+				factProfiles = append(factProfiles, profileName)
 			}
 		}
 	}
+	if len(factProfiles) == 0 {
+		return machine, found
+	}
+
+	// Fact profiles apply before the machine's own profiles and packages
+	machine.AppliedProfiles = slices.Concat(factProfiles, machine.AppliedProfiles)
+	machine.Packages, machine.merge = d.mergePackages(machineName, machine.AppliedProfiles, machine.entries)
+	machine.vars = d.mergeVars(machine.AppliedProfiles, machine.entries)
+	return machine, true
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gopkg.in/yaml.v3"
+)
+
+// The desired state can be split across files. config.yaml is read first,
+// then, each in name order:
+//
+//	config.d/*.yaml    files laid out like config.yaml
+//	machines/*.yaml    a mapping of `machines:` entries
+//	profiles/*.yaml    a mapping of profiles
+//	include: globs     any other files in the repository config.yaml lists,
+//	                   laid out by the directory they're directly in as
+//	                   above, so teams/web/machines/*.yaml hold machines
+//
+// A profile, machine entry or var defined in more than one file is an error.
+// config.d, machines and profiles are never packages.
+var configDirs = []string{"config.d", "machines", "profiles"}
+
+// isConfigDir reports whether a top level directory of the repository holds
+// config files rather than a package
+func isConfigDir(name string) bool {
+	return slices.Contains(configDirs, name)
+}
+
+type configFileKind int
+
+const (
+	configFileFull configFileKind = iota
+	configFileMachines
+	configFileProfiles
+)
+
+// configFile is one file the desired state is loaded from
+type configFile struct {
+	path string // Relative to the repository
+	kind configFileKind
+	data []byte
+	root *yaml.Node // The top level mapping, or nil if the file is empty
+}
+
+// configFileKindOf decides how a file is laid out from the name of its directory
+func configFileKindOf(filePath string) configFileKind {
+	switch path.Base(path.Dir(filePath)) {
+	case "machines":
+		return configFileMachines
+	case "profiles":
+		return configFileProfiles
+	}
+	return configFileFull
+}
+
+// configFileError is a config file that isn't valid YAML
+type configFileError struct {
+	path string
+	err  error
+}
+
+func (e *configFileError) Error() string {
+	return fmt.Sprintf("failed to unmarshal YAML from '%s': %s", e.path, e.err)
+}
+
+func (e *configFileError) Unwrap() error {
+	return e.err
+}
+
+// configSource is where config files are read from: a checkout or a git commit
+type configSource interface {
+	readFile(name string) ([]byte, error)
+	// glob returns the files matching a path.Match pattern, in name order
+	glob(pattern string) ([]string, error)
+}
+
+// dirSource reads config files from a directory
+type dirSource string
+
+func (d dirSource) readFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirSource) glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(string(d), filepath.FromSlash(pattern)))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || info.IsDir() {
+			continue
+		}
+		rel, err := filepath.Rel(string(d), match)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, filepath.ToSlash(rel))
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// gitSource reads config files from a commit's tree
+type gitSource struct {
+	tree *object.Tree
+	dirs map[string][]object.TreeEntry // The directories listed so far
+}
+
+// newGitSource opens the commit ref resolves to in the repository at
+// repoDir, returning its hash too
+func newGitSource(repoDir string, ref string) (gitSource, string, error) {
+	r, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return gitSource{}, "", fmt.Errorf("error opening repo %s: %w", repoDir, err)
+	}
+	hash, err := r.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return gitSource{}, "", fmt.Errorf("error resolving %s: %w", ref, err)
+	}
+	commit, err := r.CommitObject(*hash)
+	if err != nil {
+		return gitSource{}, "", fmt.Errorf("error reading commit %s: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return gitSource{}, "", fmt.Errorf("error reading commit %s: %w", hash, err)
+	}
+	return gitSource{tree: tree, dirs: make(map[string][]object.TreeEntry)}, hash.String(), nil
+}
+
+func (g gitSource) readFile(name string) ([]byte, error) {
+	file, err := g.tree.File(name)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	return []byte(contents), err
+}
+
+// glob matches the pattern a path segment at a time, so only the directories
+// along it are listed rather than the whole tree
+func (g gitSource) glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	segments := strings.Split(pattern, "/")
+	dirs := []string{""}
+	var files []string
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		var subdirs []string
+		for _, dir := range dirs {
+			entries, err := g.list(dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if ok, _ := path.Match(segment, entry.Name); !ok {
+					continue
+				}
+				switch name := path.Join(dir, entry.Name); {
+				case last && entry.Mode.IsFile():
+					files = append(files, name)
+				case !last && entry.Mode == filemode.Dir:
+					subdirs = append(subdirs, name)
+				}
+			}
+		}
+		dirs = subdirs
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// list returns a directory's entries, reading each directory once
+func (g gitSource) list(dir string) ([]object.TreeEntry, error) {
+	if entries, ok := g.dirs[dir]; ok {
+		return entries, nil
+	}
+	tree := g.tree
+	if dir != "" {
+		var err error
+		if tree, err = g.tree.Tree(dir); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", dir, err)
+		}
+	}
+	g.dirs[dir] = tree.Entries
+	return tree.Entries, nil
+}
+
+// loadConfigFiles reads the root config file and every file it brings in
+func loadConfigFiles(source configSource, rootFile string) ([]configFile, error) {
+	root, err := readConfigFile(source, rootFile, configFileFull)
+	if err != nil {
+		return nil, err
+	}
+	files := []configFile{root}
+
+	var includes struct {
+		Include []string `yaml:"include"`
+	}
+	if root.root != nil {
+		if err := root.root.Decode(&includes); err != nil {
+			return nil, fmt.Errorf("%s: invalid include: %w", rootFile, err)
+		}
+	}
+	patterns := []string{"config.d/*.yaml", "config.d/*.yml", "machines/*.yaml", "machines/*.yml", "profiles/*.yaml", "profiles/*.yml"}
+	patterns = append(patterns, includes.Include...)
+
+	// Everything is relative to config.yaml's directory
+	baseDir := path.Dir(rootFile)
+	seen := []string{rootFile}
+	for _, pattern := range patterns {
+		// Includes are read through the source, which mustn't reach outside the repository
+		if path.IsAbs(pattern) || !filepath.IsLocal(filepath.FromSlash(path.Join(baseDir, pattern))) {
+			return nil, fmt.Errorf("%s: include %q is outside the repository", rootFile, pattern)
+		}
+		matches, err := source.glob(path.Join(baseDir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %q: %w", rootFile, pattern, err)
+		}
+		for _, match := range matches {
+			if slices.Contains(seen, match) {
+				continue
+			}
+			seen = append(seen, match)
+			relPath := strings.TrimPrefix(match, baseDir+"/")
+			file, err := readConfigFile(source, match, configFileKindOf(relPath))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func readConfigFile(source configSource, filePath string, kind configFileKind) (configFile, error) {
+	Trace("Reading config file: ", filePath)
+	data, err := source.readFile(filePath)
+	if err != nil {
+		return configFile{}, fmt.Errorf("failed to read config file '%s': %w", filePath, err)
+	}
+	file := configFile{path: filePath, kind: kind, data: data}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return configFile{}, &configFileError{path: filePath, err: err}
+	}
+	if len(document.Content) > 0 {
+		file.root = document.Content[0]
+	}
+	return file, nil
+}
+
+// duplicateError is something defined in more than one config file
+type duplicateError struct {
+	what  string // e.g. "machine web01"
+	first string // Where it was first defined, as file:line:column
+	// Where it was defined again
+	path   string
+	line   int
+	column int
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("%s is defined in %s and again in %s:%d:%d", e.what, e.first, e.path, e.line, e.column)
+}
+
+// definitions remembers where each profile, machine entry and var was defined
+type definitions struct {
+	at   map[string]string
+	errs []error
+}
+
+func (d *definitions) define(what string, file configFile, key *yaml.Node) {
+	if first, ok := d.at[what]; ok {
+		d.errs = append(d.errs, &duplicateError{what: what, first: first, path: file.path, line: key.Line, column: key.Column})
+		return
+	}
+	d.at[what] = fmt.Sprintf("%s:%d:%d", file.path, key.Line, key.Column)
+}
+
+// mergeConfigFiles combines the files into one desired state, reporting
+// anything defined more than once. The state is returned even with an error,
+// as complete as the files allow, so validate can keep checking it.
+func mergeConfigFiles(files []configFile) (*DesiredState, error) {
+	desiredState := DesiredState{
+		Profiles: make(map[string]ProfileConfig),
+		Machines: make(map[string]MachineConfig),
+		Vars:     make(map[string]string),
+		secrets:  &secretStore{},
+	}
+	defined := definitions{at: make(map[string]string)}
+	var typeErr *yaml.TypeError
+
+	for i, file := range files {
+		if file.root == nil {
+			continue
+		}
+		// Secrets are swapped for placeholders in a copy, so the files can be merged again
+		root := cloneNode(file.root)
+		if err := desiredState.secrets.collect(root, file); err != nil {
+			defined.errs = append(defined.errs, err)
+			continue
+		}
+		var part DesiredState
+		var err error
+		switch file.kind {
+		case configFileMachines:
+			err = root.Decode(&part.Machines)
+		case configFileProfiles:
+			err = root.Decode(&part.Profiles)
+		default:
+			err = root.Decode(&part)
+		}
+		if errors.As(err, &typeErr) {
+			// The rest of the file still decoded
+			defined.errs = append(defined.errs, fmt.Errorf("failed to unmarshal YAML from '%s': %w", file.path, err))
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal YAML from '%s': %w", file.path, err)
+		}
+		if i > 0 && len(part.Include) > 0 {
+			defined.errs = append(defined.errs, fmt.Errorf("%s: include is only read from %s", file.path, files[0].path))
+		}
+
+		// Machine and profile files are bare mappings, the rest nest them
+		profiles, machines := file.root, file.root
+		if file.kind == configFileFull {
+			_, profiles = mappingKey(file.root, "profiles")
+			_, machines = mappingKey(file.root, "machines")
+			_, vars := mappingKey(file.root, "vars")
+			for _, entry := range mappingEntries(vars) {
+				defined.define("var "+entry[0].Value, file, entry[0])
+			}
+			if key, _ := mappingKey(file.root, "adhoc"); key != nil {
+				defined.define("adhoc", file, key)
+			}
+		}
+		if file.kind != configFileMachines {
+			for _, entry := range mappingEntries(profiles) {
+				defined.define("profile "+entry[0].Value, file, entry[0])
+			}
+		}
+		if file.kind != configFileProfiles {
+			for _, entry := range mappingEntries(machines) {
+				defined.define("machine "+entry[0].Value, file, entry[0])
+			}
+		}
+
+		for name, profile := range part.Profiles {
+			if _, ok := desiredState.Profiles[name]; !ok {
+				desiredState.Profiles[name] = profile
+			}
+		}
+		for name, machine := range part.Machines {
+			if _, ok := desiredState.Machines[name]; !ok {
+				desiredState.Machines[name] = machine
+			}
+		}
+		for name, value := range part.Vars {
+			if _, ok := desiredState.Vars[name]; !ok {
+				desiredState.Vars[name] = value
+			}
+		}
+		desiredState.FactProfiles = append(desiredState.FactProfiles, part.FactProfiles...)
+		if part.AdHoc.Allow != nil || part.AdHoc.Deny != nil {
+			desiredState.AdHoc = part.AdHoc
+		}
+	}
+	return &desiredState, errors.Join(defined.errs...)
+}
+
+// mappingEntries returns a mapping's key and value nodes in order
+func mappingEntries(node *yaml.Node) [][2]*yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	entries := make([][2]*yaml.Node, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		entries = append(entries, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+	}
+	return entries
+}
+
+// mappingKey returns the key and value nodes for key, or nils if it isn't set
+func mappingKey(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	for _, entry := range mappingEntries(node) {
+		if entry[0].Value == key {
+			return entry[0], entry[1]
+		}
+	}
+	return nil, nil
+}
+
+// cloneNode deep copies a YAML node. Aliases are pointed at the copies of
+// their anchors, so changes to the copy show through them.
+func cloneNode(node *yaml.Node) *yaml.Node {
+	clones := make(map[*yaml.Node]*yaml.Node)
+	clone := cloneNodeInto(node, clones)
+	for _, cloned := range clones {
+		if cloned.Alias != nil {
+			if anchor, ok := clones[cloned.Alias]; ok {
+				cloned.Alias = anchor
+			}
+		}
+	}
+	return clone
+}
+
+func cloneNodeInto(node *yaml.Node, clones map[*yaml.Node]*yaml.Node) *yaml.Node {
+	clone := *node
+	clones[node] = &clone
+	clone.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		clone.Content[i] = cloneNodeInto(child, clones)
+	}
+	return &clone
+}
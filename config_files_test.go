@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// testConfigSources returns the repository's files through a dirSource and
+// through a gitSource of its last commit
+func testConfigSources(t *testing.T, files map[string]string) map[string]configSource {
+	t.Helper()
+	repoDir := filepath.Dir(writeTestConfig(t, files))
+	runGit(t, repoDir, "init", "-q")
+	runGit(t, repoDir, "add", ".")
+	runGit(t, repoDir, "commit", "-q", "-m", "config")
+	source, _, err := newGitSource(repoDir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]configSource{"dir": dirSource(repoDir), "git": source}
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	testCases := []struct {
+		name          string
+		files         map[string]string
+		expectedFiles []string // path:kind, in load order
+		expectErr     string
+	}{
+		{
+			name: "Every kind of file",
+			files: map[string]string{
+				"config.yaml":            "include: [extra/*.yaml, teams/*/machines.yaml]\n",
+				"config.d/b.yaml":        "vars: {b: 1}\n",
+				"config.d/a.yml":         "vars: {a: 1}\n",
+				"machines/web.yaml":      "web01: {}\n",
+				"profiles/base.yaml":     "base: {}\n",
+				"profiles/notes.txt":     "not config\n",
+				"extra/more.yaml":        "vars: {c: 1}\n",
+				"teams/db/machines.yaml": "machines: {db01: {}}\n",
+				"vim/install.sh":         "#!/bin/sh\n",
+			},
+			expectedFiles: []string{
+				"config.yaml:full",
+				"config.d/b.yaml:full",
+				"config.d/a.yml:full",
+				"machines/web.yaml:machines",
+				"profiles/base.yaml:profiles",
+				"extra/more.yaml:full",
+				"teams/db/machines.yaml:full",
+			},
+		},
+		{
+			name: "Nested include",
+			files: map[string]string{
+				"config.yaml":                  "include: [teams/*/machines/*.yaml, teams/*/profiles/*.yaml, teams/*/config.d/*.yaml]\n",
+				"teams/web/machines/web.yaml":  "web01: {}\n",
+				"teams/web/profiles/base.yaml": "base: {}\n",
+				"teams/web/config.d/vars.yaml": "vars: {a: 1}\n",
+			},
+			expectedFiles: []string{
+				"config.yaml:full",
+				"teams/web/machines/web.yaml:machines",
+				"teams/web/profiles/base.yaml:profiles",
+				"teams/web/config.d/vars.yaml:full",
+			},
+		},
+		{
+			name: "Included twice",
+			files: map[string]string{
+				"config.yaml":       "include: [machines/*.yaml]\n",
+				"machines/web.yaml": "web01: {}\n",
+			},
+			expectedFiles: []string{"config.yaml:full", "machines/web.yaml:machines"},
+		},
+		{
+			name:      "Include outside the repository",
+			files:     map[string]string{"config.yaml": "include: [\"../../etc/*.yaml\"]\n"},
+			expectErr: `include "../../etc/*.yaml" is outside the repository`,
+		},
+		{
+			name:      "Absolute include",
+			files:     map[string]string{"config.yaml": "include: [/etc/*.yaml]\n"},
+			expectErr: `include "/etc/*.yaml" is outside the repository`,
+		},
+		{
+			name:          "Include that climbs back in",
+			files:         map[string]string{"config.yaml": "include: [extra/../*.yaml]\n"},
+			expectedFiles: []string{"config.yaml:full"},
+		},
+		{
+			name: "Invalid YAML",
+			files: map[string]string{
+				"config.yaml":       "machines: {}\n",
+				"machines/web.yaml": "web01: [\n",
+			},
+			expectErr: "failed to unmarshal YAML from 'machines/web.yaml'",
+		},
+	}
+	kinds := map[configFileKind]string{configFileFull: "full", configFileMachines: "machines", configFileProfiles: "profiles"}
+
+	for _, tc := range testCases {
+		for sourceName, source := range testConfigSources(t, tc.files) {
+			t.Run(tc.name+" from "+sourceName, func(t *testing.T) {
+				files, err := loadConfigFiles(source, "config.yaml")
+				if tc.expectErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+						t.Errorf("Expected an error containing %q, but got: %v", tc.expectErr, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Did not expect error, but got: %v", err)
+				}
+				var got []string
+				for _, file := range files {
+					got = append(got, file.path+":"+kinds[file.kind])
+				}
+				if !slices.Equal(got, tc.expectedFiles) {
+					t.Errorf("Expected %v, but got %v", tc.expectedFiles, got)
+				}
+			})
+		}
+	}
+}
+
+func TestGitSourceListsEachDirectoryOnce(t *testing.T) {
+	sources := testConfigSources(t, map[string]string{
+		"config.yaml":        "include: [extra/*.yaml]\n",
+		"machines/web.yaml":  "web01: {}\n",
+		"extra/more.yaml":    "vars: {a: 1}\n",
+		"vim/files/big.conf": "not config\n",
+	})
+	source := sources["git"].(gitSource)
+	if _, err := loadConfigFiles(source, "config.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for dir := range source.dirs {
+		listed = append(listed, dir)
+	}
+	slices.Sort(listed)
+	// config.d and profiles don't exist, and package directories are never read
+	if expected := []string{"", "extra", "machines"}; !slices.Equal(listed, expected) {
+		t.Errorf("Expected only %q to be listed, but got %q", expected, listed)
+	}
+}
+
+func TestMergeConfigFiles(t *testing.T) {
+	testCases := []struct {
+		name             string
+		files            map[string]string
+		expectDuplicates []string
+		expectErr        string
+	}{
+		{
+			name: "Split across files",
+			files: map[string]string{
+				"config.yaml":        "vars: {a: 1}\nmachines: {web01: {}}\n",
+				"config.d/more.yaml": "vars: {b: 1}\nprofiles: {web: {}}\n",
+				"machines/db.yaml":   "db01: {}\n",
+				"profiles/base.yaml": "base: {}\n",
+			},
+		},
+		{
+			name: "Defined twice",
+			files: map[string]string{
+				"config.yaml":        "vars: {a: 1}\nmachines: {web01: {}}\nprofiles: {base: {}}\nadhoc: {allow: [vim]}\n",
+				"config.d/more.yaml": "vars: {a: 2}\nadhoc: {deny: [vim]}\n",
+				"machines/web.yaml":  "web01: {}\n",
+				"profiles/base.yaml": "base: {}\n",
+			},
+			expectDuplicates: []string{
+				"var a is defined in config.yaml:1:8 and again in config.d/more.yaml:1:8",
+				"adhoc is defined in config.yaml:4:1 and again in config.d/more.yaml:2:1",
+				"machine web01 is defined in config.yaml:2:12 and again in machines/web.yaml:1:1",
+				"profile base is defined in config.yaml:3:12 and again in profiles/base.yaml:1:1",
+			},
+		},
+		{
+			name: "Nested include",
+			files: map[string]string{
+				"config.yaml":                 "include: [teams/*/machines/*.yaml]\nmachines: {web01: {}}\n",
+				"teams/web/machines/web.yaml": "web01: {}\n",
+			},
+			expectDuplicates: []string{"machine web01 is defined in config.yaml:2:12 and again in teams/web/machines/web.yaml:1:1"},
+		},
+		{
+			name: "Include outside config.yaml",
+			files: map[string]string{
+				"config.yaml":        "machines: {}\n",
+				"config.d/more.yaml": "include: [extra/*.yaml]\n",
+			},
+			expectErr: "config.d/more.yaml: include is only read from config.yaml",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := loadConfigFiles(testConfigSources(t, tc.files)["dir"], "config.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			desiredState, err := mergeConfigFiles(files)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Errorf("Expected an error containing %q, but got: %v", tc.expectErr, err)
+				}
+				return
+			}
+			var duplicates []string
+			for _, err := range unwrapErrors(err) {
+				var duplicate *duplicateError
+				if !errors.As(err, &duplicate) {
+					t.Fatalf("Expected only duplicates, but got: %v", err)
+				}
+				duplicates = append(duplicates, duplicate.Error())
+			}
+			if !slices.Equal(duplicates, tc.expectDuplicates) {
+				t.Errorf("Expected duplicates:\n%s\nbut got:\n%s", strings.Join(tc.expectDuplicates, "\n"), strings.Join(duplicates, "\n"))
+			}
+			if tc.expectDuplicates == nil && (len(desiredState.Machines) != 2 || len(desiredState.Profiles) != 2 || len(desiredState.Vars) != 2) {
+				t.Errorf("Expected everything from every file, but got %+v", desiredState)
+			}
+		})
+	}
+}
+
+// unwrapErrors returns the errors joined in err
+func unwrapErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	if err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+func TestCloneNodeAliases(t *testing.T) {
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte("base: &base {channel: stable}\nweb: *base\n"), &document); err != nil {
+		t.Fatal(err)
+	}
+	root := document.Content[0]
+
+	clone := cloneNode(root)
+	// The anchored mapping's channel value, edited in the copy only
+	clone.Content[1].Content[1].Value = "beta"
+
+	var got struct {
+		Base map[string]string `yaml:"base"`
+		Web  map[string]string `yaml:"web"`
+	}
+	if err := clone.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Base["channel"] != "beta" || got.Web["channel"] != "beta" {
+		t.Errorf("Expected the alias to follow the edited copy, but got %+v", got)
+	}
+	if root.Content[1].Content[1].Value != "stable" || root.Content[3].Alias != root.Content[1] {
+		t.Errorf("Expected the original to be left alone")
+	}
+}
+
+func TestSecretsThroughAliases(t *testing.T) {
+	_, recipient := writeTestIdentity(t, t.TempDir())
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+vars:
+  token: &token !secret ` + encryptTestSecret(t, recipient, "s3cr3t") + `
+  copy: *token
+`})
+	desiredState, err := LoadDesiredState(configPath)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	if desiredState.Vars["token"] != secretPlaceholder(0) || desiredState.Vars["copy"] != secretPlaceholder(0) {
+		t.Errorf("Expected the alias to get the anchor's placeholder, but got %q and %q", desiredState.Vars["token"], desiredState.Vars["copy"])
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveProfiles(t *testing.T) {
+	desiredState := &DesiredState{Profiles: map[string]ProfileConfig{
+		"base":    {},
+		"dev":     {AppliedProfiles: []string{"base"}},
+		"web":     {AppliedProfiles: []string{"base", "tls"}},
+		"tls":     {},
+		"fullweb": {AppliedProfiles: []string{"dev", "web"}},
+		"a":       {AppliedProfiles: []string{"b"}},
+		"b":       {AppliedProfiles: []string{"c"}},
+		"c":       {AppliedProfiles: []string{"a"}},
+		"self":    {AppliedProfiles: []string{"self"}},
+	}}
+
+	testCases := []struct {
+		name      string
+		profiles  []string
+		expected  []string
+		expectErr string
+	}{
+		{name: "No parents", profiles: []string{"base"}, expected: []string{"base"}},
+		{name: "Parents come first", profiles: []string{"dev"}, expected: []string{"base", "dev"}},
+		{name: "Depth first", profiles: []string{"fullweb"}, expected: []string{"base", "dev", "tls", "web", "fullweb"}},
+		{name: "Each profile once", profiles: []string{"web", "dev", "base"}, expected: []string{"base", "tls", "web", "dev"}},
+		{name: "Missing profiles are kept", profiles: []string{"nope", "base"}, expected: []string{"nope", "base"}},
+		{name: "Cycle", profiles: []string{"a"}, expectErr: "profile cycle: a -> b -> c -> a"},
+		{name: "Cycle reached through another profile", profiles: []string{"base", "b"}, expectErr: "profile cycle: b -> c -> a -> b"},
+		{name: "Profile applying itself", profiles: []string{"self"}, expectErr: "profile cycle: self -> self"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, err := desiredState.resolveProfiles(tc.profiles)
+			if tc.expectErr != "" {
+				if err == nil || err.Error() != tc.expectErr {
+					t.Errorf("Expected %q, but got: %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if !slices.Equal(resolved, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, resolved)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateProfiles(t *testing.T) {
+	testCases := []struct {
+		name             string
+		config           string
+		expectErr        string
+		expectedProfiles []string
+		expectedSteps    map[string]string // package -> action of its first step
+	}{
+		{
+			name: "Nested profiles",
+			config: `
+profiles:
+  base:
+    packages:
+      vim: [{action: install}]
+  web:
+    applied_profiles: [base]
+    packages:
+      nginx: [{action: install}]
+machines:
+  web01:
+    applied_profiles: [web]
+`,
+			expectedProfiles: []string{"base", "web"},
+			expectedSteps:    map[string]string{"vim": "install", "nginx": "install"},
+		},
+		{
+			name: "Cycle in a profile no machine uses",
+			config: `
+profiles:
+  a:
+    applied_profiles: [b]
+  b:
+    applied_profiles: [a]
+machines:
+  web01: {}
+`,
+			expectErr: "profile cycle: a -> b -> a",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			desiredState, err := LoadDesiredState(writeTestConfig(t, map[string]string{"config.yaml": tc.config}))
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Errorf("Expected an error containing %q, but got: %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			machine := desiredState.Machines["web01"]
+			if !slices.Equal(machine.AppliedProfiles, tc.expectedProfiles) {
+				t.Errorf("Expected profiles %v, but got %v", tc.expectedProfiles, machine.AppliedProfiles)
+			}
+			for packageName, action := range tc.expectedSteps {
+				if steps := machine.Packages[packageName]; len(steps) == 0 || steps[0].Action != action {
+					t.Errorf("Expected %s's %s step, but got %v", packageName, action, steps)
+				}
+			}
+		})
+	}
+}
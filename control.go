@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The control socket lets root and the admin group talk to a running agent.
+// Each connection sends one JSON controlRequest line and gets one JSON
+// controlResponse line back.
+const (
+	controlRunNow   = "run-now"
+	controlPause    = "pause"
+	controlResume   = "resume"
+	controlProgress = "progress"
+)
+
+const controlTimeout = 5 * time.Second
+
+type controlRequest struct {
+	Command string `json:"command"`
+	Package string `json:"package,omitempty"` // run-now only. Runs just this package
+}
+
+type controlResponse struct {
+	OK       bool           `json:"ok"`
+	Message  string         `json:"message,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Progress *agentProgress `json:"progress,omitempty"`
+}
+
+// agentProgress is what a running agent is doing right now
+type agentProgress struct {
+	State          string     `json:"state"` // idle, running or paused
+	CurrentPackage string     `json:"current_package,omitempty"`
+	CurrentAction  string     `json:"current_action,omitempty"`
+	PackagesDone   int        `json:"packages_done"`
+	PackagesTotal  int        `json:"packages_total"`
+	CycleStarted   *time.Time `json:"cycle_started,omitempty"`
+	LastCheck      *time.Time `json:"last_check,omitempty"`
+	LastCheckError string     `json:"last_check_error,omitempty"`
+	NextCheck      *time.Time `json:"next_check,omitempty"`
+}
+
+// agentControl holds what the control socket can see and change in the agent loop
+type agentControl struct {
+	mu       sync.Mutex
+	paused   bool
+	running  bool
+	progress agentProgress
+	runNow   chan string // a package name, or "" for a full cycle
+}
+
+func newAgentControl() *agentControl {
+	return &agentControl{runNow: make(chan string, 1)}
+}
+
+// The methods below are safe to call on a nil *agentControl, which is what
+// one-off runs like --runonce and --plan have.
+
+func (c *agentControl) startCycle(total int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.running = true
+	c.progress.CycleStarted = &now
+	c.progress.PackagesDone = 0
+	c.progress.PackagesTotal = total
+}
+
+func (c *agentControl) startPackage(name string, action string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress.CurrentPackage = name
+	c.progress.CurrentAction = action
+}
+
+func (c *agentControl) finishPackage() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress.PackagesDone++
+	c.progress.CurrentPackage = ""
+	c.progress.CurrentAction = ""
+}
+
+func (c *agentControl) finishCycle(err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.running = false
+	c.progress.CurrentPackage = ""
+	c.progress.CurrentAction = ""
+	c.progress.LastCheck = &now
+	c.progress.LastCheckError = ""
+	if err != nil {
+		c.progress.LastCheckError = err.Error()
+	}
+}
+
+func (c *agentControl) setNextCheck(delay time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := time.Now().Add(delay)
+	c.progress.NextCheck = &next
+}
+
+func (c *agentControl) isPaused() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+func (c *agentControl) snapshot() agentProgress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	progress := c.progress
+	switch {
+	case c.running:
+		progress.State = "running"
+	case c.paused:
+		progress.State = "paused"
+	default:
+		progress.State = "idle"
+	}
+	return progress
+}
+
+// handle carries out a single control request
+func (c *agentControl) handle(req controlRequest) controlResponse {
+	switch req.Command {
+	case controlRunNow:
+		what := "a full cycle"
+		if req.Package != "" {
+			what = "package " + req.Package
+		}
+		select {
+		case c.runNow <- req.Package:
+			Info("Control socket: queued ", what)
+			return controlResponse{OK: true, Message: "queued " + what}
+		default:
+			return controlResponse{Error: "another run is already queued"}
+		}
+	case controlPause, controlResume:
+		c.mu.Lock()
+		c.paused = req.Command == controlPause
+		c.mu.Unlock()
+		Info("Control socket: agent ", req.Command, "d")
+		return controlResponse{OK: true, Message: "agent " + req.Command + "d"}
+	case controlProgress:
+		progress := c.snapshot()
+		return controlResponse{OK: true, Progress: &progress}
+	}
+	return controlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+}
+
+// listen serves the control socket at socketPath until ctx is done
+func (c *agentControl) listen(ctx context.Context, socketPath string, adminGroup string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	// A socket left behind by an agent that didn't shut down cleanly is removed,
+	// but one that still answers belongs to a running agent
+	if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another agent is already listening on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	adminGID := lookupGroupID(adminGroup)
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+	if adminGID >= 0 && isRoot() {
+		if err := os.Chown(socketPath, 0, adminGID); err != nil {
+			Error("failed to give the ", adminGroup, " group the control socket: ", err)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		Debug("Control socket listening on ", socketPath)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					Error("control socket stopped accepting connections: ", err)
+				}
+				return
+			}
+			go c.serve(conn.(*net.UnixConn), adminGID)
+		}
+	}()
+	return nil
+}
+
+func (c *agentControl) serve(conn *net.UnixConn, adminGID int) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	encoder := json.NewEncoder(conn)
+
+	if err := checkPeer(conn, adminGID); err != nil {
+		Warning("Control socket: refused a connection: ", err)
+		encoder.Encode(controlResponse{Error: err.Error()})
+		return
+	}
+	var req controlRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		encoder.Encode(controlResponse{Error: "invalid request: " + err.Error()})
+		return
+	}
+	encoder.Encode(c.handle(req))
+}
+
+// checkPeer allows root, the agent's own user and members of the admin group.
+// The socket's permissions already say as much; this also covers sockets
+// whose group couldn't be set.
+func checkPeer(conn *net.UnixConn, adminGID int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+	if cred.Uid == 0 || int(cred.Uid) == os.Geteuid() {
+		return nil
+	}
+	if adminGID >= 0 {
+		if int(cred.Gid) == adminGID {
+			return nil
+		}
+		if peer, err := user.LookupId(strconv.Itoa(int(cred.Uid))); err == nil {
+			if groups, err := peer.GroupIds(); err == nil && slices.Contains(groups, strconv.Itoa(adminGID)) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("uid %d is not root or in the admin group", cred.Uid)
+}
+
+// lookupGroupID returns the group's ID, or -1 if it doesn't exist
+func lookupGroupID(name string) int {
+	if name == "" {
+		return -1
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		Debug("Admin group ", name, " not found: ", err)
+		return -1
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return -1
+	}
+	return gid
+}
+
+// sendControlRequest sends a request to the running agent
+func sendControlRequest(req controlRequest) (controlResponse, error) {
+	conn, err := net.DialTimeout("unix", appConfig.ControlSocket, controlTimeout)
+	if err != nil {
+		return controlResponse{}, fmt.Errorf("unable to reach the agent at %s (is it running?): %w", appConfig.ControlSocket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return controlResponse{}, fmt.Errorf("failed to send the request: %w", err)
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return controlResponse{}, fmt.Errorf("failed to read the agent's response: %w", err)
+	}
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// controlCommand returns a subcommand that sends command to the running agent
+func controlCommand(command string) func(args []string) int {
+	return func(args []string) int {
+		flags := newCommandFlags(command, "")
+		var packageName *string
+		if command == controlRunNow {
+			packageName = flags.String("package", "", "Run only this package, regardless of when it last ran")
+		}
+		flags.Parse(args)
+
+		req := controlRequest{Command: command}
+		if packageName != nil {
+			req.Package = *packageName
+		}
+		resp, err := sendControlRequest(req)
+		if err != nil {
+			Error(command, " failed: ", err)
+			return 1
+		}
+		fmt.Println(resp.Message)
+		return 0
+	}
+}
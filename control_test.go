@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlHandle(t *testing.T) {
+	c := newAgentControl()
+
+	testCases := []struct {
+		name          string
+		req           controlRequest
+		expectOK      bool
+		expectMessage string
+		expectError   string
+		expectState   string
+	}{
+		{name: "Run a package now", req: controlRequest{Command: controlRunNow, Package: "vim"}, expectOK: true, expectMessage: "queued package vim", expectState: "idle"},
+		{name: "Only one run is queued", req: controlRequest{Command: controlRunNow}, expectError: "already queued", expectState: "idle"},
+		{name: "Pause", req: controlRequest{Command: controlPause}, expectOK: true, expectMessage: "agent paused", expectState: "paused"},
+		{name: "Resume", req: controlRequest{Command: controlResume}, expectOK: true, expectMessage: "agent resumed", expectState: "idle"},
+		{name: "Unknown command", req: controlRequest{Command: "reboot"}, expectError: "unknown command", expectState: "idle"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := c.handle(tc.req)
+			if resp.OK != tc.expectOK || resp.Message != tc.expectMessage || !strings.Contains(resp.Error, tc.expectError) {
+				t.Errorf("Expected ok %v, message %q and error %q, but got %+v", tc.expectOK, tc.expectMessage, tc.expectError, resp)
+			}
+			progress := c.handle(controlRequest{Command: controlProgress})
+			if !progress.OK || progress.Progress.State != tc.expectState {
+				t.Errorf("Expected the agent to be %s, but got %+v", tc.expectState, progress.Progress)
+			}
+		})
+	}
+
+	if queued := <-c.runNow; queued != "vim" {
+		t.Errorf("Expected vim to be queued, but got %q", queued)
+	}
+}
+
+func TestControlProgress(t *testing.T) {
+	c := newAgentControl()
+	c.startCycle(3)
+	c.startPackage("vim", "install")
+	c.finishPackage()
+	c.startPackage("git", "configure")
+
+	progress := c.snapshot()
+	if progress.State != "running" || progress.CurrentPackage != "git" || progress.CurrentAction != "configure" || progress.PackagesDone != 1 || progress.PackagesTotal != 3 {
+		t.Errorf("Expected git's configure step, 1 of 3, but got %+v", progress)
+	}
+
+	c.finishCycle(errors.New("git failed"))
+	progress = c.snapshot()
+	if progress.State != "idle" || progress.CurrentPackage != "" || progress.LastCheck == nil || progress.LastCheckError != "git failed" {
+		t.Errorf("Expected an idle agent with the last error, but got %+v", progress)
+	}
+
+	// One-off runs have no control socket
+	var none *agentControl
+	none.startCycle(1)
+	none.finishCycle(nil)
+	if none.isPaused() {
+		t.Errorf("Expected a nil control to never be paused")
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	defer func(socket string) { appConfig.ControlSocket = socket }(appConfig.ControlSocket)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	appConfig.ControlSocket = filepath.Join(t.TempDir(), "run", "agent.sock")
+
+	// A socket left behind by an agent that crashed
+	os.MkdirAll(filepath.Dir(appConfig.ControlSocket), 0755)
+	stale, err := net.Listen("unix", appConfig.ControlSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	c := newAgentControl()
+	if err := c.listen(ctx, appConfig.ControlSocket, ""); err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, but got: %v", err)
+	}
+	info, err := os.Stat(appConfig.ControlSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected the socket's mode to be 0660, but got %v", info.Mode().Perm())
+	}
+
+	if err := newAgentControl().listen(ctx, appConfig.ControlSocket, ""); err == nil || !strings.Contains(err.Error(), "already listening") {
+		t.Errorf("Expected a second agent to be refused, but got: %v", err)
+	}
+
+	resp, err := sendControlRequest(controlRequest{Command: controlPause})
+	if err != nil || resp.Message != "agent paused" || !c.isPaused() {
+		t.Errorf("Expected the agent to be paused, but got %+v, %v", resp, err)
+	}
+	if _, err := sendControlRequest(controlRequest{Command: "reboot"}); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("Expected the agent's error, but got: %v", err)
+	}
+
+	cancel()
+	appConfig.ControlSocket = filepath.Join(t.TempDir(), "missing.sock")
+	if _, err := sendControlRequest(controlRequest{Command: controlProgress}); err == nil || !strings.Contains(err.Error(), "is it running") {
+		t.Errorf("Expected an unreachable agent, but got: %v", err)
+	}
+}
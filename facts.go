@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+// collectFacts gathers what the agent knows about its machine. It's sent to
+// the server on every check-in so configs can target machines by their facts.
+func collectFacts() *pb.Facts {
+	osRelease := readKeyValueFile("/etc/os-release", "=")
+	facts := &pb.Facts{
+		Hostname:      appConfig.Hostname,
+		Distro:        osRelease["ID"],
+		DistroVersion: osRelease["VERSION_ID"],
+		DistroLike:    strings.Fields(osRelease["ID_LIKE"]),
+		Kernel:        readFirstLine("/proc/sys/kernel/osrelease"),
+		Arch:          runtime.GOARCH,
+		CpuCount:      int32(runtime.NumCPU()),
+		CpuModel:      readKeyValueFile("/proc/cpuinfo", ":")["model name"],
+		MemoryBytes:   memoryBytes(),
+		IpAddresses:   ipAddresses(),
+		MachineId:     readFirstLine("/etc/machine-id"),
+	}
+	facts.Virtualization, facts.IsContainer = detectContainer()
+	if !facts.IsContainer {
+		facts.Virtualization, facts.IsVm = detectVM()
+	}
+	Trace("Collected facts: ", facts)
+	return facts
+}
+
+// readKeyValueFile parses lines of "key<sep>value", like /etc/os-release.
+// The first value wins when a key repeats, and quotes around values are removed.
+func readKeyValueFile(filePath string, sep string) map[string]string {
+	values := make(map[string]string)
+	file, err := os.Open(filePath)
+	if err != nil {
+		Debug("Unable to read ", filePath, ": ", err)
+		return values
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), sep)
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if _, exists := values[key]; exists {
+			continue
+		}
+		values[key] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return values
+}
+
+func readFirstLine(filePath string) string {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		Debug("Unable to read ", filePath, ": ", err)
+		return ""
+	}
+	line, _, _ := strings.Cut(string(content), "\n")
+	return strings.TrimSpace(line)
+}
+
+// memoryBytes reads MemTotal from /proc/meminfo
+func memoryBytes() uint64 {
+	memTotal := strings.Fields(readKeyValueFile("/proc/meminfo", ":")["MemTotal"])
+	if len(memTotal) == 0 {
+		return 0
+	}
+	kilobytes, err := strconv.ParseUint(memTotal[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return kilobytes * 1024
+}
+
+// ipAddresses lists the machine's addresses, leaving out loopback and link-local ones
+func ipAddresses() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		Debug("Unable to list interface addresses: ", err)
+		return nil
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP.String())
+	}
+	return ips
+}
+
+// detectContainer returns the container runtime, if the agent is running in one
+func detectContainer() (string, bool) {
+	switch {
+	case fileExists("/.dockerenv"):
+		return "docker", true
+	case fileExists("/run/.containerenv"):
+		return "podman", true
+	}
+	if container := os.Getenv("container"); container != "" {
+		return container, true
+	}
+	cgroup, _ := os.ReadFile("/proc/1/cgroup")
+	for _, runtimeName := range []string{"docker", "kubepods", "lxc", "containerd"} {
+		if strings.Contains(string(cgroup), runtimeName) {
+			return runtimeName, true
+		}
+	}
+	return "", false
+}
+
+// detectVM returns the hypervisor, if the machine is a virtual machine
+func detectVM() (string, bool) {
+	dmi := strings.ToLower(readFirstLine("/sys/class/dmi/id/sys_vendor") + " " + readFirstLine("/sys/class/dmi/id/product_name"))
+	hypervisors := map[string]string{
+		"qemu":           "kvm",
+		"kvm":            "kvm",
+		"vmware":         "vmware",
+		"virtualbox":     "virtualbox",
+		"xen":            "xen",
+		"microsoft":      "hyper-v",
+		"amazon ec2":     "amazon",
+		"google compute": "google",
+		"parallels":      "parallels",
+	}
+	for match, hypervisor := range hypervisors {
+		if strings.Contains(dmi, match) {
+			return hypervisor, true
+		}
+	}
+	flags := strings.Fields(readKeyValueFile("/proc/cpuinfo", ":")["flags"])
+	if slices.Contains(flags, "hypervisor") {
+		return "unknown", true
+	}
+	return "", false
+}
+
+// factValues flattens facts into the names used by fact_profiles. Facts with
+// several values, like ip_addresses, list all of them.
+func factValues(facts *pb.Facts) map[string][]string {
+	if facts == nil {
+		return map[string][]string{}
+	}
+	return map[string][]string{
+		"hostname":       {facts.GetHostname()},
+		"distro":         {facts.GetDistro()},
+		"distro_version": {facts.GetDistroVersion()},
+		"distro_like":    facts.GetDistroLike(),
+		"kernel":         {facts.GetKernel()},
+		"arch":           {facts.GetArch()},
+		"cpu_count":      {strconv.Itoa(int(facts.GetCpuCount()))},
+		"cpu_model":      {facts.GetCpuModel()},
+		"memory_mb":      {strconv.FormatUint(facts.GetMemoryBytes()/1024/1024, 10)},
+		"ip_addresses":   facts.GetIpAddresses(),
+		"machine_id":     {facts.GetMachineId()},
+		"is_vm":          {strconv.FormatBool(facts.GetIsVm())},
+		"is_container":   {strconv.FormatBool(facts.GetIsContainer())},
+		"virtualization": {facts.GetVirtualization()},
+	}
+}
+
+// checkFactProfiles rejects fact profiles without a match, which would
+// otherwise give any hostname that checks in a config
+func (d *DesiredState) checkFactProfiles() error {
+	for i, factProfile := range d.FactProfiles {
+		if len(factProfile.Match) == 0 {
+			return fmt.Errorf("fact_profiles[%d] has no match, so it would apply to every machine", i)
+		}
+	}
+	return nil
+}
+
+// factsMatch reports whether every fact in match has a value matching its
+// pattern. Patterns use path.Match, so "10.0.*" matches an IP address. An
+// empty match matches nothing, rather than every host.
+func factsMatch(match map[string]string, facts map[string][]string) bool {
+	if len(match) == 0 {
+		return false
+	}
+	for name, pattern := range match {
+		matched := false
+		for _, value := range facts[name] {
+			if ok, _ := path.Match(pattern, value); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
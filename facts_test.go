@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFactsMatch(t *testing.T) {
+	facts := map[string][]string{
+		"distro":       {"debian"},
+		"arch":         {"arm64"},
+		"ip_addresses": {"192.168.1.5", "10.0.3.7"},
+	}
+
+	testCases := []struct {
+		name     string
+		match    map[string]string
+		expected bool
+	}{
+		{name: "Exact", match: map[string]string{"distro": "debian"}, expected: true},
+		{name: "Every fact must match", match: map[string]string{"distro": "debian", "arch": "amd64"}, expected: false},
+		{name: "Glob", match: map[string]string{"distro": "deb*"}, expected: true},
+		{name: "Any value of a multi-value fact", match: map[string]string{"ip_addresses": "10.0.*"}, expected: true},
+		{name: "No value matches", match: map[string]string{"ip_addresses": "172.16.*"}, expected: false},
+		{name: "Unreported fact", match: map[string]string{"virtualization": "*"}, expected: false},
+		{name: "Empty match matches nothing", match: map[string]string{}, expected: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := factsMatch(tc.match, facts); got != tc.expected {
+				t.Errorf("Expected %v, but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestFactValues(t *testing.T) {
+	if values := factValues(nil); len(values) != 0 {
+		t.Errorf("Expected no facts for nil, but got %v", values)
+	}
+	values := factValues(&pb.Facts{Distro: "fedora", DistroLike: []string{"rhel", "centos"}, MemoryBytes: 2 << 30, IsVm: true})
+	expected := map[string][]string{
+		"distro":      {"fedora"},
+		"distro_like": {"rhel", "centos"},
+		"memory_mb":   {"2048"},
+		"is_vm":       {"true"},
+	}
+	for name, want := range expected {
+		if !slices.Equal(values[name], want) {
+			t.Errorf("Expected %s to be %v, but got %v", name, want, values[name])
+		}
+	}
+}
+
+func TestReadKeyValueFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "os-release")
+	os.WriteFile(filePath, []byte("ID=debian\nVERSION_ID=\"12\"\nID=ignored\nnot a pair\nNAME='Debian GNU/Linux'\n"), 0644)
+	values := readKeyValueFile(filePath, "=")
+	expected := map[string]string{"ID": "debian", "VERSION_ID": "12", "NAME": "Debian GNU/Linux"}
+	if len(values) != len(expected) {
+		t.Errorf("Expected %v, but got %v", expected, values)
+	}
+	for key, want := range expected {
+		if values[key] != want {
+			t.Errorf("Expected %s=%q, but got %q", key, want, values[key])
+		}
+	}
+	if values := readKeyValueFile(filepath.Join(t.TempDir(), "missing"), "="); len(values) != 0 {
+		t.Errorf("Expected nothing from a missing file, but got %v", values)
+	}
+}
+
+func TestFactProfiles(t *testing.T) {
+	testCases := []struct {
+		name             string
+		config           string
+		hostname         string
+		facts            map[string][]string
+		expectErr        string
+		expectFound      bool
+		expectedProfiles []string
+	}{
+		{
+			name: "Unknown host matching a fact profile",
+			config: `
+profiles:
+  arm: {}
+fact_profiles:
+  - match: {arch: arm64}
+    applied_profiles: [arm]
+`,
+			hostname:         "new-host",
+			facts:            map[string][]string{"arch": {"arm64"}},
+			expectFound:      true,
+			expectedProfiles: []string{"arm"},
+		},
+		{
+			name: "Unknown host not matching",
+			config: `
+profiles:
+  arm: {}
+fact_profiles:
+  - match: {arch: arm64}
+    applied_profiles: [arm]
+`,
+			hostname: "new-host",
+			facts:    map[string][]string{"arch": {"amd64"}},
+		},
+		{
+			name: "Unknown host without facts",
+			config: `
+profiles:
+  arm: {}
+fact_profiles:
+  - match: {arch: arm64}
+    applied_profiles: [arm]
+`,
+			hostname: "new-host",
+		},
+		{
+			name: "Fact profiles come before the machine's own",
+			config: `
+profiles:
+  base: {}
+  arm: {}
+machines:
+  web01:
+    applied_profiles: [base]
+fact_profiles:
+  - match: {arch: arm64}
+    applied_profiles: [arm]
+`,
+			hostname:         "web01",
+			facts:            map[string][]string{"arch": {"arm64"}},
+			expectFound:      true,
+			expectedProfiles: []string{"arm", "base"},
+		},
+		{
+			name: "Empty match",
+			config: `
+profiles:
+  base: {}
+fact_profiles:
+  - match: {}
+    applied_profiles: [base]
+`,
+			expectErr: "has no match",
+		},
+		{
+			name: "Missing match",
+			config: `
+profiles:
+  base: {}
+fact_profiles:
+  - applied_profiles: [base]
+`,
+			expectErr: "has no match",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			desiredState, err := LoadDesiredState(writeTestConfig(t, map[string]string{"config.yaml": tc.config}))
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Errorf("Expected an error containing %q, but got: %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			machine, found := desiredState.machineConfigFor(tc.hostname, tc.facts)
+			if found != tc.expectFound {
+				t.Fatalf("Expected found %v, but got %v", tc.expectFound, found)
+			}
+			if found && !slices.Equal(machine.AppliedProfiles, tc.expectedProfiles) {
+				t.Errorf("Expected profiles %v, but got %v", tc.expectedProfiles, machine.AppliedProfiles)
+			}
+		})
+	}
+}
+
+func TestFactStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "facts")
+	store := newFactStore(dir)
+	facts := &pb.Facts{Hostname: "web01", Distro: "debian"}
+	if err := store.record("web01", facts); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{"", "../escape", ".hidden"} {
+		if err := store.record(invalid, facts); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+
+	// The facts survive the server restarting
+	reloaded := newFactStore(dir)
+	if got := reloaded.get("web01"); !proto.Equal(got, facts) {
+		t.Errorf("Expected %v, but got %v", facts, got)
+	}
+	if got := reloaded.get("web02"); got != nil {
+		t.Errorf("Expected no facts for an unknown machine, but got %v", got)
+	}
+}
+
+func TestValidateFactProfiles(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+profiles:
+  base: {}
+fact_profiles:
+  - match: {arch: arm64}
+    applied_profiles: [base]
+  - match: {}
+    applied_profiles: [base]
+`})
+	issues, err := validateConfig(configPath, t.TempDir())
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	if len(issues) != 1 || !strings.Contains(issues[0].Message, "has no match") || issues[0].Line != 7 {
+		t.Errorf("Expected only the empty match to be reported, on line 7, but got %+v", issues)
+	}
+}
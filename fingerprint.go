@@ -0,0 +1,53 @@
+package main
+
+import "slices"
+
+// stepFingerprint identifies exactly what a package step ran with. When any
+// part differs from the last successful run, the step counts as updated.
+type stepFingerprint struct {
+	Checksum      string `json:"checksum"`
+	Action        string `json:"action"`
+	ArgumentsHash string `json:"arguments_hash"`
+	RunAsUser     string `json:"runasuser"`
+	EnvHash       string `json:"env_hash"`
+	Keyed         bool   `json:"keyed,omitempty"` // Whether the hashes are keyed by state.key
+}
+
+// fingerprint returns the package step's current fingerprint, hashing its
+// arguments and env with key
+func (p *packageInfo) fingerprint(key []byte) stepFingerprint {
+	env := slices.Clone(p.env)
+	slices.Sort(env)
+	return stepFingerprint{
+		Checksum:      p.serverChecksum,
+		Action:        p.action,
+		ArgumentsHash: hashStrings(key, p.arguments),
+		RunAsUser:     p.runAsUser,
+		EnvHash:       hashStrings(key, env),
+		Keyed:         key != nil,
+	}
+}
+
+// changes lists the parts of the fingerprint that differ from applied. A zero
+// applied fingerprint comes from state written before fingerprints existed,
+// so nothing is reported as changed. Steps are looked up by their action, so
+// it's never among the changes.
+func (f stepFingerprint) changes(applied stepFingerprint) []string {
+	if applied == (stepFingerprint{}) {
+		return nil
+	}
+	var changes []string
+	if f.Checksum != applied.Checksum {
+		changes = append(changes, "checksum")
+	}
+	if f.ArgumentsHash != applied.ArgumentsHash {
+		changes = append(changes, "arguments")
+	}
+	if f.RunAsUser != applied.RunAsUser {
+		changes = append(changes, "runasuser")
+	}
+	if f.EnvHash != applied.EnvHash {
+		changes = append(changes, "env")
+	}
+	return changes
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFingerprintChanges(t *testing.T) {
+	base := &packageInfo{
+		name:           "vim",
+		action:         "install",
+		runAsUser:      "root",
+		serverChecksum: "abc",
+		arguments:      []string{"--yes"},
+		env:            []string{"B=2", "A=1"},
+	}
+
+	testCases := []struct {
+		name     string
+		change   func(p *packageInfo)
+		applied  *stepFingerprint // Defaults to base's fingerprint
+		expected []string
+	}{
+		{name: "Unchanged", change: func(p *packageInfo) {}},
+		{name: "Env order doesn't matter", change: func(p *packageInfo) { p.env = []string{"A=1", "B=2"} }},
+		{name: "Checksum", change: func(p *packageInfo) { p.serverChecksum = "def" }, expected: []string{"checksum"}},
+		{name: "Arguments", change: func(p *packageInfo) { p.arguments = []string{"--no"} }, expected: []string{"arguments"}},
+		{name: "Runasuser", change: func(p *packageInfo) { p.runAsUser = "alice" }, expected: []string{"runasuser"}},
+		{name: "Env", change: func(p *packageInfo) { p.env = []string{"A=1"} }, expected: []string{"env"}},
+		{
+			name:     "Several",
+			change:   func(p *packageInfo) { p.serverChecksum = "def"; p.env = nil },
+			expected: []string{"checksum", "env"},
+		},
+		{
+			name:    "State from before fingerprints",
+			change:  func(p *packageInfo) { p.serverChecksum = "def" },
+			applied: &stepFingerprint{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			applied := base.fingerprint(nil)
+			if tc.applied != nil {
+				applied = *tc.applied
+			}
+			p := *base
+			tc.change(&p)
+			if got := p.fingerprint(nil).changes(applied); !slices.Equal(got, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRunDecisionAfterStepChanges(t *testing.T) {
+	testCases := []struct {
+		name            string
+		ranAs           string // The user the step last succeeded as
+		runAsUser       string
+		arguments       []string
+		expected        planDecision
+		expectedChanges []string
+	}{
+		{name: "Nothing changed", ranAs: "root", runAsUser: "root", expected: planSkip},
+		{name: "Arguments changed", ranAs: "root", runAsUser: "root", arguments: []string{"--force"}, expected: planRunUpdated, expectedChanges: []string{"arguments"}},
+		{name: "Runasuser changed", ranAs: "root", runAsUser: "alice", expected: planRunUpdated, expectedChanges: []string{"runasuser"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			state := newTestState()
+			ran := &packageInfo{name: "vim", action: "install", runAsUser: tc.ranAs, serverChecksum: "abc", startTime: time.Now().Add(-time.Minute)}
+			state.recordRun(ran, scriptStatusSuccess, "", false)
+			p := &packageInfo{name: "vim", action: "install", runAsUser: tc.runAsUser, serverChecksum: "abc", arguments: tc.arguments, updateInterval: 3600}
+
+			// --- Act ---
+			decision := p.runDecision(state)
+
+			// --- Assert ---
+			if decision != tc.expected {
+				t.Errorf("Expected %q, but got %q", tc.expected, decision)
+			}
+			if !slices.Equal(p.changes, tc.expectedChanges) {
+				t.Errorf("Expected changes %v, but got %v", tc.expectedChanges, p.changes)
+			}
+		})
+	}
+}
+
+func TestPreviousStep(t *testing.T) {
+	state := newTestState()
+	for i, runAsUser := range []string{"root", "alice"} {
+		p := &packageInfo{name: "vim", action: "install", runAsUser: runAsUser, startTime: time.Unix(int64(1700000000+i), 0)}
+		state.recordRun(p, scriptStatusSuccess, "", false)
+	}
+	failed := &packageInfo{name: "vim", action: "install", runAsUser: "bob", startTime: time.Unix(1800000000, 0)}
+	state.recordRun(failed, scriptStatusFailed, "", false)
+
+	if previous := state.previousStep("vim", "install"); previous == nil || previous.RunAsUser != "alice" {
+		t.Errorf("Expected the latest successful run, as alice, but got %+v", previous)
+	}
+	if previous := state.previousStep("vim", "configure"); previous != nil {
+		t.Errorf("Expected no previous configure step, but got %+v", previous)
+	}
+}
+
+func TestKeyedFingerprint(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, stateKeySize)
+	p := &packageInfo{name: "vim", action: "install", runAsUser: "root", serverChecksum: "abc", arguments: []string{"--token", "s3cr3t"}, env: []string{"A=1"}}
+	legacy := p.fingerprint(nil)
+	keyed := p.fingerprint(key)
+
+	if !keyed.Keyed || legacy.Keyed {
+		t.Errorf("Expected only the keyed fingerprint to be marked keyed")
+	}
+	if keyed.ArgumentsHash == legacy.ArgumentsHash || keyed.EnvHash == legacy.EnvHash {
+		t.Errorf("Expected the keyed hashes to differ from plain SHA256")
+	}
+	if other := p.fingerprint(bytes.Repeat([]byte{2}, stateKeySize)); other.ArgumentsHash == keyed.ArgumentsHash {
+		t.Errorf("Expected the hashes to depend on the key")
+	}
+
+	testCases := []struct {
+		name     string
+		key      []byte
+		applied  stepFingerprint
+		change   func(p *packageInfo)
+		expected []string
+	}{
+		{name: "Keyed, unchanged", key: key, applied: keyed, change: func(p *packageInfo) {}},
+		{name: "Keyed, arguments changed", key: key, applied: keyed, change: func(p *packageInfo) { p.arguments = nil }, expected: []string{"arguments"}},
+		{name: "Plain SHA256 from before keys", key: key, applied: legacy, change: func(p *packageInfo) {}},
+		{name: "Plain SHA256, env changed", key: key, applied: legacy, change: func(p *packageInfo) { p.env = nil }, expected: []string{"env"}},
+		// A read-only state without the key can't compare the hashes
+		{name: "Keyed, no key", applied: keyed, change: func(p *packageInfo) { p.arguments = nil }},
+		{name: "Keyed, no key, checksum changed", applied: keyed, change: func(p *packageInfo) { p.serverChecksum = "def" }, expected: []string{"checksum"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := newTestState()
+			state.hashKey = tc.key
+			changed := *p
+			tc.change(&changed)
+			if got := state.fingerprint(&changed, tc.applied).changes(tc.applied); !slices.Equal(got, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, got)
+			}
+		})
+	}
+}
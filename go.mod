@@ -11,7 +11,11 @@ require (
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require google.golang.org/grpc v1.79.3
+require (
+	filippo.io/age v1.2.1
+	golang.org/x/sys v0.39.0
+	google.golang.org/grpc v1.79.3
+)
 
 require (
 	dario.cat/mergo v1.0.0 // indirect
@@ -31,7 +35,6 @@ require (
 	github.com/xanzy/ssh-agent v0.3.3 // indirect
 	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/net v0.48.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/text v0.32.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251202230838-ff82c1b0f217 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
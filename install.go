@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+	"time"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+// installCommand implements `assimilator install`. It runs a single package
+// from the server once, whether or not it's in this machine's config, as long
+// as the server allows ad-hoc installs of it.
+func installCommand(args []string) int {
+	flags := newCommandFlags("install", "<package> [arguments...]")
+	action := flags.String("action", "install", "The package script to run")
+	runAsUser := flags.String("runasuser", appConfig.RunAsUser, "The user to run the script as. Only root can run it as another user")
+	timeout := flags.Int64("timeout", 0, "How long the script may run in seconds. 0 uses --script_timeout")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+	packageName := flags.Arg(0)
+
+	state, err := loadAgentState(appConfig.StateDir, appConfig.CacheDir, false)
+	if err != nil {
+		Error("error loading agent state: ", err)
+		return 1
+	}
+	a := &AgentData{
+		appConfig:      &appConfig,
+		commandRunner:  &LiveCommandRunner{},
+		failureReports: make(map[string]string),
+		state:          state,
+	}
+	conn, err := a.connect()
+	if err != nil {
+		Error("failed to connect to the server: ", err)
+		return 1
+	}
+	defer conn.Close()
+
+	// Cancel the script on ctrl+c, like the agent does on shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	resp, err := a.client.GetAdHocPackage(lookupCtx, &pb.AdHocPackageRequest{
+		MachineName: appConfig.Hostname,
+		Package:     packageName,
+	})
+	if err != nil {
+		Error("the server refused the install of ", packageName, ": ", err)
+		return 1
+	}
+	a.configRevision = resp.GetConfigRevision()
+
+	p := convertToPackageInfo(packageName, &pb.PackageSteps{
+		Action:    *action,
+		Arguments: flags.Args()[1:],
+		Runasuser: *runAsUser,
+		Timeout:   *timeout,
+	}, resp.GetChecksum())
+	p.adhoc = true
+	p.forced = true
+
+	err = p.ProcessPackage(ctx, a)
+	p.status = scriptStatus(err)
+	if err != nil {
+		Error("error running ", packageName, "'s ", *action, " action (", p.status, "): ", err)
+		return 1
+	}
+	Success("Ran ", packageName, "'s ", *action, " action as ", p.runAsUser)
+	return 0
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Keys under `machines:` select hosts in one of four ways:
+//
+//	web01                 the exact hostname
+//	lab-*                 a glob (path.Match) against the hostname
+//	/^lab-\d+$/           a regex against the hostname
+//	arch=arm64,distro=*   a label selector against the host's reported facts
+//
+// Every matching entry applies, merged from the least specific to the most
+// specific, so the most specific entry is applied last and wins.
+type selectorKind int
+
+const (
+	selectorLabels selectorKind = iota
+	selectorRegex
+	selectorGlob
+	selectorExact
+)
+
+func (k selectorKind) String() string {
+	switch k {
+	case selectorLabels:
+		return "labels"
+	case selectorRegex:
+		return "regex"
+	case selectorGlob:
+		return "glob"
+	}
+	return "exact"
+}
+
+// machineSelector is a parsed `machines:` key
+type machineSelector struct {
+	key    string
+	kind   selectorKind
+	regex  *regexp.Regexp
+	labels map[string]string
+	// Within a kind, a higher weight is more specific: the literal characters of
+	// a glob or regex, or the number of labels in a selector
+	weight int
+}
+
+func parseMachineSelector(key string) (machineSelector, error) {
+	selector := machineSelector{key: key}
+	switch {
+	case len(key) > 2 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/"):
+		expression := key[1 : len(key)-1]
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			return selector, fmt.Errorf("invalid machine regex %s: %w", key, err)
+		}
+		selector.kind = selectorRegex
+		selector.regex = regex
+		selector.weight = literalLength(expression, `\^$.|?*+()[]{}`)
+	case strings.Contains(key, "="):
+		selector.kind = selectorLabels
+		selector.labels = make(map[string]string)
+		for _, label := range strings.Split(key, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(label), "=")
+			if !ok || name == "" {
+				return selector, fmt.Errorf("invalid machine label selector %s: %q is not name=value", key, label)
+			}
+			if _, err := path.Match(value, ""); err != nil {
+				return selector, fmt.Errorf("invalid machine label selector %s: %w", key, err)
+			}
+			selector.labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+		selector.weight = len(selector.labels)
+	case strings.ContainsAny(key, "*?["):
+		if _, err := path.Match(key, ""); err != nil {
+			return selector, fmt.Errorf("invalid machine glob %s: %w", key, err)
+		}
+		selector.kind = selectorGlob
+		selector.weight = literalLength(key, `*?[]\`)
+	default:
+		selector.kind = selectorExact
+	}
+	return selector, nil
+}
+
+// literalLength counts the characters in a pattern that aren't special
+func literalLength(pattern string, special string) int {
+	length := 0
+	for _, r := range pattern {
+		if !strings.ContainsRune(special, r) {
+			length++
+		}
+	}
+	return length
+}
+
+// matches reports whether the selector selects the host, and why
+func (s machineSelector) matches(hostname string, facts map[string][]string) (bool, string) {
+	switch s.kind {
+	case selectorExact:
+		return s.key == hostname, "hostname is " + hostname
+	case selectorGlob:
+		ok, _ := path.Match(s.key, hostname)
+		return ok, "glob against hostname " + hostname
+	case selectorRegex:
+		return s.regex.MatchString(hostname), "regex against hostname " + hostname
+	}
+	if len(facts) == 0 {
+		return false, "no facts reported"
+	}
+	for name, pattern := range s.labels {
+		if !factsMatch(map[string]string{name: pattern}, facts) {
+			return false, fmt.Sprintf("%s is %q", name, strings.Join(facts[name], ","))
+		}
+	}
+	return true, "all labels match the reported facts"
+}
+
+// compareSpecificity orders selectors from least to most specific. Ties are
+// broken by the key so the order never depends on map iteration.
+func compareSpecificity(a, b machineSelector) int {
+	return cmp.Or(
+		cmp.Compare(a.kind, b.kind),
+		cmp.Compare(a.weight, b.weight),
+		cmp.Compare(a.key, b.key),
+	)
+}
+
+// parseMachineSelectors parses every `machines:` key, ordered from least to most specific
+func (d *DesiredState) parseMachineSelectors() error {
+	d.selectors = make([]machineSelector, 0, len(d.Machines))
+	for key := range d.Machines {
+		selector, err := parseMachineSelector(key)
+		if err != nil {
+			return err
+		}
+		d.selectors = append(d.selectors, selector)
+	}
+	slices.SortFunc(d.selectors, compareSpecificity)
+	return nil
+}
+
+// machineMatch explains whether one `machines:` entry applies to a host
+type machineMatch struct {
+	Key     string `json:"key"`
+	Kind    string `json:"kind"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason"`
+}
+
+// explainMachine lists every `machines:` entry in merge order and whether it
+// applies to the host
+func (d *DesiredState) explainMachine(hostname string, facts map[string][]string) []machineMatch {
+	explanation := make([]machineMatch, 0, len(d.selectors))
+	for _, selector := range d.selectors {
+		matched, reason := selector.matches(hostname, facts)
+		explanation = append(explanation, machineMatch{
+			Key:     selector.key,
+			Kind:    selector.kind.String(),
+			Matched: matched,
+			Reason:  reason,
+		})
+	}
+	return explanation
+}
+
+// matchedMachineConfig merges every `machines:` entry that applies to the host,
+// from the least to the most specific. Each applied profile is used once,
+// followed by the entries' own packages, and each app_config field and
+// applied_config comes from the most specific entry that sets it.
+func (d *DesiredState) matchedMachineConfig(hostname string, facts map[string][]string) (MachineConfig, bool) {
+	var matched []string
+	for _, selector := range d.selectors {
+		if ok, _ := selector.matches(hostname, facts); ok {
+			matched = append(matched, selector.key)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return MachineConfig{}, false
+	case 1:
+		return d.Machines[matched[0]], true
+	}
+	Debug(hostname, " matched machine entries (least to most specific): ", strings.Join(matched, ", "))
+
+	merged := MachineConfig{entries: matched}
+	for _, key := range matched {
+		machine := d.Machines[key]
+		for _, profileName := range machine.AppliedProfiles {
+			if !slices.Contains(merged.AppliedProfiles, profileName) {
+				merged.AppliedProfiles = append(merged.AppliedProfiles, profileName)
+			}
+		}
+		mergeAppConfig(&merged.Global, machine.Global)
+		if machine.AppliedConfig != "" {
+			merged.AppliedConfig = machine.AppliedConfig
+		}
+		for _, packageName := range machine.ExcludePackages {
+			if !slices.Contains(merged.ExcludePackages, packageName) {
+				merged.ExcludePackages = append(merged.ExcludePackages, packageName)
+			}
+		}
+	}
+	merged.Packages, merged.merge = d.mergePackages(hostname, merged.AppliedProfiles, matched)
+	merged.vars = d.mergeVars(merged.AppliedProfiles, matched)
+	return merged, true
+}
+
+// mergeAppConfig copies every field override sets into merged. A field left
+// at its zero value isn't set, so it keeps what a less specific entry gave it.
+func mergeAppConfig(merged *AppConfig, override AppConfig) {
+	mergedValue := reflect.ValueOf(merged).Elem()
+	overrideValue := reflect.ValueOf(override)
+	for i := range overrideValue.NumField() {
+		field := overrideValue.Field(i)
+		if mergedValue.Field(i).CanSet() && !field.IsZero() {
+			mergedValue.Field(i).Set(field)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseMachineSelector(t *testing.T) {
+	testCases := []struct {
+		name           string
+		key            string
+		expectedKind   selectorKind
+		expectedWeight int
+		expectErr      bool
+	}{
+		{name: "Exact", key: "web01", expectedKind: selectorExact},
+		{name: "Glob", key: "lab-*", expectedKind: selectorGlob, expectedWeight: 4},
+		{name: "Regex", key: `/^lab-\d+$/`, expectedKind: selectorRegex, expectedWeight: 5},
+		{name: "Labels", key: "arch=arm64, distro=*", expectedKind: selectorLabels, expectedWeight: 2},
+		{name: "Invalid regex", key: "/lab-(/", expectErr: true},
+		{name: "Invalid glob", key: "lab-[", expectErr: true},
+		{name: "Label without a name", key: "=arm64", expectErr: true},
+		{name: "Invalid label pattern", key: "arch=[", expectErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selector, err := parseMachineSelector(tc.key)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, but got %+v", selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if selector.kind != tc.expectedKind || selector.weight != tc.expectedWeight {
+				t.Errorf("Expected %s with weight %d, but got %s with weight %d", tc.expectedKind, tc.expectedWeight, selector.kind, selector.weight)
+			}
+		})
+	}
+}
+
+func TestSelectorSpecificityOrder(t *testing.T) {
+	desiredState := &DesiredState{Machines: map[string]MachineConfig{
+		"web01":               {},
+		"web*":                {},
+		"w*":                  {},
+		"/^web\\d+$/":         {},
+		"arch=arm64":          {},
+		"arch=arm64,os=linux": {},
+		"distro=debian":       {},
+	}}
+	if err := desiredState.parseMachineSelectors(); err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, selector := range desiredState.selectors {
+		order = append(order, selector.key)
+	}
+	// Labels, regexes, globs, then exact hostnames, each from fewest to most
+	// literal characters or labels, with ties in key order
+	expected := []string{"arch=arm64", "distro=debian", "arch=arm64,os=linux", "/^web\\d+$/", "w*", "web*", "web01"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("Expected %v, but got %v", expected, order)
+	}
+}
+
+func TestMatchedMachineConfig(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+profiles:
+  base: {}
+  web: {}
+  arm: {}
+machines:
+  web*:
+    applied_profiles: [base, web]
+    applied_config: web.toml
+    exclude_packages: [nano]
+    app_config:
+      verbositylevel: 4
+      githubrepo: infra
+  arch=arm64:
+    applied_profiles: [arm, base]
+    app_config:
+      verbositylevel: 2
+      githubbranch: arm
+  web01:
+    applied_profiles: [web]
+    exclude_packages: [nano, emacs]
+    app_config:
+      verbositylevel: 5
+`})
+	desiredState, err := LoadDesiredState(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		hostname string
+		facts    map[string][]string
+
+		expectFound      bool
+		expectedEntries  []string
+		expectedProfiles []string
+		expectedExcludes []string
+		expectedConfig   string
+		expectedGlobal   AppConfig
+	}{
+		{
+			name:     "Every entry",
+			hostname: "web01",
+			facts:    map[string][]string{"arch": {"arm64"}},
+
+			expectFound:      true,
+			expectedEntries:  []string{"arch=arm64", "web*", "web01"},
+			expectedProfiles: []string{"arm", "base", "web"},
+			expectedExcludes: []string{"nano", "emacs"},
+			expectedConfig:   "web.toml",
+			// web01 doesn't set the repo or branch, so the less specific entries' stay
+			expectedGlobal: AppConfig{VerbosityLevel: 5, GithubRepo: "infra", GithubBranch: "arm"},
+		},
+		{
+			name:     "Glob and exact",
+			hostname: "web01",
+
+			expectFound:      true,
+			expectedEntries:  []string{"web*", "web01"},
+			expectedProfiles: []string{"base", "web"},
+			expectedExcludes: []string{"nano", "emacs"},
+			expectedConfig:   "web.toml",
+			expectedGlobal:   AppConfig{VerbosityLevel: 5, GithubRepo: "infra"},
+		},
+		{
+			name:     "Only the glob",
+			hostname: "web02",
+
+			expectFound:      true,
+			expectedEntries:  []string{"web*"},
+			expectedProfiles: []string{"base", "web"},
+			expectedExcludes: []string{"nano"},
+			expectedConfig:   "web.toml",
+			expectedGlobal:   AppConfig{VerbosityLevel: 4, GithubRepo: "infra"},
+		},
+		{name: "No entry", hostname: "db01", facts: map[string][]string{"arch": {"amd64"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine, found := desiredState.matchedMachineConfig(tc.hostname, tc.facts)
+			if found != tc.expectFound {
+				t.Fatalf("Expected found %v, but got %v", tc.expectFound, found)
+			}
+			if !found {
+				return
+			}
+			if !slices.Equal(machine.entries, tc.expectedEntries) {
+				t.Errorf("Expected entries %v, but got %v", tc.expectedEntries, machine.entries)
+			}
+			if !slices.Equal(machine.AppliedProfiles, tc.expectedProfiles) {
+				t.Errorf("Expected profiles %v, but got %v", tc.expectedProfiles, machine.AppliedProfiles)
+			}
+			if !slices.Equal(machine.ExcludePackages, tc.expectedExcludes) {
+				t.Errorf("Expected excludes %v, but got %v", tc.expectedExcludes, machine.ExcludePackages)
+			}
+			if machine.AppliedConfig != tc.expectedConfig {
+				t.Errorf("Expected applied_config %q, but got %q", tc.expectedConfig, machine.AppliedConfig)
+			}
+			global := machine.Global
+			if global.VerbosityLevel != tc.expectedGlobal.VerbosityLevel || global.GithubRepo != tc.expectedGlobal.GithubRepo || global.GithubBranch != tc.expectedGlobal.GithubBranch {
+				t.Errorf("Expected app_config %+v, but got verbosity %d, repo %q and branch %q", tc.expectedGlobal, global.VerbosityLevel, global.GithubRepo, global.GithubBranch)
+			}
+		})
+	}
+}
+
+func TestExplainMachine(t *testing.T) {
+	desiredState := &DesiredState{Machines: map[string]MachineConfig{"web01": {}, "lab-*": {}, "arch=arm64": {}}}
+	if err := desiredState.parseMachineSelectors(); err != nil {
+		t.Fatal(err)
+	}
+	explanation := desiredState.explainMachine("web01", nil)
+
+	var lines []string
+	for _, match := range explanation {
+		lines = append(lines, match.Key+" "+match.Kind+" "+map[bool]string{true: "matched", false: "no"}[match.Matched]+": "+match.Reason)
+	}
+	expected := []string{
+		"arch=arm64 labels no: no facts reported",
+		"lab-* glob no: glob against hostname web01",
+		"web01 exact matched: hostname is web01",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\nbut got:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	asslog "github.com/geogian28/Assimilator/assimilator_logger"
+)
+
+// TestMain starts the logger, since nearly everything logs. It's flushed
+// rather than closed at the end, since Close exits with status 0 and would
+// hide failing tests.
+func TestMain(m *testing.M) {
+	asslog.StartLogger()
+	code := m.Run()
+	asslog.Flush()
+	os.Exit(code)
+}
+
+// newTestState returns an in-memory agent state that's never saved
+func newTestState() *AgentState {
+	return &AgentState{
+		readOnly: true,
+		Version:  agentStateVersion,
+		Packages: make(map[string]*PackageState),
+	}
+}
+
+// writeTestTarball packs scripts (name to body) into tarballPath the way the
+// server serves packages
+func writeTestTarball(t *testing.T, tarballPath string, scripts map[string]string) {
+	t.Helper()
+	sourceDir := t.TempDir()
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(tarballPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command("tar", "-czf", tarballPath, "-C", sourceDir, ".").CombinedOutput(); err != nil {
+		t.Fatalf("failed to pack %s: %v: %s", tarballPath, err, output)
+	}
+}
+
+// writeTestConfig writes a config repository, file name to contents, and
+// returns the path to its config.yaml
+func writeTestConfig(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+// runGit runs git in repoDir and returns its trimmed output
+func runGit(t *testing.T, repoDir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = repoDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// factFlags collects repeated -fact name=value flags
+type factFlags map[string][]string
+
+func (f factFlags) String() string {
+	return fmt.Sprint(map[string][]string(f))
+}
+
+func (f factFlags) Set(value string) error {
+	name, factValue, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("%q is not name=value", value)
+	}
+	f[name] = append(f[name], factValue)
+	return nil
+}
+
+// defaultConfigPath is the config.yaml in the server's repository checkout
+func defaultConfigPath() string {
+	if appConfig.RepoDir == "" {
+		return "config.yaml"
+	}
+	return filepath.Join(appConfig.RepoDir, "config.yaml")
+}
+
+// matchCommand implements `assimilator match`, which explains which
+// `machines:` entries apply to a host and in what order they merge
+func matchCommand(args []string) int {
+	flags := newCommandFlags("match", "<hostname>")
+	configPath := flags.String("config", defaultConfigPath(), "The config.yaml to read")
+	asJSON := flags.Bool("json", false, "Print the matches as JSON")
+	overrides := factFlags{}
+	flags.Var(overrides, "fact", "Set a fact as name=value, overriding what the host last reported. Repeatable")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	hostname := flags.Arg(0)
+
+	desiredState, err := LoadDesiredState(*configPath)
+	if err != nil {
+		Error("error loading ", *configPath, ": ", err)
+		return 1
+	}
+	// Start from the facts the host last reported to this server
+	facts := factValues(newFactStore(filepath.Join(appConfig.StateDir, "facts")).get(hostname))
+	for name, values := range overrides {
+		facts[name] = values
+	}
+	matches := desiredState.explainMachine(hostname, facts)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(matches)
+	} else {
+		err = printMatches(hostname, matches)
+	}
+	if err != nil {
+		Error("error printing matches: ", err)
+		return 1
+	}
+	return 0
+}
+
+func printMatches(hostname string, matches []machineMatch) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDER\tENTRY\tKIND\tMATCHED\tREASON")
+	var applied []string
+	for _, match := range matches {
+		order := "-"
+		if match.Matched {
+			applied = append(applied, match.Key)
+			order = fmt.Sprint(len(applied))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\n", order, match.Key, match.Kind, match.Matched, match.Reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+	if len(applied) == 0 {
+		fmt.Println("No machine entries apply to", hostname)
+		return nil
+	}
+	fmt.Printf("%s merges %s. The last one is the most specific and wins.\n", hostname, strings.Join(applied, ", then "))
+	return nil
+}
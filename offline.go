@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const configSnapshotFilename = "last_config.json"
+
+// configSnapshot is the last config the server returned, kept so the agent
+// can keep converging while the server is unreachable
+type configSnapshot struct {
+	SavedAt  time.Time       `json:"saved_at"`
+	Response json.RawMessage `json:"response"` // a GetSpecificConfigResponse in protojson
+}
+
+func configSnapshotPath() string {
+	return filepath.Join(appConfig.StateDir, configSnapshotFilename)
+}
+
+// snapshotSecretReason is why a step with secrets isn't applied offline
+const snapshotSecretReason = "it has secrets, which aren't saved for offline mode"
+
+// saveConfigSnapshot stores a successful GetSpecificConfig response. Steps with
+// secrets hold the plaintext, so they're left out and recorded as skipped
+// instead; their packages stay, so offline runs don't treat them as removed.
+func saveConfigSnapshot(resp *pb.GetSpecificConfigResponse) error {
+	resp = proto.Clone(resp).(*pb.GetSpecificConfigResponse)
+	for _, pkgName := range slices.Sorted(maps.Keys(resp.GetPackages())) {
+		packageConfig := resp.GetPackages()[pkgName]
+		packageConfig.PackageSteps = slices.DeleteFunc(packageConfig.GetPackageSteps(), func(step *pb.PackageSteps) bool {
+			if !step.GetHasSecrets() {
+				return false
+			}
+			resp.SkippedSteps = append(resp.SkippedSteps, &pb.SkippedStep{Package: pkgName, Action: step.GetAction(), Reason: snapshotSecretReason})
+			return true
+		})
+	}
+
+	response, err := protojson.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config snapshot: %w", err)
+	}
+	data, err := json.MarshalIndent(configSnapshot{SavedAt: time.Now(), Response: response}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config snapshot: %w", err)
+	}
+	// Responses still carry the other steps' arguments, so keep them private
+	tempPath := configSnapshotPath() + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write config snapshot: %w", err)
+	}
+	if err := os.Rename(tempPath, configSnapshotPath()); err != nil {
+		return fmt.Errorf("failed to replace config snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadConfigSnapshot reads the last saved response and when it was saved
+func loadConfigSnapshot() (*pb.GetSpecificConfigResponse, time.Time, error) {
+	data, err := os.ReadFile(configSnapshotPath())
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read config snapshot: %w", err)
+	}
+	var snapshot configSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse config snapshot: %w", err)
+	}
+	resp := &pb.GetSpecificConfigResponse{}
+	if err := protojson.Unmarshal(snapshot.Response, resp); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse config snapshot response: %w", err)
+	}
+	return resp, snapshot.SavedAt, nil
+}
+
+// isServerUnreachable reports whether an error from the server means it couldn't be reached at all,
+// as opposed to the server answering with an error
+func isServerUnreachable(err error) bool {
+	errorStatus, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch errorStatus.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// offlineConfig returns the last known config if the server is unreachable and
+// the snapshot is younger than appConfig.OfflineMaxAge
+func (a *AgentData) offlineConfig(serverErr error) (map[string]*pb.PackageConfig, error) {
+	if !isServerUnreachable(serverErr) {
+		return nil, serverErr
+	}
+	if appConfig.OfflineMaxAge <= 0 {
+		return nil, fmt.Errorf("%w (offline mode is disabled)", serverErr)
+	}
+	resp, savedAt, err := loadConfigSnapshot()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w (no config snapshot for offline mode)", serverErr)
+		}
+		return nil, fmt.Errorf("%w (%s)", serverErr, err)
+	}
+	age := time.Since(savedAt)
+	maxAge := time.Duration(appConfig.OfflineMaxAge) * time.Second
+	if age > maxAge {
+		return nil, fmt.Errorf("%w (config snapshot is %s old, older than the offline maximum of %s)", serverErr, age.Round(time.Second), maxAge)
+	}
+
+	a.offline = true
+	a.configRevision = resp.GetConfigRevision()
+	a.maxRemovals = maxRemovals(resp)
+	a.skippedSteps = resp.GetSkippedSteps()
+	Warning("OFFLINE: the server is unreachable. Applying the last known config from ", savedAt.Format(time.RFC3339), " (", age.Round(time.Second), " old).")
+	return resp.GetPackages(), nil
+}
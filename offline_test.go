@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestIsServerUnreachable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "Unavailable", err: status.Error(codes.Unavailable, "connection refused"), expected: true},
+		{name: "Deadline exceeded", err: status.Error(codes.DeadlineExceeded, "timeout"), expected: true},
+		{name: "Server answered", err: status.Error(codes.NotFound, "no such machine"), expected: false},
+		{name: "Not a gRPC error", err: errors.New("boom"), expected: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isServerUnreachable(tc.err); got != tc.expected {
+				t.Errorf("Expected %v, but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestOfflineConfig(t *testing.T) {
+	defer func(stateDir string, maxAge int64) {
+		appConfig.StateDir, appConfig.OfflineMaxAge = stateDir, maxAge
+	}(appConfig.StateDir, appConfig.OfflineMaxAge)
+	unreachable := status.Error(codes.Unavailable, "connection refused")
+
+	testCases := []struct {
+		name       string
+		serverErr  error
+		snapshot   bool
+		snapshotAt time.Duration // How old the snapshot is
+		maxAge     int64
+
+		expectErr     bool
+		expectPackage bool
+	}{
+		{name: "Fresh snapshot", serverErr: unreachable, snapshot: true, snapshotAt: time.Minute, maxAge: 3600, expectPackage: true},
+		{name: "Snapshot too old", serverErr: unreachable, snapshot: true, snapshotAt: 2 * time.Hour, maxAge: 3600, expectErr: true},
+		{name: "Offline mode disabled", serverErr: unreachable, snapshot: true, snapshotAt: time.Minute, maxAge: 0, expectErr: true},
+		{name: "No snapshot", serverErr: unreachable, maxAge: 3600, expectErr: true},
+		{name: "Server answered with an error", serverErr: status.Error(codes.NotFound, "no such machine"), snapshot: true, maxAge: 3600, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			appConfig.StateDir = t.TempDir()
+			appConfig.OfflineMaxAge = tc.maxAge
+			if tc.snapshot {
+				resp := &pb.GetSpecificConfigResponse{
+					ConfigRevision: "rev1",
+					Packages:       map[string]*pb.PackageConfig{"vim": {Checksum: "abc", PackageSteps: []*pb.PackageSteps{{Action: "install"}}}},
+				}
+				if err := saveConfigSnapshot(resp); err != nil {
+					t.Fatal(err)
+				}
+				ageSnapshot(t, tc.snapshotAt)
+			}
+			a := &AgentData{}
+
+			// --- Act ---
+			packages, err := a.offlineConfig(tc.serverErr)
+
+			// --- Assert ---
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, but got nil")
+				}
+				if a.offline {
+					t.Errorf("Expected the agent to stay online")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if _, ok := packages["vim"]; !ok || !a.offline || a.configRevision != "rev1" {
+				t.Errorf("Expected the snapshot's config, but got %v (offline %v, revision %q)", packages, a.offline, a.configRevision)
+			}
+		})
+	}
+}
+
+// ageSnapshot rewrites the saved snapshot as if it was saved age ago
+func ageSnapshot(t *testing.T, age time.Duration) {
+	t.Helper()
+	data, err := os.ReadFile(configSnapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot configSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.SavedAt = time.Now().Add(-age)
+	if data, err = json.Marshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configSnapshotPath(), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigSnapshotRoundTrip(t *testing.T) {
+	defer func(stateDir string) { appConfig.StateDir = stateDir }(appConfig.StateDir)
+	appConfig.StateDir = t.TempDir()
+	resp := &pb.GetSpecificConfigResponse{
+		ConfigRevision:  "rev1",
+		AppliedProfiles: []string{"base"},
+		Packages:        map[string]*pb.PackageConfig{"vim": {Checksum: "abc", PackageSteps: []*pb.PackageSteps{{Action: "install", Arguments: []string{"--yes"}}}}},
+	}
+	if err := saveConfigSnapshot(resp); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(configSnapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the snapshot to be private, but its mode is %v", info.Mode().Perm())
+	}
+
+	loaded, savedAt, err := loadConfigSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(savedAt) > time.Minute {
+		t.Errorf("Expected the snapshot to be saved just now, but got %v", savedAt)
+	}
+	want, _ := protojson.Marshal(resp)
+	got, _ := protojson.Marshal(loaded)
+	if string(want) != string(got) {
+		t.Errorf("Expected %s, but got %s", want, got)
+	}
+}
+
+func TestConfigSnapshotLeavesOutSecrets(t *testing.T) {
+	defer func(stateDir string) { appConfig.StateDir = stateDir }(appConfig.StateDir)
+	appConfig.StateDir = t.TempDir()
+	resp := &pb.GetSpecificConfigResponse{
+		Packages: map[string]*pb.PackageConfig{
+			"app": {Checksum: "abc", PackageSteps: []*pb.PackageSteps{
+				{Action: "install", Arguments: []string{"--token", "s3cr3t"}, HasSecrets: true},
+				{Action: "configure", Arguments: []string{"--yes"}},
+			}},
+			"db": {Checksum: "def", PackageSteps: []*pb.PackageSteps{{Action: "install", Env: map[string]string{"PASSWORD": "hunter2"}, HasSecrets: true}}},
+		},
+		SkippedSteps: []*pb.SkippedStep{{Package: "vim", Action: "install", Reason: "os=debian"}},
+	}
+	if err := saveConfigSnapshot(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(configSnapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"s3cr3t", "hunter2"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Expected %q to be left out of the snapshot", secret)
+		}
+	}
+	if len(resp.GetPackages()["app"].GetPackageSteps()) != 2 {
+		t.Errorf("Expected the response itself to be left alone")
+	}
+
+	loaded, _, err := loadConfigSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps := loaded.GetPackages()["app"].GetPackageSteps(); len(steps) != 1 || steps[0].GetAction() != "configure" {
+		t.Errorf("Expected only the configure step without secrets, but got %v", steps)
+	}
+	// Kept with no steps, so offline runs don't count it as removed
+	if db, ok := loaded.GetPackages()["db"]; !ok || len(db.GetPackageSteps()) != 0 {
+		t.Errorf("Expected db to stay without its steps, but got %v", db)
+	}
+	var skipped []string
+	for _, step := range loaded.GetSkippedSteps() {
+		skipped = append(skipped, step.GetPackage()+" "+step.GetAction()+": "+step.GetReason())
+	}
+	expected := []string{"vim install: os=debian", "app install: " + snapshotSecretReason, "db install: " + snapshotSecretReason}
+	if !slices.Equal(skipped, expected) {
+		t.Errorf("Expected skipped steps %q, but got %q", expected, skipped)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// packageMerge records how mergePackages built a machine's packages, for
+// render to explain
+type packageMerge struct {
+	stepSources map[string][]string // The profile or machine entry each merged step came from
+	notes       map[string][]string // Steps replaced or skipped, and packages excluded
+}
+
+func newPackageMerge() packageMerge {
+	return packageMerge{
+		stepSources: make(map[string][]string),
+		notes:       make(map[string][]string),
+	}
+}
+
+// mergePackages builds a machine's packages from its resolved profiles, in
+// order, followed by the own packages of each `machines:` entry. Merging:
+//
+//   - adds a package's steps to the ones already merged,
+//   - skips a step identical to one already merged,
+//   - starts over from a package's steps when one of them has replace: true,
+//   - and finally drops the entries' exclude_packages.
+func (d *DesiredState) mergePackages(machineName string, profileNames []string, entries []string) (map[string][]PackageStep, packageMerge) {
+	merged := make(map[string][]PackageStep)
+	merge := newPackageMerge()
+
+	for _, profileName := range profileNames {
+		profile, ok := d.Profiles[profileName]
+		if !ok {
+			Error("Cannot apply profile: ", profileName, " to machine: ", machineName, ": profile not found")
+			continue
+		}
+		Trace(fmt.Sprintf(`Copying packages from profile "%s" to machine: %s`, profileName, machineName))
+		merge.add(merged, "profile "+profileName, profile.Packages)
+	}
+	for _, entry := range entries {
+		Trace(fmt.Sprintf(`Applying specific overrides for machine: %s`, entry))
+		merge.add(merged, "machine "+entry, d.Machines[entry].ownPackages)
+	}
+	// Excludes apply across every entry the machine matches, so each note
+	// says which entry an exclude came from
+	excludedBy := make(map[string]string)
+	for _, entry := range entries {
+		for _, packageName := range d.Machines[entry].ExcludePackages {
+			if by, ok := excludedBy[packageName]; ok {
+				merge.notes[packageName] = append(merge.notes[packageName], "also excluded by machine "+entry)
+				Debug("machine ", entry, " excludes package ", packageName, " for ", machineName, ", which machine ", by, " already excludes")
+				continue
+			}
+			if _, ok := merged[packageName]; !ok {
+				merge.notes[packageName] = append(merge.notes[packageName], "excluded by machine "+entry+", but no profile or machine entry applies it")
+				Warning("machine ", entry, " excludes package ", packageName, ", which no profile or machine entry applies to ", machineName)
+				continue
+			}
+			excludedBy[packageName] = entry
+			delete(merged, packageName)
+			delete(merge.stepSources, packageName)
+			merge.notes[packageName] = append(merge.notes[packageName], "excluded by machine "+entry)
+		}
+	}
+	return merged, merge
+}
+
+// add merges source's packages into target
+func (m packageMerge) add(target map[string][]PackageStep, source string, packages map[string][]PackageStep) {
+	for _, pkgName := range slices.Sorted(maps.Keys(packages)) {
+		pkgSteps := packages[pkgName]
+		if slices.ContainsFunc(pkgSteps, func(step PackageStep) bool { return step.Replace }) {
+			if len(target[pkgName]) > 0 {
+				m.notes[pkgName] = append(m.notes[pkgName], fmt.Sprintf("%d step(s) replaced by %s", len(target[pkgName]), source))
+			}
+			target[pkgName] = nil
+			m.stepSources[pkgName] = nil
+		}
+		for _, step := range pkgSteps {
+			if step.RunAsUser == "" {
+				step.RunAsUser = "root"
+			}
+			if slices.ContainsFunc(target[pkgName], step.sameAs) {
+				m.notes[pkgName] = append(m.notes[pkgName], fmt.Sprintf("duplicate %s step from %s skipped", step.Action, source))
+				continue
+			}
+			target[pkgName] = append(target[pkgName], step)
+			m.stepSources[pkgName] = append(m.stepSources[pkgName], source)
+		}
+	}
+}
+
+// sameAs reports whether two steps would run the same thing. The checksum and
+// replace marker don't change what a step runs.
+func (s PackageStep) sameAs(other PackageStep) bool {
+	s.Checksum, other.Checksum = "", ""
+	s.Replace, other.Replace = false, false
+	return reflect.DeepEqual(s, other)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMergePackages(t *testing.T) {
+	desiredState := &DesiredState{
+		Profiles: map[string]ProfileConfig{
+			"base": {Packages: map[string][]PackageStep{
+				"vim":  {{Action: "install"}},
+				"nano": {{Action: "install"}},
+				"git":  {{Action: "install"}, {Action: "configure", Arguments: []string{"--global"}}},
+			}},
+			"dev": {Packages: map[string][]PackageStep{
+				"vim": {{Action: "install", RunAsUser: "root"}, {Action: "configure"}},
+				"git": {{Action: "install", Arguments: []string{"--lfs"}, Replace: true}},
+			}},
+		},
+		Machines: map[string]MachineConfig{
+			"web*": {
+				ownPackages:     map[string][]PackageStep{"nginx": {{Action: "install"}}},
+				ExcludePackages: []string{"nano", "emacs"},
+			},
+			"web01": {
+				ownPackages:     map[string][]PackageStep{"vim": {{Action: "install", RunAsUser: "alice"}}},
+				ExcludePackages: []string{"nano"},
+			},
+		},
+	}
+
+	packages, merge := desiredState.mergePackages("web01", []string{"base", "dev"}, []string{"web*", "web01"})
+
+	testCases := []struct {
+		name            string
+		packageName     string
+		expectedSteps   []string // action/runasuser/arguments
+		expectedSources []string
+		expectedNotes   []string
+	}{
+		{
+			name:            "Duplicates are skipped",
+			packageName:     "vim",
+			expectedSteps:   []string{"install/root/", "configure/root/", "install/alice/"},
+			expectedSources: []string{"profile base", "profile dev", "machine web01"},
+			expectedNotes:   []string{"duplicate install step from profile dev skipped"},
+		},
+		{
+			name:            "Replaced",
+			packageName:     "git",
+			expectedSteps:   []string{"install/root/--lfs"},
+			expectedSources: []string{"profile dev"},
+			expectedNotes:   []string{"2 step(s) replaced by profile dev"},
+		},
+		{
+			name:          "Excluded",
+			packageName:   "nano",
+			expectedNotes: []string{"excluded by machine web*", "also excluded by machine web01"},
+		},
+		{
+			name:          "Excluded but never applied",
+			packageName:   "emacs",
+			expectedNotes: []string{"excluded by machine web*, but no profile or machine entry applies it"},
+		},
+		{
+			name:            "Machine's own package",
+			packageName:     "nginx",
+			expectedSteps:   []string{"install/root/"},
+			expectedSources: []string{"machine web*"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var steps []string
+			for _, step := range packages[tc.packageName] {
+				steps = append(steps, step.Action+"/"+step.RunAsUser+"/"+strings.Join(step.Arguments, " "))
+			}
+			if !slices.Equal(steps, tc.expectedSteps) {
+				t.Errorf("Expected steps %v, but got %v", tc.expectedSteps, steps)
+			}
+			if sources := merge.stepSources[tc.packageName]; !slices.Equal(sources, tc.expectedSources) {
+				t.Errorf("Expected sources %v, but got %v", tc.expectedSources, sources)
+			}
+			if notes := merge.notes[tc.packageName]; !slices.Equal(notes, tc.expectedNotes) {
+				t.Errorf("Expected notes %v, but got %v", tc.expectedNotes, notes)
+			}
+		})
+	}
+	if _, ok := packages["emacs"]; ok || len(packages) != 3 {
+		t.Errorf("Expected vim, git and nginx only, but got %v", packages)
+	}
+}
+
+func TestFactProfileMergeOrder(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+profiles:
+  arm:
+    packages:
+      firmware: [{action: install, arguments: [--arm]}]
+  base:
+    packages:
+      firmware: [{action: install, arguments: [--generic], replace: true}]
+machines:
+  pi01:
+    applied_profiles: [base]
+fact_profiles:
+  - match: {arch: arm64}
+    applied_profiles: [arm]
+`})
+	desiredState, err := LoadDesiredState(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factProfiles := desiredState.FactProfiles[0].AppliedProfiles
+
+	machine, _ := desiredState.machineConfigFor("pi01", map[string][]string{"arch": {"arm64"}})
+
+	// The machine's own profile is merged last, so its replace wins
+	if !slices.Equal(machine.AppliedProfiles, []string{"arm", "base"}) {
+		t.Errorf("Expected the profiles in merge order, but got %v", machine.AppliedProfiles)
+	}
+	if steps := machine.Packages["firmware"]; len(steps) != 1 || steps[0].Arguments[0] != "--generic" {
+		t.Errorf("Expected base's firmware step to replace arm's, but got %v", steps)
+	}
+	if !slices.Equal(factProfiles, []string{"arm"}) || !slices.Equal(desiredState.Machines["pi01"].AppliedProfiles, []string{"base"}) {
+		t.Errorf("Expected the config to be left alone, but got fact profiles %v and machine profiles %v", factProfiles, desiredState.Machines["pi01"].AppliedProfiles)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"os"
 	"os/exec"
@@ -13,6 +15,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	pb "github.com/geogian28/Assimilator/proto"
@@ -31,18 +34,69 @@ type packageInfo struct {
 	size             int64
 	name             string // the name of the package, but excluding the .tar.gz extension
 	// localChecksum    string   // the checksum of the local package file
-	serverChecksum string    // the checksum of the server's package file
-	path           string    // the path to the local package including the .tar.gz extension
-	extractDir     string    // the directory to extract the package into
-	arguments      []string  // Any arguments that need to be passed to the package installer
-	env            []string  // Any environment variables that need to be set
-	runAsUser      string    // The user to run the package installer as
-	ticketStatus   string    // The status of the package in Tormon
-	ticketID       int       // The ID of the ticket in Tormon, if it exists
-	action         string    // The action to perform on the package
-	lastRunTime    time.Time // The last time the package was run
-	updated        bool      // Whether the package has been updated
-	updateInterval int64     // The interval at which the package should be updated
+	serverChecksum     string    // the checksum of the server's package file
+	path               string    // the path to the local package including the .tar.gz extension
+	extractDir         string    // the directory to extract the package into
+	arguments          []string  // Any arguments that need to be passed to the package installer
+	env                []string  // Any environment variables that need to be set
+	hasSecrets         bool      // Whether arguments or env hold secrets, which are kept out of logs
+	runAsUser          string    // The user to run the package installer as
+	ticketStatus       string    // The status of the package in Tormon
+	ticketID           int       // The ID of the ticket in Tormon, if it exists
+	action             string    // The action to perform on the package
+	lastRunTime        time.Time // The last time the package was run
+	updated            bool      // Whether the package has been updated
+	updateInterval     int64     // The interval at which the package should be updated
+	timeout            int64     // How long the script may run in seconds. 0 uses appConfig.ScriptTimeout
+	uninstallOnRemoval bool      // Whether to run uninstall.sh once the package is removed from the config
+	forced             bool      // Run regardless of the last run time, e.g. for run-now --package
+	adhoc              bool      // A one-off run from `assimilator install`, not from the machine's config
+	status             string    // The result of the last script run (see the script status constants)
+	compliance         string    // What check.sh found on the last run (see the compliance constants), "" if there's no check.sh
+	changes            []string  // The parts of the step's fingerprint that changed since it last succeeded
+	startTime          time.Time // When the script was last started
+	exitCode           int       // The exit code of the last script run, -1 if it didn't exit on its own
+	duration           time.Duration
+}
+
+// Script statuses recorded for each package run
+const (
+	scriptStatusSuccess  = "success"
+	scriptStatusFailed   = "failed"
+	scriptStatusTimeout  = "timeout"
+	scriptStatusCanceled = "canceled"
+)
+
+// The optional script that checks whether a package needs to run
+const checkScript = "check"
+
+// Compliance results recorded for packages that have a check.sh
+const (
+	complianceCompliant  = "compliant"  // check.sh passed, so the action was skipped
+	complianceRemediated = "remediated" // check.sh failed and the action fixed it
+	complianceFailed     = "failed"     // check.sh failed and so did the action
+)
+
+var (
+	errScriptTimeout  = errors.New("script timed out")
+	errScriptCanceled = errors.New("script was canceled")
+)
+
+// How long a script's process group gets to exit after SIGTERM before it is sent SIGKILL
+var scriptKillGrace = 10 * time.Second
+
+// scriptStatus maps an error returned by ProcessPackage to a script status
+func scriptStatus(err error) string {
+	switch {
+	case err == nil:
+		return scriptStatusSuccess
+	case errors.Is(err, errScriptTimeout):
+		return scriptStatusTimeout
+	case errors.Is(err, errScriptCanceled):
+		return scriptStatusCanceled
+	default:
+		return scriptStatusFailed
+	}
 }
 
 // Calculates the SHA256 checksum of the package
@@ -68,41 +122,84 @@ func calculateChecksum(path string) (string, error) {
 }
 
 // A single, unified function handles the entire lifecycle
-func (p *packageInfo) ProcessPackage(a *AgentData) error {
+func (p *packageInfo) ProcessPackage(ctx context.Context, a *AgentData) error {
 
-	if err := p.ensurePackage(a); err != nil {
+	if err := p.ensurePackage(ctx, a); err != nil {
 		return err
 	}
 	Trace("Successfully ensured ", p.name)
 
-	if !appConfig.RunOnce {
-		p.checkLastRunTime()
-		Info(p.printTimeSinceLastRun())
-		// Check if no updates exist AND we are still within the cooldown window
-		Trace("p.lastRunTime: ", p.lastRunTime)
-		switch {
-		case p.updated:
-			Info("Updates exist for ", p.name, ". Running...")
-			// case p.lastRunTime.IsZero():
-			// Info("No last run time for ", p.name, ". Running...")
-		case time.Since(p.lastRunTime) < time.Duration(p.updateInterval)*time.Second:
-			Info("No updates for ", p.name, " and not enough time has passed since the last run. Skipping.")
-			return nil
-		}
+	switch p.runDecision(a.state) {
+	case planRunUpdated:
+		Info("Updates exist for ", p.name, ". Running...")
+	case planSkip:
+		Info("No updates for ", p.name, " and not enough time has passed since the last run. Skipping.")
+		return nil
 	}
 
 	if err := p.extractPackage(); err != nil {
 		return err
 	}
 	Trace("Successfully extracted ", p.name)
-	if err := p.executePackageScript(a); err != nil {
+
+	// An optional check.sh decides whether the machine has drifted from the package
+	p.compliance = ""
+	hasCheck := fileExists(filepath.Join(p.extractDir, checkScript+".sh"))
+	if hasCheck {
+		err := p.runScript(ctx, a, checkScript)
+		switch {
+		case err == nil:
+			Info(p.name, " is compliant. Skipping its ", p.action, " action.")
+			p.compliance = complianceCompliant
+			if stateErr := a.state.recordRun(p, scriptStatusSuccess, a.configRevision, a.offline); stateErr != nil {
+				Error("failed to record the run in the agent state: ", stateErr)
+			}
+			return nil
+		case errors.Is(err, errScriptCanceled):
+			return err
+		}
+		Info(p.name, " is not compliant (", scriptStatus(err), "). Running its ", p.action, " action...")
+	}
+
+	err := p.executePackageScript(ctx, a)
+	if hasCheck {
+		p.compliance = complianceRemediated
+		if err != nil {
+			p.compliance = complianceFailed
+		}
+	}
+	if stateErr := a.state.recordRun(p, scriptStatus(err), a.configRevision, a.offline); stateErr != nil {
+		Error("failed to record the run in the agent state: ", stateErr)
+	}
+	if err != nil {
 		return err
 	}
 	Trace("Successfully excuted script for", p.name)
 	return nil
 }
 
-func (p *packageInfo) ensurePackage(a *AgentData) error {
+// runDecision decides whether an ensured package needs to run, and why
+func (p *packageInfo) runDecision(state *AgentState) planDecision {
+	if appConfig.RunOnce || p.forced {
+		return planRunForced
+	}
+	p.checkLastRunTime(state)
+	Info(p.printTimeSinceLastRun())
+	// Check if no updates exist AND we are still within the cooldown window
+	Trace("p.lastRunTime: ", p.lastRunTime)
+	switch {
+	case p.updated:
+		return planRunUpdated
+	case len(p.changes) > 0:
+		Info(p.name, "'s ", p.action, " step changed since it last succeeded: ", strings.Join(p.changes, ", "))
+		return planRunUpdated
+	case time.Since(p.lastRunTime) < time.Duration(p.updateInterval)*time.Second:
+		return planSkip
+	}
+	return planRunInterval
+}
+
+func (p *packageInfo) ensurePackage(ctx context.Context, a *AgentData) error {
 	// 1. Check if the folder exists
 
 	Debug("Checking if package folder exists: ", p.cacheDir)
@@ -132,9 +229,14 @@ func (p *packageInfo) ensurePackage(a *AgentData) error {
 		Debug("Package ", p.name, " does not exist.")
 	}
 
+	// Offline, only the cached tarballs matching the last known config can be used
+	if a.offline {
+		return fmt.Errorf("package %s is not cached or does not match the last known config, and the server is unreachable", p.name)
+	}
+
 	// 3. If we are here, we either don't have it or it's old. Download it
 	Debug("Downloading package: ", p.name)
-	err := p.downloadPackage(a)
+	err := p.downloadPackage(ctx, a)
 	if err != nil {
 		a.failureReports[p.name] = fmt.Sprintf("error downloading %s package: %s", p.name, err)
 		return fmt.Errorf("error downloading %s package: %s", p.name, err)
@@ -144,40 +246,29 @@ func (p *packageInfo) ensurePackage(a *AgentData) error {
 	return nil
 }
 
-func (p *packageInfo) checkLastRunTime() {
+// checkLastRunTime looks up when the package step last succeeded, and which
+// parts of its fingerprint changed since then
+func (p *packageInfo) checkLastRunTime(state *AgentState) {
 	if appConfig.RunOnce {
 		Trace("RunOnce set. Not checking last run time.")
 		return
 	}
-	lastRunPath := filepath.Join(p.cacheDir, p.action+"_"+p.runAsUser+"_lastRunTime.txt")
-	Trace("lastRunPath: ", lastRunPath)
-	if !fileExists(lastRunPath) {
-		p.lastRunTime = time.Time{}
-		Debug("lastRunPath didnt exist")
-		return
-	}
-
-	content, err := os.ReadFile(lastRunPath)
-	if err != nil {
-		Error("error opening lastRunTime.txt: ", err)
-		p.lastRunTime = time.Time{}
-		return
-	}
-
-	cleanContent := strings.TrimSpace(string(content))
-	Trace("cleanContent: ", cleanContent)
-	// Parse the string as a base-10, 64-bit integer
-	epoch, err := strconv.ParseInt(cleanContent, 10, 64)
-	Trace("epoch: ", epoch)
-	if err != nil {
-		Error("error parsing lastRunTime.txt as Epoch int: ", err)
+	step := state.step(p.name, p.action, p.runAsUser)
+	if step == nil {
 		p.lastRunTime = time.Time{}
+		p.changes = nil
+		// The step may have run as another user before its runasuser changed
+		if previous := state.previousStep(p.name, p.action); previous != nil {
+			p.changes = state.fingerprint(p, previous.Applied).changes(previous.Applied)
+			Debug(p.name, "'s ", p.action, " action last ran as ", previous.RunAsUser, ", not ", p.runAsUser)
+			return
+		}
+		Debug("No recorded runs for ", p.name, "'s ", p.action, " action as ", p.runAsUser)
 		return
 	}
-
-	// Convert Unix seconds to Go's time.Time
-	p.lastRunTime = time.Unix(epoch, 0)
-	Trace("p.lastRunTime: ", p.lastRunTime)
+	p.lastRunTime = step.LastSuccessTime
+	p.changes = state.fingerprint(p, step.Applied).changes(step.Applied)
+	Trace("p.lastRunTime: ", p.lastRunTime, ", p.changes: ", p.changes)
 }
 
 // FormatLastRun Returns a human-readable relative time string.
@@ -252,7 +343,7 @@ func (p *packageInfo) printTimeSinceLastRun() string {
 	return fmt.Sprintf("Last run time for %s is %s (%d days ago)", p.name, p.lastRunTime.Format(time.RFC3339), days)
 }
 
-func (p *packageInfo) downloadPackage(a *AgentData) error {
+func (p *packageInfo) downloadPackage(ctx context.Context, a *AgentData) error {
 	// 1. Initiate the request
 	req := &pb.PackageRequest{
 		Name: p.name,
@@ -260,7 +351,7 @@ func (p *packageInfo) downloadPackage(a *AgentData) error {
 
 	// 2. Open the stream
 	Trace("Opening the stream")
-	stream, err := a.client.DownloadPackage(context.Background(), req)
+	stream, err := a.client.DownloadPackage(ctx, req)
 	if err != nil {
 		return fmt.Errorf("failed to start download stream: %w", err)
 	}
@@ -301,18 +392,22 @@ func (p *packageInfo) downloadPackage(a *AgentData) error {
 }
 
 func (p *packageInfo) extractPackage() error {
-	// 0. Shared base temp directory: /tmp/assimilator
-	baseTempPath := filepath.Join(os.TempDir(), "assimilator")
-	if err := os.MkdirAll(baseTempPath, 0777); err != nil {
-		return fmt.Errorf("failed to create base temp dir: %w", err)
-	}
-
-	if err := os.Chmod(baseTempPath, 01777); err != nil && appConfig.CurrentUser == "root" {
-		return fmt.Errorf("failed to set sticky bit on base temp dir: %w", err)
+	// 0. Shared base temp directory: /tmp/assimilator for root. Unprivileged
+	// agents extract into their cache dir so they never write outside $HOME.
+	baseTempPath := filepath.Join(appConfig.CacheDir, "extract")
+	if isRoot() {
+		baseTempPath = filepath.Join(os.TempDir(), "assimilator")
+		if err := os.MkdirAll(baseTempPath, 0777); err != nil {
+			return fmt.Errorf("failed to create base temp dir: %w", err)
+		}
+		if err := os.Chmod(baseTempPath, 01777); err != nil {
+			return fmt.Errorf("failed to set sticky bit on base temp dir: %w", err)
+		}
 	}
 
 	// 1. Target directory: /tmp/assimilator/<user>/<pkgName>
-	extractDir := filepath.Join(baseTempPath, appConfig.RunAsUser, p.name)
+	userTempPath := filepath.Join(baseTempPath, p.runAsUser)
+	extractDir := filepath.Join(userTempPath, p.name)
 
 	// Clean up any previous run to ensure a fresh slate
 	if err := os.RemoveAll(extractDir); err != nil {
@@ -340,19 +435,117 @@ func (p *packageInfo) extractPackage() error {
 	if string(output) != "" {
 		Trace(string(output))
 	}
+
+	// Scripts running as another user need to own what they run
+	if runAs, err := p.scriptUser(); err != nil {
+		return err
+	} else if runAs != nil {
+		if err := chownTree(userTempPath, runAs); err != nil {
+			return fmt.Errorf("failed to give %s the extracted package: %w", p.runAsUser, err)
+		}
+	}
 	p.extractDir = extractDir
 	return nil
 }
 
-func (p *packageInfo) executePackageScript(a *AgentData) error {
-	Trace("Executing install script for ", p.name)
+// scriptUser returns the user to switch to for running the package's scripts,
+// or nil if they run as the agent's own user. Only root can switch users.
+func (p *packageInfo) scriptUser() (*user.User, error) {
+	if p.runAsUser == "" || p.runAsUser == appConfig.CurrentUser || !p.adhoc {
+		return nil, nil
+	}
+	if !isRoot() {
+		return nil, fmt.Errorf("cannot run %s as %s: only root can run scripts as another user", p.name, p.runAsUser)
+	}
+	runAs, err := user.Lookup(p.runAsUser)
+	if err != nil {
+		return nil, fmt.Errorf("cannot run %s as %s: %w", p.name, p.runAsUser, err)
+	}
+	return runAs, nil
+}
+
+// chownTree gives owner everything under dir, dir included
+func chownTree(dir string, owner *user.User) error {
+	uid, err := strconv.Atoi(owner.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(owner.Gid)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// scriptTimeout returns how long the package's script may run
+func (p *packageInfo) scriptTimeout() time.Duration {
+	if p.timeout > 0 {
+		return time.Duration(p.timeout) * time.Second
+	}
+	return time.Duration(appConfig.ScriptTimeout) * time.Second
+}
+
+// userCredential returns the IDs a script needs to run as u
+func userCredential(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, groupID := range groupIDs {
+		if id, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
+
+// killProcessGroup sends SIGTERM to the script's whole process group, then
+// SIGKILL if anything is still alive after the grace period. The caller stops
+// the returned timer once the script has been waited for, since by then the
+// group's ID may have been reused.
+func killProcessGroup(pid int) (*time.Timer, error) {
+	killTimer := time.AfterFunc(scriptKillGrace, func() {
+		syscall.Kill(-pid, syscall.SIGKILL)
+	})
+	return killTimer, syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+// executePackageScript runs the script for the package's action
+func (p *packageInfo) executePackageScript(ctx context.Context, a *AgentData) error {
+	return p.runScript(ctx, a, p.action)
+}
+
+// runScript runs <script>.sh from the extracted package
+func (p *packageInfo) runScript(ctx context.Context, a *AgentData, script string) error {
+	Trace("Executing ", script, " script for ", p.name)
+	p.startTime = time.Now()
+	p.exitCode = -1
+	p.duration = 0
 	// 1. Ensure the script is executable
-	if err := os.Chmod(filepath.Join(p.extractDir, fmt.Sprintf("%s.sh", p.action)), 0755); err != nil {
+	if err := os.Chmod(filepath.Join(p.extractDir, fmt.Sprintf("%s.sh", script)), 0755); err != nil {
 		return fmt.Errorf("failed to make script executable: %w", err)
 	}
 	// 2. Run the install script
 	// Join the arguments array into a space-separated string (e.g. "--unattended --force")
-	Trace("Arguments: ", p.arguments)
+	if p.hasSecrets {
+		Trace("Arguments: hidden, since they hold secrets")
+	} else {
+		Trace("Arguments: ", p.arguments)
+	}
 	// If the package didnt specify a runAsUser, default to root, then look it up
 	if p.runAsUser == "" {
 		return fmt.Errorf("package %s did not specify a runAsUser. Exiting to expose error instead of applying bandaid", p.name)
@@ -361,13 +554,49 @@ func (p *packageInfo) executePackageScript(a *AgentData) error {
 	if err != nil {
 		return fmt.Errorf("user.Current() error: %v", err)
 	}
+	runAs, err := p.scriptUser()
+	if err != nil {
+		return err
+	}
 
-	commandToRun := p.extractDir + "/" + fmt.Sprintf("%s.sh", p.action)
-	cmd := exec.Command(commandToRun, p.arguments...)
+	timeout := p.scriptTimeout()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	commandToRun := p.extractDir + "/" + fmt.Sprintf("%s.sh", script)
+	cmd := exec.CommandContext(ctx, commandToRun, p.arguments...)
+	// Start the script in its own process group so a timeout or shutdown kills everything it spawned
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if runAs != nil {
+		credential, err := userCredential(runAs)
+		if err != nil {
+			return fmt.Errorf("cannot run %s as %s: %w", p.name, p.runAsUser, err)
+		}
+		cmd.SysProcAttr.Credential = credential
+		currentUser = runAs
+	}
+	// Set by cmd.Cancel, which returns before cmd.Run does
+	var killTimer *time.Timer
+	cmd.Cancel = func() error {
+		var err error
+		killTimer, err = killProcessGroup(cmd.Process.Pid)
+		return err
+	}
+	// Wait outlasts the grace period, so the group is killed before the timer is stopped
+	cmd.WaitDelay = 2 * scriptKillGrace
 	cmd.Dir = p.extractDir
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, p.env...)
+	// These come after the step's env so a package can't override them
 	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("ASSIMILATOR_PACKAGE=%s", p.name),
+		fmt.Sprintf("ASSIMILATOR_ACTION=%s", p.action),
+		fmt.Sprintf("ASSIMILATOR_MACHINE=%s", appConfig.Hostname),
+		fmt.Sprintf("ASSIMILATOR_CHECKSUM=%s", p.serverChecksum),
+		fmt.Sprintf("ASSIMILATOR_COMMIT=%s", a.configRevision),
 		fmt.Sprintf("USER=%s", currentUser.Username),
 		fmt.Sprintf("HOME=%s", currentUser.HomeDir),
 		fmt.Sprintf("ASSIMILATOR_HOME=%s", currentUser.HomeDir),
@@ -375,33 +604,44 @@ func (p *packageInfo) executePackageScript(a *AgentData) error {
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
 	)
 
-	Trace("Running script ", commandToRun, " as user: ", p.runAsUser)
-	output, err := cmd.CombinedOutput()
+	Trace("Running script ", commandToRun, " as user: ", p.runAsUser, " with a timeout of ", timeout)
+	// Stream stdout and stderr line by line into the logger and the run's log file
+	output := p.newScriptOutput(script)
+	stdout, stderr := output.stream("stdout"), output.stream("stderr")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	p.startTime = time.Now()
+	err = cmd.Run()
+	if killTimer != nil {
+		killTimer.Stop()
+	}
+	p.duration = time.Since(p.startTime)
+	stdout.Flush()
+	stderr.Flush()
+	if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
+		p.exitCode = cmd.ProcessState.ExitCode()
+	}
 
 	if err != nil {
-		a.failureReports[p.name] = string(output)
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			code := exitErr.ExitCode()
-			Info("\n", string(output))
-			return fmt.Errorf("Script failed with exit code: %v. Output: %v", code, string(output))
-		} else {
-			// The system couldn't even start the script
-			return fmt.Errorf("Failed to start script: %v\n", err)
+		a.failureReports[p.name] = output.String()
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			err = fmt.Errorf("%w after %s. Output: %v", errScriptTimeout, timeout, output.String())
+		case errors.Is(ctx.Err(), context.Canceled):
+			err = fmt.Errorf("%w by shutdown signal", errScriptCanceled)
+		default:
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				err = fmt.Errorf("Script failed with exit code: %v. Output: %v", exitErr.ExitCode(), output.String())
+			} else {
+				// The system couldn't even start the script
+				err = fmt.Errorf("Failed to start script: %v\n", err)
+			}
 		}
 	}
-	Trace("Script ", commandToRun, " ran successfully!")
-
-	// 3. Update the last run time on disk
-	if err := os.MkdirAll(p.cacheDir, 0755); err != nil {
-		return nil
-	}
-
-	lastRunPath := filepath.Join(p.cacheDir, p.action+"_"+p.runAsUser+"_lastRunTime.txt")
-	Trace("lastRunPath: ", lastRunPath)
-	epochStr := fmt.Sprintf("%d", time.Now().Unix())
-	if err := os.WriteFile(lastRunPath, []byte(epochStr), 0644); err != nil {
-		return fmt.Errorf("failed to write lastRunTime.txt: %w", err)
+	output.Close(scriptStatus(err), p.duration)
+	if err != nil {
+		return err
 	}
-
+	Trace("Script ", commandToRun, " ran successfully!")
 	return nil
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+// newTestScript returns a package whose install.sh is script, ready for runScript
+func newTestScript(t *testing.T, script string) (*packageInfo, *AgentData) {
+	t.Helper()
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	extractDir := filepath.Join(dir, "extract")
+	if err := os.MkdirAll(extractDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(extractDir, "install.sh"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := &packageInfo{
+		name:       "vim",
+		action:     "install",
+		runAsUser:  currentUser.Username,
+		cacheDir:   filepath.Join(dir, "cache"),
+		extractDir: extractDir,
+	}
+	return p, &AgentData{failureReports: make(map[string]string)}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	defer func(timeout int64) { appConfig.ScriptTimeout = timeout }(appConfig.ScriptTimeout)
+	appConfig.ScriptTimeout = 600
+
+	testCases := []struct {
+		name     string
+		timeout  int64
+		expected time.Duration
+	}{
+		{name: "Agent default", timeout: 0, expected: 600 * time.Second},
+		{name: "Step timeout", timeout: 30, expected: 30 * time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &packageInfo{timeout: tc.timeout}
+			if got := p.scriptTimeout(); got != tc.expected {
+				t.Errorf("Expected %s, but got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	defer func(grace time.Duration) { scriptKillGrace = grace }(scriptKillGrace)
+	scriptKillGrace = 200 * time.Millisecond
+
+	testCases := []struct {
+		name    string
+		script  string
+		timeout int64
+		cancel  bool // Cancel the context as if the agent were shutting down
+
+		expectedErr      error // Matched with errors.Is
+		expectErr        bool
+		expectedExitCode int
+		maxDuration      time.Duration
+	}{
+		{
+			name:             "Success",
+			script:           "exit 0",
+			expectedExitCode: 0,
+			maxDuration:      5 * time.Second,
+		},
+		{
+			name:             "Failure",
+			script:           "exit 3",
+			expectErr:        true,
+			expectedExitCode: 3,
+			maxDuration:      5 * time.Second,
+		},
+		{
+			name:             "Timeout",
+			script:           "sleep 30",
+			timeout:          1,
+			expectedErr:      errScriptTimeout,
+			expectedExitCode: -1,
+			maxDuration:      5 * time.Second,
+		},
+		{
+			// Both the shell and sleep ignore SIGTERM, so only the SIGKILL after the grace period stops them
+			name:             "Timeout ignoring SIGTERM",
+			script:           "trap '' TERM\nsleep 30 &\necho $! > sleep.pid\nwait",
+			timeout:          1,
+			expectedErr:      errScriptTimeout,
+			expectedExitCode: -1,
+			maxDuration:      5 * time.Second,
+		},
+		{
+			name:             "Shutdown",
+			script:           "sleep 30",
+			cancel:           true,
+			expectedErr:      errScriptCanceled,
+			expectedExitCode: -1,
+			maxDuration:      5 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			p, a := newTestScript(t, tc.script)
+			p.timeout = tc.timeout
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				time.AfterFunc(500*time.Millisecond, cancel)
+			}
+
+			// --- Act ---
+			start := time.Now()
+			err := p.runScript(ctx, a, "install")
+
+			// --- Assert ---
+			if elapsed := time.Since(start); elapsed > tc.maxDuration {
+				t.Errorf("Expected the script to finish within %s, but it took %s", tc.maxDuration, elapsed)
+			}
+			switch {
+			case tc.expectedErr != nil && !errors.Is(err, tc.expectedErr):
+				t.Errorf("Expected %v, but got: %v", tc.expectedErr, err)
+			case tc.expectErr && err == nil:
+				t.Errorf("Expected an error, but got nil")
+			case tc.expectedErr == nil && !tc.expectErr && err != nil:
+				t.Errorf("Did not expect error, but got: %v", err)
+			}
+			if p.exitCode != tc.expectedExitCode {
+				t.Errorf("Expected exit code %d, but got %d", tc.expectedExitCode, p.exitCode)
+			}
+			// Nothing the script started may outlive it
+			if pid, err := os.ReadFile(filepath.Join(p.extractDir, "sleep.pid")); err == nil {
+				if stat, err := os.ReadFile("/proc/" + strings.TrimSpace(string(pid)) + "/stat"); err == nil && !strings.Contains(string(stat), ") Z ") {
+					t.Errorf("Expected the script's children to be killed, but %s is still running", strings.TrimSpace(string(pid)))
+				}
+			}
+		})
+	}
+}
+
+func TestProcessPackageCheckScript(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(cacheDir string) { appConfig.CacheDir = cacheDir }(appConfig.CacheDir)
+
+	testCases := []struct {
+		name    string
+		scripts map[string]string
+
+		expectErr          bool
+		expectActionRan    bool
+		expectedStatus     string
+		expectedCompliance string
+	}{
+		{
+			name:            "No check.sh",
+			scripts:         map[string]string{"install.sh": "echo install >> $MARKER"},
+			expectActionRan: true,
+			expectedStatus:  scriptStatusSuccess,
+		},
+		{
+			name:               "Compliant",
+			scripts:            map[string]string{"check.sh": "exit 0", "install.sh": "echo install >> $MARKER"},
+			expectedStatus:     scriptStatusSuccess,
+			expectedCompliance: complianceCompliant,
+		},
+		{
+			name:               "Drifted and remediated",
+			scripts:            map[string]string{"check.sh": "exit 1", "install.sh": "echo install >> $MARKER"},
+			expectActionRan:    true,
+			expectedStatus:     scriptStatusSuccess,
+			expectedCompliance: complianceRemediated,
+		},
+		{
+			name:               "Drifted and the action failed",
+			scripts:            map[string]string{"check.sh": "exit 1", "install.sh": "echo install >> $MARKER; exit 2"},
+			expectErr:          true,
+			expectActionRan:    true,
+			expectedStatus:     scriptStatusFailed,
+			expectedCompliance: complianceFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			appConfig.CacheDir = t.TempDir()
+			marker := filepath.Join(t.TempDir(), "ran")
+			packageName := "check-test"
+			tarballPath := filepath.Join(appConfig.CacheDir, packageName, packageName+".tar.gz")
+			writeTestTarball(t, tarballPath, tc.scripts)
+			checksum, _ := calculateChecksum(tarballPath)
+			t.Cleanup(func() { os.RemoveAll(filepath.Join(os.TempDir(), "assimilator", currentUser.Username, packageName)) })
+			p := &packageInfo{
+				name:           packageName,
+				action:         "install",
+				runAsUser:      currentUser.Username,
+				cacheDir:       filepath.Dir(tarballPath),
+				path:           tarballPath,
+				serverChecksum: checksum,
+				env:            []string{"MARKER=" + marker},
+			}
+			a := &AgentData{state: newTestState(), failureReports: make(map[string]string)}
+
+			// --- Act ---
+			err := p.ProcessPackage(context.Background(), a)
+
+			// --- Assert ---
+			if (err != nil) != tc.expectErr {
+				t.Errorf("Expected an error: %v, but got: %v", tc.expectErr, err)
+			}
+			ran, _ := os.ReadFile(marker)
+			if strings.Contains(string(ran), "install") != tc.expectActionRan {
+				t.Errorf("Expected the action to run: %v", tc.expectActionRan)
+			}
+			step := a.state.step(packageName, "install", currentUser.Username)
+			if step == nil {
+				t.Fatalf("Expected the run to be recorded")
+			}
+			if step.Status != tc.expectedStatus || step.Compliance != tc.expectedCompliance {
+				t.Errorf("Expected status %q and compliance %q, but got %q and %q", tc.expectedStatus, tc.expectedCompliance, step.Status, step.Compliance)
+			}
+		})
+	}
+}
+
+func TestStepEnv(t *testing.T) {
+	if env := stepEnv(nil); len(env) != 0 {
+		t.Errorf("Expected no env, but got %v", env)
+	}
+	expected := []string{"A=1", "B=x=y", "EMPTY="}
+	if env := stepEnv(map[string]string{"B": "x=y", "EMPTY": "", "A": "1"}); !slices.Equal(env, expected) {
+		t.Errorf("Expected %v, but got %v", expected, env)
+	}
+	p := convertToPackageInfo("vim", &pb.PackageSteps{Action: "install", Runasuser: "root", Env: map[string]string{"EDITOR": "vim"}}, "abc")
+	if !slices.Equal(p.env, []string{"EDITOR=vim"}) {
+		t.Errorf("Expected the step's env, but got %v", p.env)
+	}
+}
+
+func TestScriptEnv(t *testing.T) {
+	defer func(hostname string) { appConfig.Hostname = hostname }(appConfig.Hostname)
+	appConfig.Hostname = "web01"
+	p, a := newTestScript(t, `env > "$ENV_FILE"`)
+	envFile := filepath.Join(t.TempDir(), "env")
+	p.serverChecksum = "abc"
+	// The step can set its own variables, but not the standard ones
+	p.env = []string{"ENV_FILE=" + envFile, "EDITOR=vim", "ASSIMILATOR_PACKAGE=spoofed"}
+	a.configRevision = "rev1"
+
+	if err := p.runScript(context.Background(), a, "install"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, expected := range []string{
+		"EDITOR=vim",
+		"ASSIMILATOR_PACKAGE=vim",
+		"ASSIMILATOR_ACTION=install",
+		"ASSIMILATOR_MACHINE=web01",
+		"ASSIMILATOR_CHECKSUM=abc",
+		"ASSIMILATOR_COMMIT=rev1",
+	} {
+		if !slices.Contains(env, expected) {
+			t.Errorf("Expected %s in the script's environment", expected)
+		}
+	}
+	if slices.Contains(env, "ASSIMILATOR_PACKAGE=spoofed") {
+		t.Errorf("Expected the standard variables to win over the step's env")
+	}
+}
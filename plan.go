@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// planDecision is what the agent would do with a package once it is cached
+type planDecision string
+
+const (
+	planRunUpdated  planDecision = "run-updated"  // the package changed since it was last cached
+	planRunInterval planDecision = "run-interval" // the package update interval has elapsed
+	planRunForced   planDecision = "run-forced"   // runonce ignores the last run time
+	planSkip        planDecision = "skip"         // nothing changed and the interval has not elapsed
+	planNotApplied  planDecision = "not-applied"  // the step's when: condition is false for this machine
+)
+
+// planEntry describes what would happen to a single package step
+type planEntry struct {
+	Package        string       `json:"package"`
+	Action         string       `json:"action"`
+	RunAsUser      string       `json:"runasuser"`
+	Download       bool         `json:"download"`
+	Decision       planDecision `json:"decision"`
+	Reason         string       `json:"reason"`
+	LocalChecksum  string       `json:"local_checksum,omitempty"`
+	ServerChecksum string       `json:"server_checksum"`
+	LastRunTime    *time.Time   `json:"last_run_time,omitempty"`
+	Changed        []string     `json:"changed,omitempty"` // The parts of the step's fingerprint that changed since it last succeeded
+}
+
+// plan works out what ProcessPackage would do without downloading or running anything
+func (p *packageInfo) plan(state *AgentState) planEntry {
+	entry := planEntry{
+		Package:        p.name,
+		Action:         p.action,
+		RunAsUser:      p.runAsUser,
+		ServerChecksum: p.serverChecksum,
+	}
+
+	// 1. Compare the cached tarball with the server's
+	switch {
+	case !fileExists(p.path):
+		entry.Download = true
+		entry.Reason = "package is not cached"
+	default:
+		checksum, err := calculateChecksum(p.path)
+		if err != nil {
+			entry.Download = true
+			entry.Reason = fmt.Sprintf("cached package is unreadable: %s", err)
+			break
+		}
+		entry.LocalChecksum = checksum
+		if checksum != p.serverChecksum {
+			entry.Download = true
+			entry.Reason = "cached checksum differs from the server"
+		}
+	}
+	// A download always means the package counts as updated
+	p.updated = entry.Download
+
+	// 2. Compare the last run time with the update interval
+	entry.Decision = p.runDecision(state)
+	if !p.lastRunTime.IsZero() {
+		lastRunTime := p.lastRunTime
+		entry.LastRunTime = &lastRunTime
+	}
+	entry.Changed = p.changes
+	switch entry.Decision {
+	case planRunUpdated:
+		if len(p.changes) > 0 {
+			changed := "step changed: " + strings.Join(p.changes, ", ")
+			if entry.Reason != "" {
+				changed = entry.Reason + "; " + changed
+			}
+			entry.Reason = changed
+		}
+	case planRunForced:
+		entry.Reason = "runonce is set"
+	case planRunInterval:
+		if p.lastRunTime.IsZero() {
+			entry.Reason = "package has never run"
+		} else {
+			entry.Reason = fmt.Sprintf("update interval of %ds has elapsed", p.updateInterval)
+		}
+	case planSkip:
+		entry.Reason = "no updates and the update interval has not elapsed"
+	}
+	return entry
+}
+
+// planCheck fetches the config and plans every package without executing any script
+func (a *AgentData) planCheck(ctx context.Context) ([]planEntry, error) {
+	Info("Starting assimilation plan...")
+	conn, err := a.connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start NewClient: %w", err)
+	}
+	defer conn.Close()
+
+	machineConfig, err := a.getPackageInfoFromServer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package info from server: %w", err)
+	}
+
+	filteredNames, filteredPackages := PackagesForUser(machineConfig)
+	entries := make([]planEntry, 0, len(filteredNames))
+	for _, packageName := range filteredNames {
+		entries = append(entries, filteredPackages[packageName].plan(a.state))
+	}
+	for _, step := range a.skippedSteps {
+		entries = append(entries, planEntry{
+			Package:  step.GetPackage(),
+			Action:   step.GetAction(),
+			Decision: planNotApplied,
+			Reason:   step.GetReason(),
+		})
+	}
+	Info("Completed assimilation plan.")
+	return entries, nil
+}
+
+// printPlan writes the plan in the requested format ("text" or "json")
+func printPlan(w io.Writer, entries []planEntry, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "", "text":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "PACKAGE\tACTION\tUSER\tPLAN\tREASON")
+		for _, entry := range entries {
+			plan := string(entry.Decision)
+			if entry.Download {
+				plan = "download, " + plan
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entry.Package, entry.Action, entry.RunAsUser, plan, entry.Reason)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown plan format: %s", format)
+	}
+}
+
+// AgentPlan prints what the agent would do on its next check and exits
+func AgentPlan() {
+	agentData = &AgentData{
+		appConfig: &appConfig,
+	}
+
+	// Only read the state; planning must not change anything on disk
+	state, err := loadAgentState(appConfig.StateDir, appConfig.CacheDir, true)
+	if err != nil {
+		Fatal(1, "error loading agent state: ", err)
+	}
+	agentData.state = state
+
+	entries, err := agentData.planCheck(context.Background())
+	if err != nil {
+		Fatal(1, err)
+	}
+	if err := printPlan(os.Stdout, entries, appConfig.PlanFormat); err != nil {
+		Fatal(1, "error printing plan: ", err)
+	}
+}
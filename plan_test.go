@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPackagePlan(t *testing.T) {
+	cacheDir := t.TempDir()
+	cachedPath := filepath.Join(cacheDir, "vim.tar.gz")
+	if err := os.WriteFile(cachedPath, []byte("tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cachedChecksum, err := calculateChecksum(cachedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name           string
+		path           string
+		serverChecksum string
+		lastRun        time.Duration // How long ago the step last succeeded, 0 if never
+		runOnce        bool
+
+		expectedDecision planDecision
+		expectedDownload bool
+		expectedReason   string
+	}{
+		{
+			name:             "Not cached",
+			path:             filepath.Join(cacheDir, "missing.tar.gz"),
+			serverChecksum:   cachedChecksum,
+			expectedDecision: planRunUpdated,
+			expectedDownload: true,
+			expectedReason:   "package is not cached",
+		},
+		{
+			name:             "Cached checksum differs",
+			path:             cachedPath,
+			serverChecksum:   "other",
+			expectedDecision: planRunUpdated,
+			expectedDownload: true,
+			expectedReason:   "cached checksum differs from the server",
+		},
+		{
+			name:             "Never run",
+			path:             cachedPath,
+			serverChecksum:   cachedChecksum,
+			expectedDecision: planRunInterval,
+			expectedReason:   "package has never run",
+		},
+		{
+			name:             "Ran recently",
+			path:             cachedPath,
+			serverChecksum:   cachedChecksum,
+			lastRun:          time.Minute,
+			expectedDecision: planSkip,
+			expectedReason:   "no updates and the update interval has not elapsed",
+		},
+		{
+			name:             "Interval elapsed",
+			path:             cachedPath,
+			serverChecksum:   cachedChecksum,
+			lastRun:          2 * time.Hour,
+			expectedDecision: planRunInterval,
+			expectedReason:   "update interval of 3600s has elapsed",
+		},
+		{
+			name:             "Runonce",
+			path:             cachedPath,
+			serverChecksum:   cachedChecksum,
+			lastRun:          time.Minute,
+			runOnce:          true,
+			expectedDecision: planRunForced,
+			expectedReason:   "runonce is set",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			appConfig.RunOnce = tc.runOnce
+			defer func() { appConfig.RunOnce = false }()
+			p := &packageInfo{
+				name:           "vim",
+				action:         "install",
+				runAsUser:      "root",
+				path:           tc.path,
+				serverChecksum: tc.serverChecksum,
+				updateInterval: 3600,
+			}
+			state := newTestState()
+			if tc.lastRun > 0 {
+				p.startTime = time.Now().Add(-tc.lastRun)
+				state.recordRun(p, scriptStatusSuccess, "", false)
+			}
+
+			// --- Act ---
+			entry := p.plan(state)
+
+			// --- Assert ---
+			if entry.Decision != tc.expectedDecision {
+				t.Errorf("Expected decision %q, but got %q", tc.expectedDecision, entry.Decision)
+			}
+			if entry.Download != tc.expectedDownload {
+				t.Errorf("Expected download %v, but got %v", tc.expectedDownload, entry.Download)
+			}
+			if entry.Reason != tc.expectedReason {
+				t.Errorf("Expected reason %q, but got %q", tc.expectedReason, entry.Reason)
+			}
+		})
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	entries := []planEntry{
+		{Package: "vim", Action: "install", RunAsUser: "root", Download: true, Decision: planRunUpdated, Reason: "package is not cached"},
+	}
+
+	testCases := []struct {
+		name      string
+		format    string
+		expected  string
+		expectErr bool
+	}{
+		{name: "Text", format: "text", expected: "vim      install  root  download, run-updated  package is not cached"},
+		{name: "Default is text", format: "", expected: "PACKAGE  ACTION"},
+		{name: "JSON", format: "json", expected: `"decision": "run-updated"`},
+		{name: "Unknown format", format: "xml", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := printPlan(&out, entries, tc.format)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if !strings.Contains(out.String(), tc.expected) {
+				t.Errorf("Expected the output to contain %q, but got:\n%s", tc.expected, out.String())
+			}
+			if tc.format == "json" {
+				var decoded []planEntry
+				if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != 1 {
+					t.Errorf("Expected one JSON entry, but got %v (%v)", decoded, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// nextCheckDelay decides how long the agent waits before its next check.
+// Normally that's the check interval (the server's if it sent one) plus a
+// random splay, so a fleet doesn't check in at the same moment. While the
+// server is unreachable the delay backs off exponentially with jitter.
+func (a *AgentData) nextCheckDelay(checkErr error) time.Duration {
+	interval := time.Duration(appConfig.UpdateCheckInterval) * time.Second
+	if a.serverPollInterval > 0 {
+		interval = a.serverPollInterval
+	}
+	interval = max(interval, time.Second)
+
+	if checkErr != nil && isServerUnreachable(checkErr) {
+		a.failedChecks++
+		maxBackoff := max(time.Duration(appConfig.MaxCheckBackoff)*time.Second, interval)
+		backoff := maxBackoff
+		// Stop doubling well before the duration could overflow
+		if a.failedChecks < 30 && interval<<a.failedChecks < maxBackoff {
+			backoff = interval << a.failedChecks
+		}
+		delay := jitter(backoff)
+		Info("Server unreachable ", a.failedChecks, " time(s) in a row. Backing off for ", delay.Round(time.Second), " before next check.")
+		return delay
+	}
+
+	a.failedChecks = 0
+	delay := interval + splay(time.Duration(appConfig.UpdateCheckSplay)*time.Second)
+	Info("Waiting ", delay.Round(time.Second), " before next check.")
+	return delay
+}
+
+// splay returns a random duration between 0 and maxSplay
+func splay(maxSplay time.Duration) time.Duration {
+	if maxSplay <= 0 {
+		return 0
+	}
+	return rand.N(maxSplay + 1)
+}
+
+// jitter returns a random duration between half of d and d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + splay(d/2)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNextCheckDelay(t *testing.T) {
+	defer func(interval, splay, maxBackoff int64) {
+		appConfig.UpdateCheckInterval, appConfig.UpdateCheckSplay, appConfig.MaxCheckBackoff = interval, splay, maxBackoff
+	}(appConfig.UpdateCheckInterval, appConfig.UpdateCheckSplay, appConfig.MaxCheckBackoff)
+	appConfig.UpdateCheckInterval = 60
+	appConfig.UpdateCheckSplay = 10
+	appConfig.MaxCheckBackoff = 600
+	unreachable := status.Error(codes.Unavailable, "connection refused")
+
+	testCases := []struct {
+		name               string
+		serverPollInterval time.Duration
+		failedChecks       int
+		checkErr           error
+
+		expectedMin          time.Duration
+		expectedMax          time.Duration
+		expectedFailedChecks int
+	}{
+		{name: "Agent interval plus splay", expectedMin: 60 * time.Second, expectedMax: 70 * time.Second},
+		{name: "Server interval", serverPollInterval: 300 * time.Second, expectedMin: 300 * time.Second, expectedMax: 310 * time.Second},
+		{name: "Other errors don't back off", checkErr: errors.New("script failed"), failedChecks: 3, expectedMin: 60 * time.Second, expectedMax: 70 * time.Second},
+		{name: "First failure doubles", checkErr: unreachable, expectedMin: 60 * time.Second, expectedMax: 120 * time.Second, expectedFailedChecks: 1},
+		{name: "Third failure", checkErr: unreachable, failedChecks: 2, expectedMin: 240 * time.Second, expectedMax: 480 * time.Second, expectedFailedChecks: 3},
+		{name: "Capped", checkErr: unreachable, failedChecks: 10, expectedMin: 300 * time.Second, expectedMax: 600 * time.Second, expectedFailedChecks: 11},
+		{name: "Never overflows", checkErr: unreachable, failedChecks: 100, expectedMin: 300 * time.Second, expectedMax: 600 * time.Second, expectedFailedChecks: 101},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for range 20 {
+				a := &AgentData{serverPollInterval: tc.serverPollInterval, failedChecks: tc.failedChecks}
+				delay := a.nextCheckDelay(tc.checkErr)
+				if delay < tc.expectedMin || delay > tc.expectedMax {
+					t.Fatalf("Expected a delay between %s and %s, but got %s", tc.expectedMin, tc.expectedMax, delay)
+				}
+				if a.failedChecks != tc.expectedFailedChecks {
+					t.Fatalf("Expected %d failed checks, but got %d", tc.expectedFailedChecks, a.failedChecks)
+				}
+			}
+		})
+	}
+}
+
+func TestSplay(t *testing.T) {
+	if got := splay(0); got != 0 {
+		t.Errorf("Expected no splay, but got %s", got)
+	}
+	for range 100 {
+		if got := splay(time.Second); got < 0 || got > time.Second {
+			t.Fatalf("Expected a splay up to 1s, but got %s", got)
+		}
+		if got := jitter(time.Second); got < time.Second/2 || got > time.Second {
+			t.Fatalf("Expected a jitter between 0.5s and 1s, but got %s", got)
+		}
+	}
+}
@@ -110,8 +110,10 @@ func (x *GetAllConfigsResponse) GetAppconfig() map[string]*AppConfig {
 }
 
 type GetSpecificConfigRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	MachineName   string                 `protobuf:"bytes,1,opt,name=MachineName,proto3" json:"MachineName,omitempty"`
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	MachineName string                 `protobuf:"bytes,1,opt,name=MachineName,proto3" json:"MachineName,omitempty"`
+	// What the agent knows about its machine, used to target configs
+	Facts         *Facts `protobuf:"bytes,2,opt,name=facts,proto3" json:"facts,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -153,6 +155,161 @@ func (x *GetSpecificConfigRequest) GetMachineName() string {
 	return ""
 }
 
+func (x *GetSpecificConfigRequest) GetFacts() *Facts {
+	if x != nil {
+		return x.Facts
+	}
+	return nil
+}
+
+type Facts struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Hostname       string                 `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Distro         string                 `protobuf:"bytes,2,opt,name=distro,proto3" json:"distro,omitempty"`                                    // ID from /etc/os-release
+	DistroVersion  string                 `protobuf:"bytes,3,opt,name=distro_version,json=distroVersion,proto3" json:"distro_version,omitempty"` // VERSION_ID from /etc/os-release
+	DistroLike     []string               `protobuf:"bytes,4,rep,name=distro_like,json=distroLike,proto3" json:"distro_like,omitempty"`          // ID_LIKE from /etc/os-release
+	Kernel         string                 `protobuf:"bytes,5,opt,name=kernel,proto3" json:"kernel,omitempty"`
+	Arch           string                 `protobuf:"bytes,6,opt,name=arch,proto3" json:"arch,omitempty"` // GOARCH, e.g. amd64 or arm64
+	CpuCount       int32                  `protobuf:"varint,7,opt,name=cpu_count,json=cpuCount,proto3" json:"cpu_count,omitempty"`
+	CpuModel       string                 `protobuf:"bytes,8,opt,name=cpu_model,json=cpuModel,proto3" json:"cpu_model,omitempty"`
+	MemoryBytes    uint64                 `protobuf:"varint,9,opt,name=memory_bytes,json=memoryBytes,proto3" json:"memory_bytes,omitempty"`
+	IpAddresses    []string               `protobuf:"bytes,10,rep,name=ip_addresses,json=ipAddresses,proto3" json:"ip_addresses,omitempty"`
+	MachineId      string                 `protobuf:"bytes,11,opt,name=machine_id,json=machineId,proto3" json:"machine_id,omitempty"`
+	IsVm           bool                   `protobuf:"varint,12,opt,name=is_vm,json=isVm,proto3" json:"is_vm,omitempty"`
+	IsContainer    bool                   `protobuf:"varint,13,opt,name=is_container,json=isContainer,proto3" json:"is_container,omitempty"`
+	Virtualization string                 `protobuf:"bytes,14,opt,name=virtualization,proto3" json:"virtualization,omitempty"` // the hypervisor or container runtime
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *Facts) Reset() {
+	*x = Facts{}
+	mi := &file_assctl_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Facts) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Facts) ProtoMessage() {}
+
+func (x *Facts) ProtoReflect() protoreflect.Message {
+	mi := &file_assctl_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Facts.ProtoReflect.Descriptor instead.
+func (*Facts) Descriptor() ([]byte, []int) {
+	return file_assctl_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Facts) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Facts) GetDistro() string {
+	if x != nil {
+		return x.Distro
+	}
+	return ""
+}
+
+func (x *Facts) GetDistroVersion() string {
+	if x != nil {
+		return x.DistroVersion
+	}
+	return ""
+}
+
+func (x *Facts) GetDistroLike() []string {
+	if x != nil {
+		return x.DistroLike
+	}
+	return nil
+}
+
+func (x *Facts) GetKernel() string {
+	if x != nil {
+		return x.Kernel
+	}
+	return ""
+}
+
+func (x *Facts) GetArch() string {
+	if x != nil {
+		return x.Arch
+	}
+	return ""
+}
+
+func (x *Facts) GetCpuCount() int32 {
+	if x != nil {
+		return x.CpuCount
+	}
+	return 0
+}
+
+func (x *Facts) GetCpuModel() string {
+	if x != nil {
+		return x.CpuModel
+	}
+	return ""
+}
+
+func (x *Facts) GetMemoryBytes() uint64 {
+	if x != nil {
+		return x.MemoryBytes
+	}
+	return 0
+}
+
+func (x *Facts) GetIpAddresses() []string {
+	if x != nil {
+		return x.IpAddresses
+	}
+	return nil
+}
+
+func (x *Facts) GetMachineId() string {
+	if x != nil {
+		return x.MachineId
+	}
+	return ""
+}
+
+func (x *Facts) GetIsVm() bool {
+	if x != nil {
+		return x.IsVm
+	}
+	return false
+}
+
+func (x *Facts) GetIsContainer() bool {
+	if x != nil {
+		return x.IsContainer
+	}
+	return false
+}
+
+func (x *Facts) GetVirtualization() string {
+	if x != nil {
+		return x.Virtualization
+	}
+	return ""
+}
+
 type GetSpecificConfigResponse struct {
 	state   protoimpl.MessageState `protogen:"open.v1"`
 	Version *ServerVersion         `protobuf:"bytes,1,opt,name=Version,proto3" json:"Version,omitempty"`
@@ -162,13 +319,22 @@ type GetSpecificConfigResponse struct {
 	Packages        map[string]*PackageConfig `protobuf:"bytes,5,rep,name=packages,proto3" json:"packages,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 	ConfigOverrides *AppConfig                `protobuf:"bytes,6,opt,name=config_overrides,json=configOverrides,proto3" json:"config_overrides,omitempty"`
 	AppliedConfig   string                    `protobuf:"bytes,7,opt,name=applied_config,json=appliedConfig,proto3" json:"applied_config,omitempty"`
-	unknownFields   protoimpl.UnknownFields
-	sizeCache       protoimpl.SizeCache
+	// The commit of the config repository the server is serving
+	ConfigRevision string `protobuf:"bytes,8,opt,name=config_revision,json=configRevision,proto3" json:"config_revision,omitempty"`
+	// How many seconds the agent should wait before its next check. 0 lets the agent decide
+	NextPollInterval int64 `protobuf:"varint,9,opt,name=next_poll_interval,json=nextPollInterval,proto3" json:"next_poll_interval,omitempty"`
+	// The most packages the agent may uninstall in one check because they were removed from its config.
+	// Unset by servers that predate it, in which case the agent uses its own default
+	MaxRemovals *int32 `protobuf:"varint,10,opt,name=max_removals,json=maxRemovals,proto3,oneof" json:"max_removals,omitempty"`
+	// The steps left out of packages because their when: condition is false for this machine
+	SkippedSteps  []*SkippedStep `protobuf:"bytes,11,rep,name=skipped_steps,json=skippedSteps,proto3" json:"skipped_steps,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *GetSpecificConfigResponse) Reset() {
 	*x = GetSpecificConfigResponse{}
-	mi := &file_assctl_proto_msgTypes[3]
+	mi := &file_assctl_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -180,7 +346,7 @@ func (x *GetSpecificConfigResponse) String() string {
 func (*GetSpecificConfigResponse) ProtoMessage() {}
 
 func (x *GetSpecificConfigResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[3]
+	mi := &file_assctl_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -193,7 +359,7 @@ func (x *GetSpecificConfigResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use GetSpecificConfigResponse.ProtoReflect.Descriptor instead.
 func (*GetSpecificConfigResponse) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{3}
+	return file_assctl_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *GetSpecificConfigResponse) GetVersion() *ServerVersion {
@@ -231,6 +397,95 @@ func (x *GetSpecificConfigResponse) GetAppliedConfig() string {
 	return ""
 }
 
+func (x *GetSpecificConfigResponse) GetConfigRevision() string {
+	if x != nil {
+		return x.ConfigRevision
+	}
+	return ""
+}
+
+func (x *GetSpecificConfigResponse) GetNextPollInterval() int64 {
+	if x != nil {
+		return x.NextPollInterval
+	}
+	return 0
+}
+
+func (x *GetSpecificConfigResponse) GetMaxRemovals() int32 {
+	if x != nil && x.MaxRemovals != nil {
+		return *x.MaxRemovals
+	}
+	return 0
+}
+
+func (x *GetSpecificConfigResponse) GetSkippedSteps() []*SkippedStep {
+	if x != nil {
+		return x.SkippedSteps
+	}
+	return nil
+}
+
+type SkippedStep struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Package string                 `protobuf:"bytes,1,opt,name=package,proto3" json:"package,omitempty"`
+	Action  string                 `protobuf:"bytes,2,opt,name=action,proto3" json:"action,omitempty"`
+	// Why the step doesn't apply, e.g. the fact values that made its condition false
+	Reason        string `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SkippedStep) Reset() {
+	*x = SkippedStep{}
+	mi := &file_assctl_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SkippedStep) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SkippedStep) ProtoMessage() {}
+
+func (x *SkippedStep) ProtoReflect() protoreflect.Message {
+	mi := &file_assctl_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SkippedStep.ProtoReflect.Descriptor instead.
+func (*SkippedStep) Descriptor() ([]byte, []int) {
+	return file_assctl_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SkippedStep) GetPackage() string {
+	if x != nil {
+		return x.Package
+	}
+	return ""
+}
+
+func (x *SkippedStep) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
+func (x *SkippedStep) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
 type PackageRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Name          string                 `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"` // string Category = 2;
@@ -240,7 +495,7 @@ type PackageRequest struct {
 
 func (x *PackageRequest) Reset() {
 	*x = PackageRequest{}
-	mi := &file_assctl_proto_msgTypes[4]
+	mi := &file_assctl_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -252,7 +507,7 @@ func (x *PackageRequest) String() string {
 func (*PackageRequest) ProtoMessage() {}
 
 func (x *PackageRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[4]
+	mi := &file_assctl_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -265,7 +520,7 @@ func (x *PackageRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use PackageRequest.ProtoReflect.Descriptor instead.
 func (*PackageRequest) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{4}
+	return file_assctl_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *PackageRequest) GetName() string {
@@ -290,7 +545,7 @@ type PackageResponse struct {
 
 func (x *PackageResponse) Reset() {
 	*x = PackageResponse{}
-	mi := &file_assctl_proto_msgTypes[5]
+	mi := &file_assctl_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -302,7 +557,7 @@ func (x *PackageResponse) String() string {
 func (*PackageResponse) ProtoMessage() {}
 
 func (x *PackageResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[5]
+	mi := &file_assctl_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -315,7 +570,7 @@ func (x *PackageResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use PackageResponse.ProtoReflect.Descriptor instead.
 func (*PackageResponse) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{5}
+	return file_assctl_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *PackageResponse) GetContent() []byte {
@@ -332,6 +587,255 @@ func (x *PackageResponse) GetTotalSize() int64 {
 	return 0
 }
 
+type AgentBinaryRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The agent's GOOS and GOARCH, e.g. linux and arm64
+	Os            string `protobuf:"bytes,1,opt,name=os,proto3" json:"os,omitempty"`
+	Arch          string `protobuf:"bytes,2,opt,name=arch,proto3" json:"arch,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentBinaryRequest) Reset() {
+	*x = AgentBinaryRequest{}
+	mi := &file_assctl_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentBinaryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentBinaryRequest) ProtoMessage() {}
+
+func (x *AgentBinaryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_assctl_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentBinaryRequest.ProtoReflect.Descriptor instead.
+func (*AgentBinaryRequest) Descriptor() ([]byte, []int) {
+	return file_assctl_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *AgentBinaryRequest) GetOs() string {
+	if x != nil {
+		return x.Os
+	}
+	return ""
+}
+
+func (x *AgentBinaryRequest) GetArch() string {
+	if x != nil {
+		return x.Arch
+	}
+	return ""
+}
+
+type AgentBinaryResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The binary data, sent in chunks like PackageResponse
+	Content []byte `protobuf:"bytes,1,opt,name=content,proto3" json:"content,omitempty"`
+	// The fields below are only populated in the first chunk
+	TotalSize int64 `protobuf:"varint,2,opt,name=total_size,json=totalSize,proto3" json:"total_size,omitempty"`
+	// The version of the agent build
+	Version string `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
+	// The SHA-256 of the whole binary in hex
+	Checksum string `protobuf:"bytes,4,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	// The ed25519 signature of the version, "<os>/<arch>" and raw SHA-256
+	// digest together, see updateSignedMessage
+	Signature     []byte `protobuf:"bytes,5,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentBinaryResponse) Reset() {
+	*x = AgentBinaryResponse{}
+	mi := &file_assctl_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentBinaryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentBinaryResponse) ProtoMessage() {}
+
+func (x *AgentBinaryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_assctl_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentBinaryResponse.ProtoReflect.Descriptor instead.
+func (*AgentBinaryResponse) Descriptor() ([]byte, []int) {
+	return file_assctl_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *AgentBinaryResponse) GetContent() []byte {
+	if x != nil {
+		return x.Content
+	}
+	return nil
+}
+
+func (x *AgentBinaryResponse) GetTotalSize() int64 {
+	if x != nil {
+		return x.TotalSize
+	}
+	return 0
+}
+
+func (x *AgentBinaryResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *AgentBinaryResponse) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+func (x *AgentBinaryResponse) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+type AdHocPackageRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MachineName   string                 `protobuf:"bytes,1,opt,name=machine_name,json=machineName,proto3" json:"machine_name,omitempty"`
+	Package       string                 `protobuf:"bytes,2,opt,name=package,proto3" json:"package,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AdHocPackageRequest) Reset() {
+	*x = AdHocPackageRequest{}
+	mi := &file_assctl_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AdHocPackageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AdHocPackageRequest) ProtoMessage() {}
+
+func (x *AdHocPackageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_assctl_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AdHocPackageRequest.ProtoReflect.Descriptor instead.
+func (*AdHocPackageRequest) Descriptor() ([]byte, []int) {
+	return file_assctl_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *AdHocPackageRequest) GetMachineName() string {
+	if x != nil {
+		return x.MachineName
+	}
+	return ""
+}
+
+func (x *AdHocPackageRequest) GetPackage() string {
+	if x != nil {
+		return x.Package
+	}
+	return ""
+}
+
+type AdHocPackageResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The checksum of the package's tarball
+	Checksum string         `protobuf:"bytes,1,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	Version  *ServerVersion `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	// The commit of the config repository the server is serving
+	ConfigRevision string `protobuf:"bytes,3,opt,name=config_revision,json=configRevision,proto3" json:"config_revision,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *AdHocPackageResponse) Reset() {
+	*x = AdHocPackageResponse{}
+	mi := &file_assctl_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AdHocPackageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AdHocPackageResponse) ProtoMessage() {}
+
+func (x *AdHocPackageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_assctl_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AdHocPackageResponse.ProtoReflect.Descriptor instead.
+func (*AdHocPackageResponse) Descriptor() ([]byte, []int) {
+	return file_assctl_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *AdHocPackageResponse) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+func (x *AdHocPackageResponse) GetVersion() *ServerVersion {
+	if x != nil {
+		return x.Version
+	}
+	return nil
+}
+
+func (x *AdHocPackageResponse) GetConfigRevision() string {
+	if x != nil {
+		return x.ConfigRevision
+	}
+	return ""
+}
+
 type DesiredState struct {
 	state         protoimpl.MessageState    `protogen:"open.v1"`
 	Global        *AppConfig                `protobuf:"bytes,1,opt,name=global,proto3" json:"global,omitempty"`
@@ -343,7 +847,7 @@ type DesiredState struct {
 
 func (x *DesiredState) Reset() {
 	*x = DesiredState{}
-	mi := &file_assctl_proto_msgTypes[6]
+	mi := &file_assctl_proto_msgTypes[12]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -355,7 +859,7 @@ func (x *DesiredState) String() string {
 func (*DesiredState) ProtoMessage() {}
 
 func (x *DesiredState) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[6]
+	mi := &file_assctl_proto_msgTypes[12]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -368,7 +872,7 @@ func (x *DesiredState) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DesiredState.ProtoReflect.Descriptor instead.
 func (*DesiredState) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{6}
+	return file_assctl_proto_rawDescGZIP(), []int{12}
 }
 
 func (x *DesiredState) GetGlobal() *AppConfig {
@@ -403,7 +907,7 @@ type ServerVersion struct {
 
 func (x *ServerVersion) Reset() {
 	*x = ServerVersion{}
-	mi := &file_assctl_proto_msgTypes[7]
+	mi := &file_assctl_proto_msgTypes[13]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -415,7 +919,7 @@ func (x *ServerVersion) String() string {
 func (*ServerVersion) ProtoMessage() {}
 
 func (x *ServerVersion) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[7]
+	mi := &file_assctl_proto_msgTypes[13]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -428,7 +932,7 @@ func (x *ServerVersion) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ServerVersion.ProtoReflect.Descriptor instead.
 func (*ServerVersion) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{7}
+	return file_assctl_proto_rawDescGZIP(), []int{13}
 }
 
 func (x *ServerVersion) GetVersion() string {
@@ -469,7 +973,7 @@ type AppConfig struct {
 
 func (x *AppConfig) Reset() {
 	*x = AppConfig{}
-	mi := &file_assctl_proto_msgTypes[8]
+	mi := &file_assctl_proto_msgTypes[14]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -481,7 +985,7 @@ func (x *AppConfig) String() string {
 func (*AppConfig) ProtoMessage() {}
 
 func (x *AppConfig) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[8]
+	mi := &file_assctl_proto_msgTypes[14]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -494,7 +998,7 @@ func (x *AppConfig) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use AppConfig.ProtoReflect.Descriptor instead.
 func (*AppConfig) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{8}
+	return file_assctl_proto_rawDescGZIP(), []int{14}
 }
 
 func (x *AppConfig) GetIsServer() bool {
@@ -570,7 +1074,7 @@ type ConfigProfile struct {
 
 func (x *ConfigProfile) Reset() {
 	*x = ConfigProfile{}
-	mi := &file_assctl_proto_msgTypes[9]
+	mi := &file_assctl_proto_msgTypes[15]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -582,7 +1086,7 @@ func (x *ConfigProfile) String() string {
 func (*ConfigProfile) ProtoMessage() {}
 
 func (x *ConfigProfile) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[9]
+	mi := &file_assctl_proto_msgTypes[15]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -595,7 +1099,7 @@ func (x *ConfigProfile) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ConfigProfile.ProtoReflect.Descriptor instead.
 func (*ConfigProfile) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{9}
+	return file_assctl_proto_rawDescGZIP(), []int{15}
 }
 
 func (x *ConfigProfile) GetAppconfig() map[string]*AppConfig {
@@ -624,7 +1128,7 @@ type MachineConfig struct {
 
 func (x *MachineConfig) Reset() {
 	*x = MachineConfig{}
-	mi := &file_assctl_proto_msgTypes[10]
+	mi := &file_assctl_proto_msgTypes[16]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -636,7 +1140,7 @@ func (x *MachineConfig) String() string {
 func (*MachineConfig) ProtoMessage() {}
 
 func (x *MachineConfig) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[10]
+	mi := &file_assctl_proto_msgTypes[16]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -649,7 +1153,7 @@ func (x *MachineConfig) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MachineConfig.ProtoReflect.Descriptor instead.
 func (*MachineConfig) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{10}
+	return file_assctl_proto_rawDescGZIP(), []int{16}
 }
 
 func (x *MachineConfig) GetAppliedProfiles() []string {
@@ -692,7 +1196,7 @@ type PackageConfig struct {
 
 func (x *PackageConfig) Reset() {
 	*x = PackageConfig{}
-	mi := &file_assctl_proto_msgTypes[11]
+	mi := &file_assctl_proto_msgTypes[17]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -704,7 +1208,7 @@ func (x *PackageConfig) String() string {
 func (*PackageConfig) ProtoMessage() {}
 
 func (x *PackageConfig) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[11]
+	mi := &file_assctl_proto_msgTypes[17]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -717,7 +1221,7 @@ func (x *PackageConfig) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use PackageConfig.ProtoReflect.Descriptor instead.
 func (*PackageConfig) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{11}
+	return file_assctl_proto_rawDescGZIP(), []int{17}
 }
 
 func (x *PackageConfig) GetPackageSteps() []*PackageSteps {
@@ -741,14 +1245,22 @@ type PackageSteps struct {
 	// Any arguments that should be passed to the package during runtime
 	Arguments []string `protobuf:"bytes,2,rep,name=arguments,proto3" json:"arguments,omitempty"`
 	// The user to run the package as
-	Runasuser     string `protobuf:"bytes,3,opt,name=runasuser,proto3" json:"runasuser,omitempty"`
+	Runasuser string `protobuf:"bytes,3,opt,name=runasuser,proto3" json:"runasuser,omitempty"`
+	// How long the script may run in seconds before it is killed. 0 uses the agent's default
+	Timeout int64 `protobuf:"varint,4,opt,name=timeout,proto3" json:"timeout,omitempty"`
+	// Whether the agent should run uninstall.sh once the package is removed from its config
+	UninstallOnRemoval bool `protobuf:"varint,5,opt,name=uninstall_on_removal,json=uninstallOnRemoval,proto3" json:"uninstall_on_removal,omitempty"`
+	// Environment variables to set for the package's scripts
+	Env map[string]string `protobuf:"bytes,6,rep,name=env,proto3" json:"env,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Whether the arguments or env hold decrypted secrets, which the agent keeps out of its logs
+	HasSecrets    bool `protobuf:"varint,7,opt,name=has_secrets,json=hasSecrets,proto3" json:"has_secrets,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *PackageSteps) Reset() {
 	*x = PackageSteps{}
-	mi := &file_assctl_proto_msgTypes[12]
+	mi := &file_assctl_proto_msgTypes[18]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -760,7 +1272,7 @@ func (x *PackageSteps) String() string {
 func (*PackageSteps) ProtoMessage() {}
 
 func (x *PackageSteps) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[12]
+	mi := &file_assctl_proto_msgTypes[18]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -773,7 +1285,7 @@ func (x *PackageSteps) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use PackageSteps.ProtoReflect.Descriptor instead.
 func (*PackageSteps) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{12}
+	return file_assctl_proto_rawDescGZIP(), []int{18}
 }
 
 func (x *PackageSteps) GetAction() string {
@@ -797,6 +1309,34 @@ func (x *PackageSteps) GetRunasuser() string {
 	return ""
 }
 
+func (x *PackageSteps) GetTimeout() int64 {
+	if x != nil {
+		return x.Timeout
+	}
+	return 0
+}
+
+func (x *PackageSteps) GetUninstallOnRemoval() bool {
+	if x != nil {
+		return x.UninstallOnRemoval
+	}
+	return false
+}
+
+func (x *PackageSteps) GetEnv() map[string]string {
+	if x != nil {
+		return x.Env
+	}
+	return nil
+}
+
+func (x *PackageSteps) GetHasSecrets() bool {
+	if x != nil {
+		return x.HasSecrets
+	}
+	return false
+}
+
 type PackageMap struct {
 	state         protoimpl.MessageState    `protogen:"open.v1"`
 	Packages      map[string]*PackageConfig `protobuf:"bytes,1,rep,name=packages,proto3" json:"packages,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
@@ -806,7 +1346,7 @@ type PackageMap struct {
 
 func (x *PackageMap) Reset() {
 	*x = PackageMap{}
-	mi := &file_assctl_proto_msgTypes[13]
+	mi := &file_assctl_proto_msgTypes[19]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -818,7 +1358,7 @@ func (x *PackageMap) String() string {
 func (*PackageMap) ProtoMessage() {}
 
 func (x *PackageMap) ProtoReflect() protoreflect.Message {
-	mi := &file_assctl_proto_msgTypes[13]
+	mi := &file_assctl_proto_msgTypes[19]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -831,7 +1371,7 @@ func (x *PackageMap) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use PackageMap.ProtoReflect.Descriptor instead.
 func (*PackageMap) Descriptor() ([]byte, []int) {
-	return file_assctl_proto_rawDescGZIP(), []int{13}
+	return file_assctl_proto_rawDescGZIP(), []int{19}
 }
 
 func (x *PackageMap) GetPackages() map[string]*PackageConfig {
@@ -855,24 +1395,70 @@ const file_assctl_proto_rawDesc = "" +
 	"\x05value\x18\x02 \x01(\v2\x15.assctl.MachineConfigR\x05value:\x028\x01\x1aO\n" +
 	"\x0eAppconfigEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12'\n" +
-	"\x05value\x18\x02 \x01(\v2\x11.assctl.AppConfigR\x05value:\x028\x01\"<\n" +
+	"\x05value\x18\x02 \x01(\v2\x11.assctl.AppConfigR\x05value:\x028\x01\"a\n" +
 	"\x18GetSpecificConfigRequest\x12 \n" +
-	"\vMachineName\x18\x01 \x01(\tR\vMachineName\"\xfc\x02\n" +
+	"\vMachineName\x18\x01 \x01(\tR\vMachineName\x12#\n" +
+	"\x05facts\x18\x02 \x01(\v2\r.assctl.FactsR\x05facts\"\xae\x03\n" +
+	"\x05Facts\x12\x1a\n" +
+	"\bhostname\x18\x01 \x01(\tR\bhostname\x12\x16\n" +
+	"\x06distro\x18\x02 \x01(\tR\x06distro\x12%\n" +
+	"\x0edistro_version\x18\x03 \x01(\tR\rdistroVersion\x12\x1f\n" +
+	"\vdistro_like\x18\x04 \x03(\tR\n" +
+	"distroLike\x12\x16\n" +
+	"\x06kernel\x18\x05 \x01(\tR\x06kernel\x12\x12\n" +
+	"\x04arch\x18\x06 \x01(\tR\x04arch\x12\x1b\n" +
+	"\tcpu_count\x18\a \x01(\x05R\bcpuCount\x12\x1b\n" +
+	"\tcpu_model\x18\b \x01(\tR\bcpuModel\x12!\n" +
+	"\fmemory_bytes\x18\t \x01(\x04R\vmemoryBytes\x12!\n" +
+	"\fip_addresses\x18\n" +
+	" \x03(\tR\vipAddresses\x12\x1d\n" +
+	"\n" +
+	"machine_id\x18\v \x01(\tR\tmachineId\x12\x13\n" +
+	"\x05is_vm\x18\f \x01(\bR\x04isVm\x12!\n" +
+	"\fis_container\x18\r \x01(\bR\visContainer\x12&\n" +
+	"\x0evirtualization\x18\x0e \x01(\tR\x0evirtualization\"\xc6\x04\n" +
 	"\x19GetSpecificConfigResponse\x12/\n" +
 	"\aVersion\x18\x01 \x01(\v2\x15.assctl.ServerVersionR\aVersion\x12(\n" +
 	"\x0fappliedProfiles\x18\x04 \x03(\tR\x0fappliedProfiles\x12K\n" +
 	"\bpackages\x18\x05 \x03(\v2/.assctl.GetSpecificConfigResponse.PackagesEntryR\bpackages\x12<\n" +
 	"\x10config_overrides\x18\x06 \x01(\v2\x11.assctl.AppConfigR\x0fconfigOverrides\x12%\n" +
-	"\x0eapplied_config\x18\a \x01(\tR\rappliedConfig\x1aR\n" +
+	"\x0eapplied_config\x18\a \x01(\tR\rappliedConfig\x12'\n" +
+	"\x0fconfig_revision\x18\b \x01(\tR\x0econfigRevision\x12,\n" +
+	"\x12next_poll_interval\x18\t \x01(\x03R\x10nextPollInterval\x12&\n" +
+	"\fmax_removals\x18\n" +
+	" \x01(\x05H\x00R\vmaxRemovals\x88\x01\x01\x128\n" +
+	"\rskipped_steps\x18\v \x03(\v2\x13.assctl.SkippedStepR\fskippedSteps\x1aR\n" +
 	"\rPackagesEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12+\n" +
-	"\x05value\x18\x02 \x01(\v2\x15.assctl.PackageConfigR\x05value:\x028\x01\"$\n" +
+	"\x05value\x18\x02 \x01(\v2\x15.assctl.PackageConfigR\x05value:\x028\x01B\x0f\n" +
+	"\r_max_removals\"W\n" +
+	"\vSkippedStep\x12\x18\n" +
+	"\apackage\x18\x01 \x01(\tR\apackage\x12\x16\n" +
+	"\x06action\x18\x02 \x01(\tR\x06action\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason\"$\n" +
 	"\x0ePackageRequest\x12\x12\n" +
 	"\x04Name\x18\x01 \x01(\tR\x04Name\"J\n" +
 	"\x0fPackageResponse\x12\x18\n" +
 	"\acontent\x18\x01 \x01(\fR\acontent\x12\x1d\n" +
 	"\n" +
-	"total_size\x18\x02 \x01(\x03R\ttotalSize\"\xe1\x02\n" +
+	"total_size\x18\x02 \x01(\x03R\ttotalSize\"8\n" +
+	"\x12AgentBinaryRequest\x12\x0e\n" +
+	"\x02os\x18\x01 \x01(\tR\x02os\x12\x12\n" +
+	"\x04arch\x18\x02 \x01(\tR\x04arch\"\xa2\x01\n" +
+	"\x13AgentBinaryResponse\x12\x18\n" +
+	"\acontent\x18\x01 \x01(\fR\acontent\x12\x1d\n" +
+	"\n" +
+	"total_size\x18\x02 \x01(\x03R\ttotalSize\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\tR\aversion\x12\x1a\n" +
+	"\bchecksum\x18\x04 \x01(\tR\bchecksum\x12\x1c\n" +
+	"\tsignature\x18\x05 \x01(\fR\tsignature\"R\n" +
+	"\x13AdHocPackageRequest\x12!\n" +
+	"\fmachine_name\x18\x01 \x01(\tR\vmachineName\x12\x18\n" +
+	"\apackage\x18\x02 \x01(\tR\apackage\"\x8c\x01\n" +
+	"\x14AdHocPackageResponse\x12\x1a\n" +
+	"\bchecksum\x18\x01 \x01(\tR\bchecksum\x12/\n" +
+	"\aversion\x18\x02 \x01(\v2\x15.assctl.ServerVersionR\aversion\x12'\n" +
+	"\x0fconfig_revision\x18\x03 \x01(\tR\x0econfigRevision\"\xe1\x02\n" +
 	"\fDesiredState\x12)\n" +
 	"\x06global\x18\x01 \x01(\v2\x11.assctl.AppConfigR\x06global\x12>\n" +
 	"\bprofiles\x18\x02 \x03(\v2\".assctl.DesiredState.ProfilesEntryR\bprofiles\x12>\n" +
@@ -924,21 +1510,31 @@ const file_assctl_proto_rawDesc = "" +
 	"\x05value\x18\x02 \x01(\v2\x15.assctl.PackageConfigR\x05value:\x028\x01\"f\n" +
 	"\rPackageConfig\x129\n" +
 	"\rpackage_steps\x18\x01 \x03(\v2\x14.assctl.PackageStepsR\fpackageSteps\x12\x1a\n" +
-	"\bchecksum\x18\x02 \x01(\tR\bchecksum\"b\n" +
+	"\bchecksum\x18\x02 \x01(\tR\bchecksum\"\xb8\x02\n" +
 	"\fPackageSteps\x12\x16\n" +
 	"\x06action\x18\x01 \x01(\tR\x06action\x12\x1c\n" +
 	"\targuments\x18\x02 \x03(\tR\targuments\x12\x1c\n" +
-	"\trunasuser\x18\x03 \x01(\tR\trunasuser\"\x9e\x01\n" +
+	"\trunasuser\x18\x03 \x01(\tR\trunasuser\x12\x18\n" +
+	"\atimeout\x18\x04 \x01(\x03R\atimeout\x120\n" +
+	"\x14uninstall_on_removal\x18\x05 \x01(\bR\x12uninstallOnRemoval\x12/\n" +
+	"\x03env\x18\x06 \x03(\v2\x1d.assctl.PackageSteps.EnvEntryR\x03env\x12\x1f\n" +
+	"\vhas_secrets\x18\a \x01(\bR\n" +
+	"hasSecrets\x1a6\n" +
+	"\bEnvEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x9e\x01\n" +
 	"\n" +
 	"PackageMap\x12<\n" +
 	"\bpackages\x18\x01 \x03(\v2 .assctl.PackageMap.PackagesEntryR\bpackages\x1aR\n" +
 	"\rPackagesEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12+\n" +
-	"\x05value\x18\x02 \x01(\v2\x15.assctl.PackageConfigR\x05value:\x028\x012\x81\x02\n" +
+	"\x05value\x18\x02 \x01(\v2\x15.assctl.PackageConfigR\x05value:\x028\x012\xa5\x03\n" +
 	"\vAssimilator\x12N\n" +
 	"\rGetAllConfigs\x12\x1c.assctl.GetAllConfigsRequest\x1a\x1d.assctl.GetAllConfigsResponse\"\x00\x12Z\n" +
 	"\x11GetSpecificConfig\x12 .assctl.GetSpecificConfigRequest\x1a!.assctl.GetSpecificConfigResponse\"\x00\x12F\n" +
-	"\x0fDownloadPackage\x12\x16.assctl.PackageRequest\x1a\x17.assctl.PackageResponse\"\x000\x01B\n" +
+	"\x0fDownloadPackage\x12\x16.assctl.PackageRequest\x1a\x17.assctl.PackageResponse\"\x000\x01\x12R\n" +
+	"\x13DownloadAgentBinary\x12\x1a.assctl.AgentBinaryRequest\x1a\x1b.assctl.AgentBinaryResponse\"\x000\x01\x12N\n" +
+	"\x0fGetAdHocPackage\x12\x1b.assctl.AdHocPackageRequest\x1a\x1c.assctl.AdHocPackageResponse\"\x00B\n" +
 	"Z\b./assctlb\x06proto3"
 
 var (
@@ -953,70 +1549,85 @@ func file_assctl_proto_rawDescGZIP() []byte {
 	return file_assctl_proto_rawDescData
 }
 
-var file_assctl_proto_msgTypes = make([]protoimpl.MessageInfo, 24)
+var file_assctl_proto_msgTypes = make([]protoimpl.MessageInfo, 31)
 var file_assctl_proto_goTypes = []any{
 	(*GetAllConfigsRequest)(nil),      // 0: assctl.GetAllConfigsRequest
 	(*GetAllConfigsResponse)(nil),     // 1: assctl.GetAllConfigsResponse
 	(*GetSpecificConfigRequest)(nil),  // 2: assctl.GetSpecificConfigRequest
-	(*GetSpecificConfigResponse)(nil), // 3: assctl.GetSpecificConfigResponse
-	(*PackageRequest)(nil),            // 4: assctl.PackageRequest
-	(*PackageResponse)(nil),           // 5: assctl.PackageResponse
-	(*DesiredState)(nil),              // 6: assctl.DesiredState
-	(*ServerVersion)(nil),             // 7: assctl.ServerVersion
-	(*AppConfig)(nil),                 // 8: assctl.AppConfig
-	(*ConfigProfile)(nil),             // 9: assctl.ConfigProfile
-	(*MachineConfig)(nil),             // 10: assctl.MachineConfig
-	(*PackageConfig)(nil),             // 11: assctl.PackageConfig
-	(*PackageSteps)(nil),              // 12: assctl.PackageSteps
-	(*PackageMap)(nil),                // 13: assctl.PackageMap
-	nil,                               // 14: assctl.GetAllConfigsResponse.MachinesEntry
-	nil,                               // 15: assctl.GetAllConfigsResponse.AppconfigEntry
-	nil,                               // 16: assctl.GetSpecificConfigResponse.PackagesEntry
-	nil,                               // 17: assctl.DesiredState.ProfilesEntry
-	nil,                               // 18: assctl.DesiredState.MachinesEntry
-	nil,                               // 19: assctl.AppConfig.PackageMapEntry
-	nil,                               // 20: assctl.ConfigProfile.AppconfigEntry
-	nil,                               // 21: assctl.ConfigProfile.MachinesEntry
-	nil,                               // 22: assctl.MachineConfig.PackagesEntry
-	nil,                               // 23: assctl.PackageMap.PackagesEntry
+	(*Facts)(nil),                     // 3: assctl.Facts
+	(*GetSpecificConfigResponse)(nil), // 4: assctl.GetSpecificConfigResponse
+	(*SkippedStep)(nil),               // 5: assctl.SkippedStep
+	(*PackageRequest)(nil),            // 6: assctl.PackageRequest
+	(*PackageResponse)(nil),           // 7: assctl.PackageResponse
+	(*AgentBinaryRequest)(nil),        // 8: assctl.AgentBinaryRequest
+	(*AgentBinaryResponse)(nil),       // 9: assctl.AgentBinaryResponse
+	(*AdHocPackageRequest)(nil),       // 10: assctl.AdHocPackageRequest
+	(*AdHocPackageResponse)(nil),      // 11: assctl.AdHocPackageResponse
+	(*DesiredState)(nil),              // 12: assctl.DesiredState
+	(*ServerVersion)(nil),             // 13: assctl.ServerVersion
+	(*AppConfig)(nil),                 // 14: assctl.AppConfig
+	(*ConfigProfile)(nil),             // 15: assctl.ConfigProfile
+	(*MachineConfig)(nil),             // 16: assctl.MachineConfig
+	(*PackageConfig)(nil),             // 17: assctl.PackageConfig
+	(*PackageSteps)(nil),              // 18: assctl.PackageSteps
+	(*PackageMap)(nil),                // 19: assctl.PackageMap
+	nil,                               // 20: assctl.GetAllConfigsResponse.MachinesEntry
+	nil,                               // 21: assctl.GetAllConfigsResponse.AppconfigEntry
+	nil,                               // 22: assctl.GetSpecificConfigResponse.PackagesEntry
+	nil,                               // 23: assctl.DesiredState.ProfilesEntry
+	nil,                               // 24: assctl.DesiredState.MachinesEntry
+	nil,                               // 25: assctl.AppConfig.PackageMapEntry
+	nil,                               // 26: assctl.ConfigProfile.AppconfigEntry
+	nil,                               // 27: assctl.ConfigProfile.MachinesEntry
+	nil,                               // 28: assctl.MachineConfig.PackagesEntry
+	nil,                               // 29: assctl.PackageSteps.EnvEntry
+	nil,                               // 30: assctl.PackageMap.PackagesEntry
 }
 var file_assctl_proto_depIdxs = []int32{
-	14, // 0: assctl.GetAllConfigsResponse.Machines:type_name -> assctl.GetAllConfigsResponse.MachinesEntry
-	15, // 1: assctl.GetAllConfigsResponse.appconfig:type_name -> assctl.GetAllConfigsResponse.AppconfigEntry
-	7,  // 2: assctl.GetSpecificConfigResponse.Version:type_name -> assctl.ServerVersion
-	16, // 3: assctl.GetSpecificConfigResponse.packages:type_name -> assctl.GetSpecificConfigResponse.PackagesEntry
-	8,  // 4: assctl.GetSpecificConfigResponse.config_overrides:type_name -> assctl.AppConfig
-	8,  // 5: assctl.DesiredState.global:type_name -> assctl.AppConfig
-	17, // 6: assctl.DesiredState.profiles:type_name -> assctl.DesiredState.ProfilesEntry
-	18, // 7: assctl.DesiredState.machines:type_name -> assctl.DesiredState.MachinesEntry
-	19, // 8: assctl.AppConfig.packageMap:type_name -> assctl.AppConfig.PackageMapEntry
-	20, // 9: assctl.ConfigProfile.appconfig:type_name -> assctl.ConfigProfile.AppconfigEntry
-	21, // 10: assctl.ConfigProfile.machines:type_name -> assctl.ConfigProfile.MachinesEntry
-	22, // 11: assctl.MachineConfig.packages:type_name -> assctl.MachineConfig.PackagesEntry
-	8,  // 12: assctl.MachineConfig.config_overrides:type_name -> assctl.AppConfig
-	12, // 13: assctl.PackageConfig.package_steps:type_name -> assctl.PackageSteps
-	23, // 14: assctl.PackageMap.packages:type_name -> assctl.PackageMap.PackagesEntry
-	10, // 15: assctl.GetAllConfigsResponse.MachinesEntry.value:type_name -> assctl.MachineConfig
-	8,  // 16: assctl.GetAllConfigsResponse.AppconfigEntry.value:type_name -> assctl.AppConfig
-	11, // 17: assctl.GetSpecificConfigResponse.PackagesEntry.value:type_name -> assctl.PackageConfig
-	9,  // 18: assctl.DesiredState.ProfilesEntry.value:type_name -> assctl.ConfigProfile
-	10, // 19: assctl.DesiredState.MachinesEntry.value:type_name -> assctl.MachineConfig
-	13, // 20: assctl.AppConfig.PackageMapEntry.value:type_name -> assctl.PackageMap
-	8,  // 21: assctl.ConfigProfile.AppconfigEntry.value:type_name -> assctl.AppConfig
-	10, // 22: assctl.ConfigProfile.MachinesEntry.value:type_name -> assctl.MachineConfig
-	11, // 23: assctl.MachineConfig.PackagesEntry.value:type_name -> assctl.PackageConfig
-	11, // 24: assctl.PackageMap.PackagesEntry.value:type_name -> assctl.PackageConfig
-	0,  // 25: assctl.Assimilator.GetAllConfigs:input_type -> assctl.GetAllConfigsRequest
-	2,  // 26: assctl.Assimilator.GetSpecificConfig:input_type -> assctl.GetSpecificConfigRequest
-	4,  // 27: assctl.Assimilator.DownloadPackage:input_type -> assctl.PackageRequest
-	1,  // 28: assctl.Assimilator.GetAllConfigs:output_type -> assctl.GetAllConfigsResponse
-	3,  // 29: assctl.Assimilator.GetSpecificConfig:output_type -> assctl.GetSpecificConfigResponse
-	5,  // 30: assctl.Assimilator.DownloadPackage:output_type -> assctl.PackageResponse
-	28, // [28:31] is the sub-list for method output_type
-	25, // [25:28] is the sub-list for method input_type
-	25, // [25:25] is the sub-list for extension type_name
-	25, // [25:25] is the sub-list for extension extendee
-	0,  // [0:25] is the sub-list for field type_name
+	20, // 0: assctl.GetAllConfigsResponse.Machines:type_name -> assctl.GetAllConfigsResponse.MachinesEntry
+	21, // 1: assctl.GetAllConfigsResponse.appconfig:type_name -> assctl.GetAllConfigsResponse.AppconfigEntry
+	3,  // 2: assctl.GetSpecificConfigRequest.facts:type_name -> assctl.Facts
+	13, // 3: assctl.GetSpecificConfigResponse.Version:type_name -> assctl.ServerVersion
+	22, // 4: assctl.GetSpecificConfigResponse.packages:type_name -> assctl.GetSpecificConfigResponse.PackagesEntry
+	14, // 5: assctl.GetSpecificConfigResponse.config_overrides:type_name -> assctl.AppConfig
+	5,  // 6: assctl.GetSpecificConfigResponse.skipped_steps:type_name -> assctl.SkippedStep
+	13, // 7: assctl.AdHocPackageResponse.version:type_name -> assctl.ServerVersion
+	14, // 8: assctl.DesiredState.global:type_name -> assctl.AppConfig
+	23, // 9: assctl.DesiredState.profiles:type_name -> assctl.DesiredState.ProfilesEntry
+	24, // 10: assctl.DesiredState.machines:type_name -> assctl.DesiredState.MachinesEntry
+	25, // 11: assctl.AppConfig.packageMap:type_name -> assctl.AppConfig.PackageMapEntry
+	26, // 12: assctl.ConfigProfile.appconfig:type_name -> assctl.ConfigProfile.AppconfigEntry
+	27, // 13: assctl.ConfigProfile.machines:type_name -> assctl.ConfigProfile.MachinesEntry
+	28, // 14: assctl.MachineConfig.packages:type_name -> assctl.MachineConfig.PackagesEntry
+	14, // 15: assctl.MachineConfig.config_overrides:type_name -> assctl.AppConfig
+	18, // 16: assctl.PackageConfig.package_steps:type_name -> assctl.PackageSteps
+	29, // 17: assctl.PackageSteps.env:type_name -> assctl.PackageSteps.EnvEntry
+	30, // 18: assctl.PackageMap.packages:type_name -> assctl.PackageMap.PackagesEntry
+	16, // 19: assctl.GetAllConfigsResponse.MachinesEntry.value:type_name -> assctl.MachineConfig
+	14, // 20: assctl.GetAllConfigsResponse.AppconfigEntry.value:type_name -> assctl.AppConfig
+	17, // 21: assctl.GetSpecificConfigResponse.PackagesEntry.value:type_name -> assctl.PackageConfig
+	15, // 22: assctl.DesiredState.ProfilesEntry.value:type_name -> assctl.ConfigProfile
+	16, // 23: assctl.DesiredState.MachinesEntry.value:type_name -> assctl.MachineConfig
+	19, // 24: assctl.AppConfig.PackageMapEntry.value:type_name -> assctl.PackageMap
+	14, // 25: assctl.ConfigProfile.AppconfigEntry.value:type_name -> assctl.AppConfig
+	16, // 26: assctl.ConfigProfile.MachinesEntry.value:type_name -> assctl.MachineConfig
+	17, // 27: assctl.MachineConfig.PackagesEntry.value:type_name -> assctl.PackageConfig
+	17, // 28: assctl.PackageMap.PackagesEntry.value:type_name -> assctl.PackageConfig
+	0,  // 29: assctl.Assimilator.GetAllConfigs:input_type -> assctl.GetAllConfigsRequest
+	2,  // 30: assctl.Assimilator.GetSpecificConfig:input_type -> assctl.GetSpecificConfigRequest
+	6,  // 31: assctl.Assimilator.DownloadPackage:input_type -> assctl.PackageRequest
+	8,  // 32: assctl.Assimilator.DownloadAgentBinary:input_type -> assctl.AgentBinaryRequest
+	10, // 33: assctl.Assimilator.GetAdHocPackage:input_type -> assctl.AdHocPackageRequest
+	1,  // 34: assctl.Assimilator.GetAllConfigs:output_type -> assctl.GetAllConfigsResponse
+	4,  // 35: assctl.Assimilator.GetSpecificConfig:output_type -> assctl.GetSpecificConfigResponse
+	7,  // 36: assctl.Assimilator.DownloadPackage:output_type -> assctl.PackageResponse
+	9,  // 37: assctl.Assimilator.DownloadAgentBinary:output_type -> assctl.AgentBinaryResponse
+	11, // 38: assctl.Assimilator.GetAdHocPackage:output_type -> assctl.AdHocPackageResponse
+	34, // [34:39] is the sub-list for method output_type
+	29, // [29:34] is the sub-list for method input_type
+	29, // [29:29] is the sub-list for extension type_name
+	29, // [29:29] is the sub-list for extension extendee
+	0,  // [0:29] is the sub-list for field type_name
 }
 
 func init() { file_assctl_proto_init() }
@@ -1024,13 +1635,14 @@ func file_assctl_proto_init() {
 	if File_assctl_proto != nil {
 		return
 	}
+	file_assctl_proto_msgTypes[4].OneofWrappers = []any{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_assctl_proto_rawDesc), len(file_assctl_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   24,
+			NumMessages:   31,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -19,9 +19,11 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	Assimilator_GetAllConfigs_FullMethodName     = "/assctl.Assimilator/GetAllConfigs"
-	Assimilator_GetSpecificConfig_FullMethodName = "/assctl.Assimilator/GetSpecificConfig"
-	Assimilator_DownloadPackage_FullMethodName   = "/assctl.Assimilator/DownloadPackage"
+	Assimilator_GetAllConfigs_FullMethodName       = "/assctl.Assimilator/GetAllConfigs"
+	Assimilator_GetSpecificConfig_FullMethodName   = "/assctl.Assimilator/GetSpecificConfig"
+	Assimilator_DownloadPackage_FullMethodName     = "/assctl.Assimilator/DownloadPackage"
+	Assimilator_DownloadAgentBinary_FullMethodName = "/assctl.Assimilator/DownloadAgentBinary"
+	Assimilator_GetAdHocPackage_FullMethodName     = "/assctl.Assimilator/GetAdHocPackage"
 )
 
 // AssimilatorClient is the client API for Assimilator service.
@@ -34,6 +36,10 @@ type AssimilatorClient interface {
 	GetSpecificConfig(ctx context.Context, in *GetSpecificConfigRequest, opts ...grpc.CallOption) (*GetSpecificConfigResponse, error)
 	// Downloads a package
 	DownloadPackage(ctx context.Context, in *PackageRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PackageResponse], error)
+	// Downloads the server's agent build so agents can update themselves
+	DownloadAgentBinary(ctx context.Context, in *AgentBinaryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AgentBinaryResponse], error)
+	// Looks up a package for a one-off install, if the server allows it
+	GetAdHocPackage(ctx context.Context, in *AdHocPackageRequest, opts ...grpc.CallOption) (*AdHocPackageResponse, error)
 }
 
 type assimilatorClient struct {
@@ -83,6 +89,35 @@ func (c *assimilatorClient) DownloadPackage(ctx context.Context, in *PackageRequ
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type Assimilator_DownloadPackageClient = grpc.ServerStreamingClient[PackageResponse]
 
+func (c *assimilatorClient) DownloadAgentBinary(ctx context.Context, in *AgentBinaryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AgentBinaryResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Assimilator_ServiceDesc.Streams[1], Assimilator_DownloadAgentBinary_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AgentBinaryRequest, AgentBinaryResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Assimilator_DownloadAgentBinaryClient = grpc.ServerStreamingClient[AgentBinaryResponse]
+
+func (c *assimilatorClient) GetAdHocPackage(ctx context.Context, in *AdHocPackageRequest, opts ...grpc.CallOption) (*AdHocPackageResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AdHocPackageResponse)
+	err := c.cc.Invoke(ctx, Assimilator_GetAdHocPackage_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // AssimilatorServer is the server API for Assimilator service.
 // All implementations must embed UnimplementedAssimilatorServer
 // for forward compatibility.
@@ -93,6 +128,10 @@ type AssimilatorServer interface {
 	GetSpecificConfig(context.Context, *GetSpecificConfigRequest) (*GetSpecificConfigResponse, error)
 	// Downloads a package
 	DownloadPackage(*PackageRequest, grpc.ServerStreamingServer[PackageResponse]) error
+	// Downloads the server's agent build so agents can update themselves
+	DownloadAgentBinary(*AgentBinaryRequest, grpc.ServerStreamingServer[AgentBinaryResponse]) error
+	// Looks up a package for a one-off install, if the server allows it
+	GetAdHocPackage(context.Context, *AdHocPackageRequest) (*AdHocPackageResponse, error)
 	mustEmbedUnimplementedAssimilatorServer()
 }
 
@@ -112,6 +151,12 @@ func (UnimplementedAssimilatorServer) GetSpecificConfig(context.Context, *GetSpe
 func (UnimplementedAssimilatorServer) DownloadPackage(*PackageRequest, grpc.ServerStreamingServer[PackageResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method DownloadPackage not implemented")
 }
+func (UnimplementedAssimilatorServer) DownloadAgentBinary(*AgentBinaryRequest, grpc.ServerStreamingServer[AgentBinaryResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadAgentBinary not implemented")
+}
+func (UnimplementedAssimilatorServer) GetAdHocPackage(context.Context, *AdHocPackageRequest) (*AdHocPackageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAdHocPackage not implemented")
+}
 func (UnimplementedAssimilatorServer) mustEmbedUnimplementedAssimilatorServer() {}
 func (UnimplementedAssimilatorServer) testEmbeddedByValue()                     {}
 
@@ -180,6 +225,35 @@ func _Assimilator_DownloadPackage_Handler(srv interface{}, stream grpc.ServerStr
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type Assimilator_DownloadPackageServer = grpc.ServerStreamingServer[PackageResponse]
 
+func _Assimilator_DownloadAgentBinary_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(AgentBinaryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AssimilatorServer).DownloadAgentBinary(m, &grpc.GenericServerStream[AgentBinaryRequest, AgentBinaryResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Assimilator_DownloadAgentBinaryServer = grpc.ServerStreamingServer[AgentBinaryResponse]
+
+func _Assimilator_GetAdHocPackage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AdHocPackageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AssimilatorServer).GetAdHocPackage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Assimilator_GetAdHocPackage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AssimilatorServer).GetAdHocPackage(ctx, req.(*AdHocPackageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Assimilator_ServiceDesc is the grpc.ServiceDesc for Assimilator service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -195,6 +269,10 @@ var Assimilator_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetSpecificConfig",
 			Handler:    _Assimilator_GetSpecificConfig_Handler,
 		},
+		{
+			MethodName: "GetAdHocPackage",
+			Handler:    _Assimilator_GetAdHocPackage_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -202,6 +280,11 @@ var Assimilator_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _Assimilator_DownloadPackage_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "DownloadAgentBinary",
+			Handler:       _Assimilator_DownloadAgentBinary_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "assctl.proto",
 }
@@ -38,9 +38,14 @@ func toProtoPackageConfig(packageSteps []PackageStep) *pb.PackageConfig {
 	for i, packageStep := range packageSteps {
 		pbPackageSteps[i] = toProtoPackageSteps(&packageStep)
 	}
+	// A package whose steps were all skipped by their `when:` has none
+	checksum := ""
+	if len(packageSteps) > 0 {
+		checksum = packageSteps[0].Checksum
+	}
 	return &pb.PackageConfig{
 		PackageSteps: pbPackageSteps,
-		Checksum:     packageSteps[0].Checksum,
+		Checksum:     checksum,
 	}
 }
 
@@ -52,7 +57,24 @@ func toProtoPackageSteps(packageConfig *PackageStep) *pb.PackageSteps {
 		Action:    packageConfig.Action,
 		Arguments: packageConfig.Arguments,
 		Runasuser: packageConfig.RunAsUser,
+		Timeout:   packageConfig.Timeout,
+		Env:       packageConfig.Env,
+
+		UninstallOnRemoval: packageConfig.UninstallOnRemoval,
+		HasSecrets:         packageConfig.hasSecrets,
+	}
+}
+
+func toProtoSkippedSteps(skipped []skippedStep) []*pb.SkippedStep {
+	skippedSteps := make([]*pb.SkippedStep, 0, len(skipped))
+	for _, step := range skipped {
+		skippedSteps = append(skippedSteps, &pb.SkippedStep{
+			Package: step.Package,
+			Action:  step.Action,
+			Reason:  step.Reason,
+		})
 	}
+	return skippedSteps
 }
 
 func toProtoMachineConfigMap(machines *map[string]MachineConfig) map[string]*pb.MachineConfig {
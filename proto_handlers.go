@@ -10,6 +10,7 @@ import (
 	pb "github.com/geogian28/Assimilator/proto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // GetAllConfigs implements AssimilatorService
@@ -18,8 +19,14 @@ func (s *AssimilatorServer) GetAllConfigs(ctx context.Context, req *pb.GetAllCon
 		Warning("Agent attempted to get all configs, but Server has not loaded the configuration yet")
 		return nil, fmt.Errorf("server has not loaded the configuration yet")
 	}
+	// Every machine's config is in here, so none of their secrets are
+	machines := make(map[string]MachineConfig, len(s.desiredState.Machines))
+	for machineName, machine := range s.desiredState.Machines {
+		machine.Packages = redactPackages(machine.Packages)
+		machines[machineName] = machine
+	}
 	response := &pb.GetAllConfigsResponse{
-		Machines: toProtoMachineConfigMap(&s.desiredState.Machines),
+		Machines: toProtoMachineConfigMap(&machines),
 		// Users:    toProtoUserConfigMap(&s.desiredState.Users),
 	}
 	Info("Returning response to agent.")
@@ -33,25 +40,82 @@ func (s *AssimilatorServer) GetSpecificConfig(ctx context.Context, req *pb.GetSp
 		Warning("Agent attempted to get a specific config, but Server has not loaded the configuration yet")
 		return nil, fmt.Errorf("server has not loaded the configuration yet")
 	}
-	if len(s.desiredState.Machines) == 0 {
+	if len(s.desiredState.Machines) == 0 && len(s.desiredState.FactProfiles) == 0 {
 		Warning("Configs loaded, but there are no machines.")
 		return nil, fmt.Errorf("configs loaded, but there are no machines")
 	}
-	// Trace("Printing DesiredState.Machines[req.MachineName]: \n%v\n", DesiredState.Machines[req.MachineName])
-	if machine, okay := s.desiredState.Machines[req.MachineName]; okay {
+
+	// Agents report their facts on every check-in. Fall back to the last ones
+	// reported if this request has none.
+	facts := req.GetFacts()
+	if facts != nil {
+		if err := s.facts.record(req.MachineName, facts); err != nil {
+			Error("failed to store facts for ", req.MachineName, ": ", err)
+		}
+	} else {
+		facts = s.facts.get(req.MachineName)
+	}
+
+	factMap := factValues(facts)
+	if machine, okay := s.desiredState.machineConfigFor(req.MachineName, factMap); okay {
 		Trace("Found a machine with name: ", req.MachineName)
+		packages, skipped, err := applyWhen(machine.Packages, machine.vars, factMap)
+		if err != nil {
+			Error("failed to evaluate the step conditions for ", req.MachineName, ": ", err)
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to evaluate the step conditions for %s: %v", req.MachineName, err)
+		}
+		for _, step := range skipped {
+			Debug("Skipping the ", step.Action, " step of ", step.Package, " for ", req.MachineName, ": ", step.Reason)
+		}
+		packages, err = renderArguments(packages, templateData(machine.vars, req.MachineName, s.configRevision, factMap))
+		if err != nil {
+			Error("failed to render the arguments for ", req.MachineName, ": ", err)
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to render the arguments for %s: %v", req.MachineName, err)
+		}
+		// Only this machine's own steps get their secrets revealed
+		if packages, err = s.desiredState.secrets.revealPackages(packages); err != nil {
+			Error("failed to reveal the secrets for ", req.MachineName, ": ", err)
+			return nil, status.Errorf(codes.FailedPrecondition, "failed to reveal the secrets for %s", req.MachineName)
+		}
+		packages = withChecksums(packages, s.packages)
 		Info("Returning response to ", req.MachineName, "'s agent.")
 		return &pb.GetSpecificConfigResponse{
-			AppliedProfiles: machine.AppliedProfiles,
-			Packages:        toProtoPackageConfigMap(&machine.Packages),
-			ConfigOverrides: toProtoAppConfig(machine.Global),
-			Version:         toProtoServerVersion(&s.ServerVersion),
+			AppliedProfiles:  machine.AppliedProfiles,
+			Packages:         toProtoPackageConfigMap(&packages),
+			ConfigOverrides:  toProtoAppConfig(machine.Global),
+			Version:          toProtoServerVersion(&s.ServerVersion),
+			ConfigRevision:   s.configRevision,
+			NextPollInterval: appConfig.AgentPollInterval,
+			MaxRemovals:      proto.Int32(int32(appConfig.MaxRemovalsPerCycle)),
+			SkippedSteps:     toProtoSkippedSteps(skipped),
 		}, nil
 	}
 	Debug("Cannot find a machine with name: ", req.MachineName)
 	return nil, status.Errorf(codes.NotFound, "cannot find a machine with name: %v", req.MachineName)
 }
 
+// GetAdHocPackage implements AssimilatorService
+func (s *AssimilatorServer) GetAdHocPackage(ctx context.Context, req *pb.AdHocPackageRequest) (*pb.AdHocPackageResponse, error) {
+	Info(req.GetMachineName(), " requested an ad-hoc install of ", req.GetPackage())
+	if s.desiredState == nil {
+		Warning("Agent attempted an ad-hoc install, but Server has not loaded the configuration yet")
+		return nil, fmt.Errorf("server has not loaded the configuration yet")
+	}
+	if !s.desiredState.AdHoc.allows(req.GetPackage()) {
+		Warning("Denied an ad-hoc install of ", req.GetPackage(), " for ", req.GetMachineName())
+		return nil, status.Errorf(codes.PermissionDenied, "ad-hoc installs of %s are not allowed", req.GetPackage())
+	}
+	pkgInfo, ok := s.packages[req.GetPackage()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "package %s not found", req.GetPackage())
+	}
+	return &pb.AdHocPackageResponse{
+		Checksum:       pkgInfo.checksum,
+		Version:        toProtoServerVersion(&s.ServerVersion),
+		ConfigRevision: s.configRevision,
+	}, nil
+}
+
 func (s *AssimilatorServer) DownloadPackage(req *assctl.PackageRequest, stream pb.Assimilator_DownloadPackageServer) error {
 	Info("Client requested package: ", req.Name)
 	if s.PackageDir == "" {
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// renderedMachine is a machine's effective config, as render prints it
+type renderedMachine struct {
+	Machine         string                     `yaml:"machine" json:"machine"`
+	Revision        string                     `yaml:"revision,omitempty" json:"revision,omitempty"`
+	Entries         []string                   `yaml:"entries" json:"entries"` // The `machines:` entries merged, least specific first
+	AppliedProfiles []string                   `yaml:"applied_profiles" json:"applied_profiles"`
+	AppliedConfig   string                     `yaml:"applied_config,omitempty" json:"applied_config,omitempty"`
+	Vars            map[string]string          `yaml:"vars,omitempty" json:"vars,omitempty"`
+	Packages        map[string]renderedPackage `yaml:"packages" json:"packages"`
+}
+
+type renderedPackage struct {
+	Steps []renderedStep `yaml:"steps,omitempty" json:"steps,omitempty"`
+	Notes []string       `yaml:"notes,omitempty" json:"notes,omitempty"`
+}
+
+type renderedStep struct {
+	Source      string `yaml:"source" json:"source"`                       // The profile or machine entry it came from
+	Skipped     string `yaml:"skipped,omitempty" json:"skipped,omitempty"` // Why the step isn't served, if its when: is false
+	PackageStep `yaml:",inline"`
+}
+
+// renderMachine annotates a merged machine config with where each step came from
+func renderMachine(machineName string, machine MachineConfig) renderedMachine {
+	rendered := renderedMachine{
+		Machine:         machineName,
+		Entries:         machine.entries,
+		AppliedProfiles: machine.AppliedProfiles,
+		AppliedConfig:   machine.AppliedConfig,
+		Vars:            redactVars(machine.vars),
+		Packages:        make(map[string]renderedPackage),
+	}
+	for pkgName, pkgSteps := range machine.Packages {
+		var pkg renderedPackage
+		for i, step := range pkgSteps {
+			source := "unknown"
+			if sources := machine.merge.stepSources[pkgName]; i < len(sources) {
+				source = sources[i]
+			}
+			pkg.Steps = append(pkg.Steps, renderedStep{Source: source, PackageStep: step})
+		}
+		pkg.Notes = machine.merge.notes[pkgName]
+		rendered.Packages[pkgName] = pkg
+	}
+	// Excluded packages are listed too, so it's clear where they went
+	for pkgName, notes := range machine.merge.notes {
+		if _, ok := rendered.Packages[pkgName]; !ok {
+			rendered.Packages[pkgName] = renderedPackage{Notes: notes}
+		}
+	}
+	return rendered
+}
+
+// renderMachineConfig merges a machine's config for its facts and renders its
+// arguments and conditions as the server would serve them
+func renderMachineConfig(desiredState *DesiredState, machineName string, revision string, facts map[string][]string) (renderedMachine, error) {
+	machine, ok := desiredState.machineConfigFor(machineName, facts)
+	if !ok {
+		return renderedMachine{}, fmt.Errorf("no config applies to %s", machineName)
+	}
+	// Conditions come first, as on the server, so only the steps it would
+	// serve have their arguments rendered
+	applied, skipped, err := applyWhen(machine.Packages, machine.vars, facts)
+	if err != nil {
+		return renderedMachine{}, fmt.Errorf("error evaluating the step conditions: %w", err)
+	}
+	// Without a ref there's no commit to serve, so {{ .commit }} is empty
+	applied, err = renderArguments(applied, templateData(machine.vars, machineName, revision, facts))
+	if err != nil {
+		return renderedMachine{}, fmt.Errorf("error rendering the arguments: %w", err)
+	}
+
+	// Skipped steps are still shown as written, marked with why they don't apply
+	skippedAt := make(map[string]map[int]string)
+	for _, step := range skipped {
+		if skippedAt[step.Package] == nil {
+			skippedAt[step.Package] = make(map[int]string)
+		}
+		skippedAt[step.Package][step.Index] = step.Reason
+	}
+	packages := make(map[string][]PackageStep, len(machine.Packages))
+	for pkgName, pkgSteps := range machine.Packages {
+		steps := slices.Clone(pkgSteps)
+		next := 0
+		for i := range steps {
+			if _, ok := skippedAt[pkgName][i]; !ok {
+				steps[i] = applied[pkgName][next]
+				next++
+			}
+		}
+		packages[pkgName] = steps
+	}
+	machine.Packages = redactPackages(packages)
+	rendered := renderMachine(machineName, machine)
+	rendered.Revision = revision
+	for pkgName, reasons := range skippedAt {
+		for i, reason := range reasons {
+			rendered.Packages[pkgName].Steps[i].Skipped = reason
+		}
+	}
+	return rendered, nil
+}
+
+// renderCommand implements `assimilator render`, which prints a machine's
+// effective config after profiles and machine entries are merged
+func renderCommand(args []string) int {
+	flags := newCommandFlags("render", "<machine>")
+	configPath := flags.String("config", defaultConfigPath(), "The config.yaml to read")
+	ref := flags.String("ref", "", "Read config.yaml from this git ref (a branch, tag or commit) instead of the checkout")
+	repoDir := flags.String("repo", "", "The git repository -ref reads from. Defaults to the config's directory")
+	format := flags.String("format", "yaml", "The output format: yaml or json")
+	overrides := factFlags{}
+	flags.Var(overrides, "fact", "Set a fact as name=value, overriding what the host last reported. Repeatable")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*format != "yaml" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+	machineName := flags.Arg(0)
+
+	var desiredState *DesiredState
+	var revision string
+	var err error
+	if *ref == "" {
+		desiredState, err = LoadDesiredState(*configPath)
+	} else {
+		if *repoDir == "" {
+			*repoDir = filepath.Dir(*configPath)
+		}
+		var source gitSource
+		var relPath string
+		relPath, err = filepath.Rel(*repoDir, *configPath)
+		if err == nil {
+			source, revision, err = newGitSource(*repoDir, *ref)
+		}
+		if err == nil {
+			desiredState, err = loadDesiredState(source, filepath.ToSlash(relPath))
+		}
+	}
+	if err != nil {
+		Error("error loading the config: ", err)
+		return 1
+	}
+
+	// Start from the facts the host last reported to this server
+	facts := factValues(newFactStore(filepath.Join(appConfig.StateDir, "facts")).get(machineName))
+	for name, values := range overrides {
+		facts[name] = values
+	}
+	rendered, err := renderMachineConfig(desiredState, machineName, revision, facts)
+	if err != nil {
+		Error(err)
+		return 1
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(rendered)
+	} else {
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		err = encoder.Encode(rendered)
+	}
+	if err != nil {
+		Error("error printing the config: ", err)
+		return 1
+	}
+	return 0
+}
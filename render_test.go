@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRenderMachineConfig(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+vars:
+  domain: example.com
+profiles:
+  base:
+    vars:
+      channel: stable
+    packages:
+      vim: [{action: install}]
+      nano: [{action: install}]
+machines:
+  web*:
+    applied_profiles: [base]
+    packages:
+      nginx:
+        - action: install
+          arguments: ["--server-name={{ .hostname }}.{{ .vars.domain }}", "--channel={{ .vars.channel }}"]
+        - action: configure
+          when: distro == "fedora"
+  web01:
+    exclude_packages: [nano]
+    vars:
+      channel: beta
+`})
+	desiredState, err := LoadDesiredState(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := renderMachineConfig(desiredState, "web01", "abc123", map[string][]string{"distro": {"debian"}})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+
+	if rendered.Revision != "abc123" || !slices.Equal(rendered.Entries, []string{"web*", "web01"}) || !slices.Equal(rendered.AppliedProfiles, []string{"base"}) {
+		t.Errorf("Expected web01's entries and profiles at abc123, but got %+v", rendered)
+	}
+	if rendered.Vars["channel"] != "beta" || rendered.Vars["domain"] != "example.com" {
+		t.Errorf("Expected the merged vars, but got %v", rendered.Vars)
+	}
+	nginx := rendered.Packages["nginx"].Steps
+	if len(nginx) != 2 {
+		t.Fatalf("Expected both nginx steps, the skipped one too, but got %+v", nginx)
+	}
+	if expected := []string{"--server-name=web01.example.com", "--channel=beta"}; !slices.Equal(nginx[0].Arguments, expected) {
+		t.Errorf("Expected arguments %v, but got %v", expected, nginx[0].Arguments)
+	}
+	if nginx[0].Source != "machine web*" || nginx[0].Skipped != "" {
+		t.Errorf("Expected the install step from web* to apply, but got %+v", nginx[0])
+	}
+	if !strings.Contains(nginx[1].Skipped, "distro") {
+		t.Errorf("Expected the configure step to be skipped because of the distro, but got %q", nginx[1].Skipped)
+	}
+	if vim := rendered.Packages["vim"].Steps; len(vim) != 1 || vim[0].Source != "profile base" {
+		t.Errorf("Expected vim from the base profile, but got %+v", vim)
+	}
+	if nano := rendered.Packages["nano"]; len(nano.Steps) != 0 || !slices.Equal(nano.Notes, []string{"excluded by machine web01"}) {
+		t.Errorf("Expected nano to be listed as excluded, but got %+v", nano)
+	}
+
+	if _, err := renderMachineConfig(desiredState, "db01", "", nil); err == nil || !strings.Contains(err.Error(), "no config applies to db01") {
+		t.Errorf("Expected no config for db01, but got: %v", err)
+	}
+}
+
+func TestRenderAtGitRef(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{
+		"config.yaml":      "include: [extra/*.yaml]\nmachines:\n  web01:\n    packages:\n      vim: [{action: install}]\n",
+		"extra/nginx.yaml": "machines:\n  web02: {}\n",
+		"machines/db.yaml": "db01: {}\n",
+	})
+	repoDir := filepath.Dir(configPath)
+	git := func(args ...string) string { return runGit(t, repoDir, args...) }
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	git("tag", "v1")
+	firstCommit := git("rev-parse", "HEAD")
+	// Later changes, committed and not, aren't in v1
+	os.WriteFile(configPath, []byte("machines:\n  web01:\n    packages:\n      emacs: [{action: install}]\n"), 0644)
+	git("commit", "-q", "-am", "second")
+	os.WriteFile(configPath, []byte("machines: [not valid"), 0644)
+
+	source, revision, err := newGitSource(repoDir, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desiredState, err := loadDesiredState(source, "config.yaml")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	rendered, err := renderMachineConfig(desiredState, "web01", revision, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revision != firstCommit || rendered.Revision != firstCommit {
+		t.Errorf("Expected revision %s, but got %s", firstCommit, rendered.Revision)
+	}
+	if _, ok := rendered.Packages["vim"]; !ok || len(rendered.Packages) != 1 {
+		t.Errorf("Expected only v1's vim, but got %v", rendered.Packages)
+	}
+	for _, machineName := range []string{"web02", "db01"} {
+		if _, ok := desiredState.Machines[machineName]; !ok {
+			t.Errorf("Expected %s from v1's included files", machineName)
+		}
+	}
+
+	if _, _, err := newGitSource(repoDir, "v2"); err == nil {
+		t.Errorf("Expected an unknown ref to fail")
+	}
+}
+
+func TestRenderEvaluatesConditionsFirst(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+machines:
+  web01:
+    packages:
+      nginx:
+        - action: install
+          arguments: ["--distro={{ .facts.distro }}"]
+        - action: tune
+          arguments: ["--arch={{ .facts.arch }}"]
+          when: distro == "fedora"
+`})
+	desiredState, err := LoadDesiredState(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// arch isn't reported, but the server never renders the skipped step that uses it
+	rendered, err := renderMachineConfig(desiredState, "web01", "", map[string][]string{"distro": {"debian"}})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	nginx := rendered.Packages["nginx"].Steps
+	if len(nginx) != 2 {
+		t.Fatalf("Expected both nginx steps, but got %+v", nginx)
+	}
+	if expected := []string{"--distro=debian"}; !slices.Equal(nginx[0].Arguments, expected) || nginx[0].Skipped != "" {
+		t.Errorf("Expected the install step rendered with %v, but got %+v", expected, nginx[0])
+	}
+	if expected := []string{"--arch={{ .facts.arch }}"}; !slices.Equal(nginx[1].Arguments, expected) || nginx[1].Skipped == "" {
+		t.Errorf("Expected the skipped tune step as written, but got %+v", nginx[1])
+	}
+
+	if _, err := renderMachineConfig(desiredState, "web01", "", map[string][]string{"distro": {"fedora"}}); err == nil || !strings.Contains(err.Error(), "error rendering the arguments") {
+		t.Errorf("Expected the applied tune step to fail to render without arch, but got: %v", err)
+	}
+}
+
+func TestRenderWithoutFacts(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+machines:
+  web01:
+    packages:
+      nginx:
+        - action: install
+        - action: tune
+          when: virtualization == "kvm"
+`})
+	desiredState, err := LoadDesiredState(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing stored for the host and no -fact flags
+	rendered, err := renderMachineConfig(desiredState, "web01", "", nil)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	nginx := rendered.Packages["nginx"].Steps
+	if len(nginx) != 2 || nginx[0].Skipped != "" {
+		t.Fatalf("Expected the install step to apply, but got %+v", nginx)
+	}
+	if expected := `when virtualization == "kvm" is false (virtualization has no value for this machine)`; nginx[1].Skipped != expected {
+		t.Errorf("Expected the tune step skipped with %q, but got %q", expected, nginx[1].Skipped)
+	}
+}
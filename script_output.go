@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scriptOutput collects the output of a single script run. Every line is
+// logged as soon as it is written and copied into the run's log file.
+type scriptOutput struct {
+	mu       sync.Mutex
+	tag      string       // package and action, e.g. "vim/install"
+	combined bytes.Buffer // stdout and stderr interleaved, used for failure reports
+	logFile  *os.File     // the per-run log file, nil if it couldn't be created
+	logPath  string
+}
+
+// scriptStream is the io.Writer for one of the script's streams (stdout or stderr)
+type scriptStream struct {
+	output  *scriptOutput
+	name    string
+	partial []byte // an unfinished line waiting for its newline
+}
+
+// newScriptOutput opens a new per-run log file under the package's cache dir
+// and removes the oldest ones beyond appConfig.ScriptLogRetention. Each user
+// and script gets its own directory, logs/<user>/<script>, since usernames
+// and actions can both contain underscores.
+func (p *packageInfo) newScriptOutput(script string) *scriptOutput {
+	output := &scriptOutput{tag: p.name + "/" + script}
+
+	logDir := filepath.Join(p.cacheDir, "logs", p.runAsUser, script)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		Error("failed to create script log directory: ", err)
+		return output
+	}
+	output.logPath = filepath.Join(logDir, time.Now().UTC().Format("20060102T150405.000Z")+".log")
+	logFile, err := os.OpenFile(output.logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		Error("failed to create script log file: ", err)
+		output.logPath = ""
+		return output
+	}
+	output.logFile = logFile
+	pruneScriptLogs(logDir, appConfig.ScriptLogRetention)
+	return output
+}
+
+// stream returns a writer that tags each line with the stream's name
+func (o *scriptOutput) stream(name string) *scriptStream {
+	return &scriptStream{output: o, name: name}
+}
+
+func (o *scriptOutput) line(stream string, line string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.combined.WriteString(line)
+	o.combined.WriteByte('\n')
+	if o.logFile != nil {
+		fmt.Fprintf(o.logFile, "%s [%s] %s\n", time.Now().Format(time.RFC3339), stream, line)
+	}
+	Info("[", o.tag, ":", stream, "] ", line)
+}
+
+// String returns everything the script has written so far
+func (o *scriptOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.combined.String()
+}
+
+// Close writes the script's result to the log file and closes it
+func (o *scriptOutput) Close(status string, duration time.Duration) {
+	if o.logFile == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(o.logFile, "%s [assimilator] finished with status %s after %s\n", time.Now().Format(time.RFC3339), status, duration.Round(time.Millisecond))
+	o.logFile.Close()
+	o.logFile = nil
+}
+
+func (s *scriptStream) Write(b []byte) (int, error) {
+	s.partial = append(s.partial, b...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.output.line(s.name, strings.TrimRight(string(s.partial[:i]), "\r"))
+		s.partial = s.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush logs a trailing line that never got its newline
+func (s *scriptStream) Flush() {
+	if len(s.partial) > 0 {
+		s.output.line(s.name, string(s.partial))
+		s.partial = nil
+	}
+}
+
+// pruneScriptLogs keeps only the newest `keep` log files in logDir
+func pruneScriptLogs(logDir string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		Error("failed to read script log directory: ", err)
+		return
+	}
+	var logs []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".log") {
+			logs = append(logs, entry.Name())
+		}
+	}
+	// The timestamps in the names sort chronologically
+	slices.Sort(logs)
+	for len(logs) > keep {
+		Trace("Removing old script log: ", logs[0])
+		if err := os.Remove(filepath.Join(logDir, logs[0])); err != nil {
+			Error("failed to remove old script log: ", err)
+		}
+		logs = logs[1:]
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptStream(t *testing.T) {
+	testCases := []struct {
+		name     string
+		writes   []string
+		expected string
+	}{
+		{name: "Whole lines", writes: []string{"one\ntwo\n"}, expected: "one\ntwo\n"},
+		{name: "Line split across writes", writes: []string{"o", "ne\ntw", "o\n"}, expected: "one\ntwo\n"},
+		{name: "CRLF", writes: []string{"one\r\n"}, expected: "one\n"},
+		{name: "Trailing line without a newline", writes: []string{"one\ntwo"}, expected: "one\ntwo\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output := &scriptOutput{tag: "vim/install"}
+			stream := output.stream("stdout")
+			for _, write := range tc.writes {
+				if n, err := stream.Write([]byte(write)); err != nil || n != len(write) {
+					t.Fatalf("Write returned %d, %v", n, err)
+				}
+			}
+			stream.Flush()
+			if got := output.String(); got != tc.expected {
+				t.Errorf("Expected %q, but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestScriptLogFiles(t *testing.T) {
+	defer func(retention int) { appConfig.ScriptLogRetention = retention }(appConfig.ScriptLogRetention)
+	appConfig.ScriptLogRetention = 2
+	cacheDir := t.TempDir()
+
+	// Usernames and actions may contain underscores, so none of these runs may
+	// prune another's logs
+	runs := []struct{ script, runAsUser string }{
+		{"install", "deploy"},
+		{"install", "deploy_bot"},
+		{"install_extra", "deploy"},
+	}
+	for i := 0; i < 3; i++ {
+		for _, run := range runs {
+			p := &packageInfo{name: "vim", runAsUser: run.runAsUser, cacheDir: cacheDir}
+			output := p.newScriptOutput(run.script)
+			output.stream("stdout").Write([]byte("hello\n"))
+			output.Close(scriptStatusSuccess, time.Second)
+			// The log names have millisecond timestamps
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+
+	for _, run := range runs {
+		logDir := filepath.Join(cacheDir, "logs", run.runAsUser, run.script)
+		entries, err := os.ReadDir(logDir)
+		if err != nil {
+			t.Fatalf("Expected logs in %s, but got: %v", logDir, err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("Expected 2 logs in %s, but got %d", logDir, len(entries))
+		}
+		for _, entry := range entries {
+			content, _ := os.ReadFile(filepath.Join(logDir, entry.Name()))
+			if !strings.Contains(string(content), "[stdout] hello") || !strings.Contains(string(content), "finished with status success") {
+				t.Errorf("Unexpected log content in %s:\n%s", entry.Name(), content)
+			}
+		}
+	}
+}
+
+func TestPruneScriptLogs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		keep     int
+		expected []string
+	}{
+		{name: "Keeps the newest", keep: 2, expected: []string{"20250102T000000.000Z.log", "20250103T000000.000Z.log", "notes.txt"}},
+		{name: "Zero keeps everything", keep: 0, expected: []string{"20250101T000000.000Z.log", "20250102T000000.000Z.log", "20250103T000000.000Z.log", "notes.txt"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logDir := t.TempDir()
+			for _, name := range []string{"20250103T000000.000Z.log", "20250101T000000.000Z.log", "20250102T000000.000Z.log", "notes.txt"} {
+				os.WriteFile(filepath.Join(logDir, name), nil, 0644)
+			}
+			pruneScriptLogs(logDir, tc.keep)
+			entries, _ := os.ReadDir(logDir)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if !slices.Equal(names, tc.expected) {
+				t.Errorf("Expected %v, but got %v", tc.expected, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// Values in the config can be encrypted to the server's age recipient:
+//
+//	arguments: [--token, !secret YWdlLWVuY3J5cHRpb24ub3JnL3Yx...]
+//	env:
+//	  API_KEY: !secret |
+//	    -----BEGIN AGE ENCRYPTED FILE-----
+//	    ...
+//
+// Either base64 or armored age ciphertext works. When the config loads, each
+// secret is replaced with a placeholder, so logs, GetAllConfigs, render and
+// validate never see the plaintext. The server decrypts them with its identity
+// file and only puts the plaintext into the config served to the machine
+// whose steps use it.
+const secretTag = "!secret"
+
+// redactedSecret is what admin views show in place of a secret
+const redactedSecret = "<secret>"
+
+// The placeholder holds the secret's index. Faking one takes a "\0" escape in
+// the config, and only gets at secrets anyone who can edit it could copy anyway.
+var secretPlaceholderPattern = regexp.MustCompile("\x00secret:([0-9]+)\x00")
+
+func secretPlaceholder(index int) string {
+	return fmt.Sprintf("\x00secret:%d\x00", index)
+}
+
+// secretStore holds the config's secrets, by placeholder index
+type secretStore struct {
+	locations   []string // Where each secret is in the config, as file:line:column
+	ciphertexts [][]byte
+	plaintexts  []string // Set once decrypted
+}
+
+// collect replaces every !secret value under node with a placeholder
+func (s *secretStore) collect(node *yaml.Node, file configFile) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == secretTag {
+		location := fmt.Sprintf("%s:%d:%d", file.path, node.Line, node.Column)
+		ciphertext, err := parseCiphertext(node.Value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid secret: %w", location, err)
+		}
+		node.Value = secretPlaceholder(len(s.ciphertexts))
+		node.Tag = "!!str"
+		s.locations = append(s.locations, location)
+		s.ciphertexts = append(s.ciphertexts, ciphertext)
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := s.collect(child, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseCiphertext decodes armored or base64 age ciphertext
+func parseCiphertext(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	var ciphertext []byte
+	var err error
+	if strings.HasPrefix(value, armor.Header) {
+		ciphertext, err = io.ReadAll(armor.NewReader(strings.NewReader(value)))
+	} else {
+		ciphertext, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(ciphertext, []byte("age-encryption.org/")) {
+		return nil, fmt.Errorf("not age ciphertext")
+	}
+	return ciphertext, nil
+}
+
+// decrypt decrypts every secret with the identities in identityPath
+func (s *secretStore) decrypt(identityPath string) error {
+	if len(s.ciphertexts) == 0 {
+		return nil
+	}
+	identityFile, err := os.Open(identityPath)
+	if err != nil {
+		return fmt.Errorf("the config has secrets, but the identity file can't be read: %w", err)
+	}
+	defer identityFile.Close()
+	identities, err := age.ParseIdentities(identityFile)
+	if err != nil {
+		return fmt.Errorf("failed to parse identity file %s: %w", identityPath, err)
+	}
+
+	plaintexts := make([]string, len(s.ciphertexts))
+	for i, ciphertext := range s.ciphertexts {
+		reader, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the secret at %s: %w", s.locations[i], err)
+		}
+		plaintext, err := io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the secret at %s: %w", s.locations[i], err)
+		}
+		plaintexts[i] = string(plaintext)
+	}
+	s.plaintexts = plaintexts
+	Info("Decrypted ", len(plaintexts), " secrets")
+	return nil
+}
+
+// reveal replaces the placeholders in value with the plaintext secrets
+func (s *secretStore) reveal(value string) (string, bool, error) {
+	var revealErr error
+	found := false
+	revealed := secretPlaceholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		found = true
+		index, _ := strconv.Atoi(secretPlaceholderPattern.FindStringSubmatch(placeholder)[1])
+		switch {
+		case index >= len(s.ciphertexts):
+			revealErr = fmt.Errorf("unknown secret %d", index)
+			return ""
+		case index >= len(s.plaintexts):
+			revealErr = fmt.Errorf("the secret at %s hasn't been decrypted", s.locations[index])
+			return ""
+		}
+		return s.plaintexts[index]
+	})
+	return revealed, found, revealErr
+}
+
+// revealPackages returns a copy of packages with their secrets revealed.
+// Steps with secrets are marked so agents keep their arguments out of logs.
+func (s *secretStore) revealPackages(packages map[string][]PackageStep) (map[string][]PackageStep, error) {
+	revealed := make(map[string][]PackageStep, len(packages))
+	for pkgName, pkgSteps := range packages {
+		steps := slices.Clone(pkgSteps)
+		for i := range steps {
+			steps[i].Arguments = slices.Clone(steps[i].Arguments)
+			for j, argument := range steps[i].Arguments {
+				value, found, err := s.reveal(argument)
+				if err != nil {
+					return nil, fmt.Errorf("package %s: %w", pkgName, err)
+				}
+				steps[i].Arguments[j] = value
+				steps[i].hasSecrets = steps[i].hasSecrets || found
+			}
+			steps[i].Env = maps.Clone(steps[i].Env)
+			for key, envValue := range steps[i].Env {
+				value, found, err := s.reveal(envValue)
+				if err != nil {
+					return nil, fmt.Errorf("package %s: %w", pkgName, err)
+				}
+				steps[i].Env[key] = value
+				steps[i].hasSecrets = steps[i].hasSecrets || found
+			}
+		}
+		revealed[pkgName] = steps
+	}
+	return revealed, nil
+}
+
+// redactSecrets replaces the secret placeholders in value for display
+func redactSecrets(value string) string {
+	return secretPlaceholderPattern.ReplaceAllString(value, redactedSecret)
+}
+
+// redactPackages returns a copy of packages that's safe to show
+func redactPackages(packages map[string][]PackageStep) map[string][]PackageStep {
+	redacted := make(map[string][]PackageStep, len(packages))
+	for pkgName, pkgSteps := range packages {
+		steps := slices.Clone(pkgSteps)
+		for i := range steps {
+			steps[i].Arguments = slices.Clone(steps[i].Arguments)
+			for j, argument := range steps[i].Arguments {
+				steps[i].Arguments[j] = redactSecrets(argument)
+			}
+			steps[i].Env = maps.Clone(steps[i].Env)
+			for key, value := range steps[i].Env {
+				steps[i].Env[key] = redactSecrets(value)
+			}
+		}
+		redacted[pkgName] = steps
+	}
+	return redacted
+}
+
+// redactVars returns a copy of vars that's safe to show
+func redactVars(vars map[string]string) map[string]string {
+	redacted := make(map[string]string, len(vars))
+	for name, value := range vars {
+		redacted[name] = redactSecrets(value)
+	}
+	return redacted
+}
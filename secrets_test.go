@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// writeTestIdentity writes a new age identity file into dir and returns its
+// path and recipient
+func writeTestIdentity(t *testing.T, dir string) (string, age.Recipient) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityPath := filepath.Join(dir, "secrets.key")
+	if err := os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return identityPath, identity.Recipient()
+}
+
+// encryptTestSecret returns plaintext encrypted to recipient, in base64
+func encryptTestSecret(t *testing.T, recipient age.Recipient, plaintext string) string {
+	t.Helper()
+	var ciphertext bytes.Buffer
+	writer, err := age.Encrypt(&ciphertext, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext.Bytes())
+}
+
+func TestSecretPlaceholders(t *testing.T) {
+	// --- Arrange ---
+	identityPath, recipient := writeTestIdentity(t, t.TempDir())
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+vars:
+  db_password: !secret ` + encryptTestSecret(t, recipient, "hunter2") + `
+machines:
+  web01:
+    packages:
+      app:
+        - action: install
+          arguments: [--token, !secret ` + encryptTestSecret(t, recipient, "s3cr3t") + `]
+          env:
+            API_KEY: !secret ` + encryptTestSecret(t, recipient, "k3y") + `
+            REGION: eu
+        - action: configure
+`})
+
+	// --- Act ---
+	desiredState, err := LoadDesiredState(configPath)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	steps := desiredState.Machines["web01"].Packages["app"]
+
+	// --- Assert ---
+	// Loading only swaps in placeholders; nothing is decrypted yet
+	if steps[0].Arguments[1] != secretPlaceholder(1) || steps[0].Env["API_KEY"] != secretPlaceholder(2) {
+		t.Fatalf("Expected placeholders, but got %v and %q", steps[0].Arguments, steps[0].Env["API_KEY"])
+	}
+	if desiredState.Vars["db_password"] != secretPlaceholder(0) {
+		t.Errorf("Expected a placeholder for the var, but got %q", desiredState.Vars["db_password"])
+	}
+
+	redacted := redactPackages(desiredState.Machines["web01"].Packages)
+	if got := redacted["app"][0].Arguments[1]; got != redactedSecret {
+		t.Errorf("Expected %q, but got %q", redactedSecret, got)
+	}
+	if got := redacted["app"][0].Env; got["API_KEY"] != redactedSecret || got["REGION"] != "eu" {
+		t.Errorf("Expected only the secret env to be redacted, but got %v", got)
+	}
+	if steps[0].Arguments[1] != secretPlaceholder(1) {
+		t.Errorf("Expected redacting to leave the config's own steps alone, but got %v", steps[0].Arguments)
+	}
+	if got := redactVars(desiredState.Vars); got["db_password"] != redactedSecret {
+		t.Errorf("Expected %q, but got %q", redactedSecret, got["db_password"])
+	}
+
+	if _, err := desiredState.secrets.revealPackages(desiredState.Machines["web01"].Packages); err == nil || !strings.Contains(err.Error(), "hasn't been decrypted") {
+		t.Errorf("Expected an error revealing secrets before decrypting, but got: %v", err)
+	}
+	if err := desiredState.secrets.decrypt(identityPath); err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	revealed, err := desiredState.secrets.revealPackages(desiredState.Machines["web01"].Packages)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	if got := revealed["app"][0]; got.Arguments[1] != "s3cr3t" || got.Env["API_KEY"] != "k3y" || !got.hasSecrets {
+		t.Errorf("Expected the revealed step with hasSecrets, but got %+v", got)
+	}
+	if revealed["app"][1].hasSecrets {
+		t.Errorf("Expected the step without secrets not to be marked")
+	}
+	if steps[0].Arguments[1] != secretPlaceholder(1) {
+		t.Errorf("Expected revealing to leave the config's own steps alone, but got %v", steps[0].Arguments)
+	}
+}
+
+func TestSecretReveal(t *testing.T) {
+	secrets := &secretStore{
+		locations:   []string{"config.yaml:3:5", "config.yaml:4:5"},
+		ciphertexts: [][]byte{[]byte("a"), []byte("b")},
+		plaintexts:  []string{"one", "two"},
+	}
+	testCases := []struct {
+		name          string
+		value         string
+		expected      string
+		expectedFound bool
+		expectErr     string
+	}{
+		{name: "No secrets", value: "plain", expected: "plain"},
+		{name: "Whole value", value: secretPlaceholder(1), expected: "two", expectedFound: true},
+		{name: "Inside a value", value: "--token=" + secretPlaceholder(0) + "," + secretPlaceholder(1), expected: "--token=one,two", expectedFound: true},
+		{name: "Unknown secret", value: secretPlaceholder(2), expectedFound: true, expectErr: "unknown secret 2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, found, err := secrets.reveal(tc.value)
+			if tc.expectErr != "" {
+				if err == nil || err.Error() != tc.expectErr {
+					t.Errorf("Expected error %q, but got: %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if got != tc.expected || found != tc.expectedFound {
+				t.Errorf("Expected %q (found %v), but got %q (found %v)", tc.expected, tc.expectedFound, got, found)
+			}
+		})
+	}
+}
+
+func TestInvalidSecret(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+vars:
+  token: !secret bm90IGFnZQ==
+`})
+	_, err := LoadDesiredState(configPath)
+	if err == nil || !strings.Contains(err.Error(), "config.yaml:3:10: invalid secret: not age ciphertext") {
+		t.Errorf("Expected an invalid secret error with its location, but got: %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	asslog "github.com/geogian28/Assimilator/assimilator_logger"
+	pb "github.com/geogian28/Assimilator/proto"
+	"github.com/hashicorp/go-version"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Self-updates are signed with an ed25519 key pair in PEM form, e.g.:
+//
+//	openssl genpkey -algorithm ed25519 -out update.key
+//	openssl pkey -in update.key -pubout -out update.pub
+//
+// The server keeps update.key and every agent gets update.pub.
+
+const selfUpdateTimeout = 10 * time.Minute
+
+var validPlatform = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// DownloadAgentBinary implements AssimilatorService. It streams the agent build
+// for the requested platform with its checksum and signature in the first chunk.
+// Builds are signed with the server's version, which the server can't check
+// for other platforms' builds, so agents also check the version the build
+// itself reports before switching to it.
+func (s *AssimilatorServer) DownloadAgentBinary(req *pb.AgentBinaryRequest, stream pb.Assimilator_DownloadAgentBinaryServer) error {
+	Info("Agent requested the agent binary for ", req.GetOs(), "/", req.GetArch())
+	binaryPath, err := agentBinaryPath(req.GetOs(), req.GetArch())
+	if err != nil {
+		Warning("Unable to serve the agent binary: ", err)
+		return status.Errorf(codes.NotFound, "%v", err)
+	}
+	signingKey, err := loadUpdateSigningKey(appConfig.UpdateSigningKey)
+	if err != nil {
+		Error("Unable to sign the agent binary: ", err)
+		return status.Errorf(codes.FailedPrecondition, "the server cannot sign agent binaries: %v", err)
+	}
+
+	binary, err := os.ReadFile(binaryPath)
+	if err != nil {
+		Error("Failed to read the agent binary: ", err)
+		return status.Errorf(codes.Internal, "failed to read the agent binary")
+	}
+	digest := sha256.Sum256(binary)
+	first := &pb.AgentBinaryResponse{
+		TotalSize: int64(len(binary)),
+		Version:   s.ServerVersion.Version,
+		Checksum:  hex.EncodeToString(digest[:]),
+		Signature: ed25519.Sign(signingKey, updateSignedMessage(s.ServerVersion.Version, req.GetOs(), req.GetArch(), digest[:])),
+	}
+
+	// Stream the binary in 32KB chunks, like DownloadPackage
+	const chunkSize = 32 * 1024
+	for offset := 0; offset < len(binary) || offset == 0; offset += chunkSize {
+		resp := &pb.AgentBinaryResponse{}
+		if offset == 0 {
+			resp = first
+		}
+		resp.Content = binary[offset:min(offset+chunkSize, len(binary))]
+		if err := stream.Send(resp); err != nil {
+			return status.Errorf(codes.Internal, "failed to send chunk: %v", err)
+		}
+	}
+	Info("Successfully sent the agent binary for ", req.GetOs(), "/", req.GetArch())
+	return nil
+}
+
+// agentBinaryPath finds the agent build for a platform. Builds for other
+// platforms live in appConfig.AgentBinaryDir; the server's own platform falls
+// back to the running binary.
+func agentBinaryPath(goos string, goarch string) (string, error) {
+	if !validPlatform.MatchString(goos) || !validPlatform.MatchString(goarch) {
+		return "", fmt.Errorf("invalid platform %q/%q", goos, goarch)
+	}
+	binaryPath := filepath.Join(appConfig.AgentBinaryDir, "assimilator-"+goos+"-"+goarch)
+	if fileExists(binaryPath) {
+		return binaryPath, nil
+	}
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return os.Executable()
+	}
+	return "", fmt.Errorf("no agent binary for %s/%s in %s", goos, goarch, appConfig.AgentBinaryDir)
+}
+
+// updateSignedMessage is what an agent build's signature covers. Signing the
+// version and platform with the digest stops a validly signed old or foreign
+// build from being served as a newer one.
+func updateSignedMessage(agentVersion string, goos string, goarch string, digest []byte) []byte {
+	message := fmt.Appendf(nil, "assimilator-agent\x00%s\x00%s/%s\x00", agentVersion, goos, goarch)
+	return append(message, digest...)
+}
+
+func loadUpdateSigningKey(keyPath string) (ed25519.PrivateKey, error) {
+	der, err := readPEMFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", keyPath, err)
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", keyPath)
+	}
+	return signingKey, nil
+}
+
+func loadUpdatePublicKey(keyPath string) (ed25519.PublicKey, error) {
+	der, err := readPEMFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", keyPath, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", keyPath)
+	}
+	return publicKey, nil
+}
+
+func readPEMFile(filePath string) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", filePath)
+	}
+	return block.Bytes, nil
+}
+
+// selfUpdateTarget returns the key updates are verified with and the binary
+// they replace, or why this agent can't update itself
+func (a *AgentData) selfUpdateTarget() (ed25519.PublicKey, string, error) {
+	publicKey, err := loadUpdatePublicKey(a.appConfig.UpdatePublicKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot verify updates: %w", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to find the agent binary: %w", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve the agent binary: %w", err)
+	}
+	// The update is downloaded next to the binary, e.g. /usr/bin, which
+	// unprivileged agents can't write to
+	if err := unix.Access(filepath.Dir(executable), unix.W_OK); err != nil {
+		return nil, "", fmt.Errorf("cannot replace %s: %w", executable, err)
+	}
+	return publicKey, executable, nil
+}
+
+// selfUpdate downloads the server's agent build, verifies its checksum and
+// signature, and replaces executable with it. If it fails, executable is
+// left as it was.
+func (a *AgentData) selfUpdate(ctx context.Context, currentVersion *version.Version, publicKey ed25519.PublicKey, executable string) error {
+	ctx, cancel := context.WithTimeout(ctx, selfUpdateTimeout)
+	defer cancel()
+	stream, err := a.client.DownloadAgentBinary(ctx, &pb.AgentBinaryRequest{Os: runtime.GOOS, Arch: runtime.GOARCH})
+	if err != nil {
+		return fmt.Errorf("failed to start download stream: %w", err)
+	}
+
+	// Download next to the binary so the rename below is atomic
+	tempFile, err := os.CreateTemp(filepath.Dir(executable), ".assimilator-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create the update file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	var header *pb.AgentBinaryResponse
+	hash := sha256.New()
+	writer := io.MultiWriter(tempFile, hash)
+	var bytesReceived int64
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("stream error while downloading the agent binary: %w", err)
+		}
+		if header == nil {
+			header = chunk
+		}
+		n, err := writer.Write(chunk.GetContent())
+		if err != nil {
+			return fmt.Errorf("failed to write the update file: %w", err)
+		}
+		bytesReceived += int64(n)
+	}
+	if header == nil {
+		return errors.New("the server sent an empty agent binary")
+	}
+
+	// Verify what was downloaded before it can replace anything
+	newVersion, err := version.NewVersion(header.GetVersion())
+	if err != nil {
+		return fmt.Errorf("the server sent an invalid agent version %q: %w", header.GetVersion(), err)
+	}
+	if !currentVersion.LessThan(newVersion) {
+		return fmt.Errorf("the server's agent binary (%s) is not newer than this agent (%s)", newVersion, currentVersion)
+	}
+	if bytesReceived != header.GetTotalSize() {
+		return fmt.Errorf("received %d bytes of the agent binary, expected %d", bytesReceived, header.GetTotalSize())
+	}
+	digest := hash.Sum(nil)
+	if hex.EncodeToString(digest) != header.GetChecksum() {
+		return fmt.Errorf("the agent binary's checksum doesn't match: got %x, expected %s", digest, header.GetChecksum())
+	}
+	if !ed25519.Verify(publicKey, updateSignedMessage(header.GetVersion(), runtime.GOOS, runtime.GOARCH, digest), header.GetSignature()) {
+		return errors.New("the agent binary's signature is invalid")
+	}
+
+	if err := tempFile.Chmod(0755); err != nil {
+		return fmt.Errorf("failed to make the update executable: %w", err)
+	}
+	if err := tempFile.Sync(); err != nil {
+		return fmt.Errorf("failed to write the update file: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write the update file: %w", err)
+	}
+	// A stale build would otherwise be installed as the new version, and the
+	// agent would update again on every check
+	builtVersion, err := binaryVersion(ctx, tempFile.Name())
+	if err != nil {
+		return err
+	}
+	if !builtVersion.Equal(newVersion) {
+		return fmt.Errorf("the server's agent binary reports version %s, not %s", builtVersion, newVersion)
+	}
+	if err := os.Rename(tempFile.Name(), executable); err != nil {
+		return fmt.Errorf("failed to replace the agent binary: %w", err)
+	}
+
+	Success("Updated the agent from ", currentVersion, " to ", newVersion, ". Restarting...")
+	return nil
+}
+
+// binaryVersion runs an agent binary with -version and returns the version it reports
+func binaryVersion(ctx context.Context, binaryPath string) (*version.Version, error) {
+	output, err := exec.CommandContext(ctx, binaryPath, "-version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the downloaded agent binary: %w", err)
+	}
+	for line := range strings.Lines(string(output)) {
+		if value, ok := strings.CutPrefix(line, "Version:"); ok {
+			builtVersion, err := version.NewVersion(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("the downloaded agent binary reports an invalid version: %w", err)
+			}
+			return builtVersion, nil
+		}
+	}
+	return nil, errors.New("the downloaded agent binary doesn't report its version")
+}
+
+// exitToUpdate exits so the launcher, or the service manager after a distro
+// package upgrade, starts the new version
+func exitToUpdate() {
+	asslog.Flush()
+	os.Exit(0)
+}
+
+// restartAgent re-executes the updated binary in place of this process
+func restartAgent(executable string) {
+	asslog.Flush()
+	err := syscall.Exec(executable, os.Args, os.Environ())
+	// The logger is already flushed, so the error can only go to stderr. The
+	// new binary is in place, so exiting lets the service manager start it.
+	fmt.Fprintln(os.Stderr, "failed to re-execute the updated agent:", err)
+	os.Exit(1)
+}
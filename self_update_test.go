@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"github.com/hashicorp/go-version"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// writeUpdateKeys writes a new update.key and update.pub into dir
+func writeUpdateKeys(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	publicKey, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, pubPath := filepath.Join(dir, "update.key"), filepath.Join(dir, "update.pub")
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+	return keyPath, pubPath
+}
+
+// startTestServer serves s in memory and returns a client for it
+func startTestServer(t *testing.T, s *AssimilatorServer) pb.AssimilatorClient {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	pb.RegisterAssimilatorServer(server, s)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewAssimilatorClient(conn)
+}
+
+func TestUpdateSignedMessage(t *testing.T) {
+	publicKey, signingKey, _ := ed25519.GenerateKey(nil)
+	digest := []byte("0123456789abcdef0123456789abcdef")
+	signature := ed25519.Sign(signingKey, updateSignedMessage("2.0.0", "linux", "amd64", digest))
+
+	testCases := []struct {
+		name     string
+		message  []byte
+		expected bool
+	}{
+		{name: "Same build", message: updateSignedMessage("2.0.0", "linux", "amd64", digest), expected: true},
+		{name: "Relabeled version", message: updateSignedMessage("3.0.0", "linux", "amd64", digest), expected: false},
+		{name: "Other platform", message: updateSignedMessage("2.0.0", "linux", "arm64", digest), expected: false},
+		{name: "Digest alone", message: digest, expected: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ed25519.Verify(publicKey, tc.message, signature); got != tc.expected {
+				t.Errorf("Expected %v, but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSelfUpdateTarget(t *testing.T) {
+	_, pubPath := writeUpdateKeys(t, t.TempDir())
+
+	a := &AgentData{appConfig: &AppConfig{UpdatePublicKey: filepath.Join(t.TempDir(), "update.pub")}}
+	if _, _, err := a.selfUpdateTarget(); err == nil || !strings.Contains(err.Error(), "cannot verify updates") {
+		t.Errorf("Expected a missing key to rule out self-updates, but got: %v", err)
+	}
+
+	a.appConfig.UpdatePublicKey = pubPath
+	publicKey, executable, err := a.selfUpdateTarget()
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	if publicKey == nil || executable == "" {
+		t.Errorf("Expected the key and the test binary, but got %v and %q", publicKey, executable)
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	defer func(binaryDir, signingKey string) {
+		appConfig.AgentBinaryDir, appConfig.UpdateSigningKey = binaryDir, signingKey
+	}(appConfig.AgentBinaryDir, appConfig.UpdateSigningKey)
+
+	testCases := []struct {
+		name          string
+		serverVersion string
+		builtVersion  string // What the build reports with -version, if anything
+		otherKey      bool   // The agent trusts a different key than the server signs with
+		expectErr     string
+	}{
+		{name: "Newer build", serverVersion: "2.0.0", builtVersion: "2.0.0"},
+		{name: "Same version", serverVersion: "1.0.0", builtVersion: "1.0.0", expectErr: "not newer"},
+		{name: "Untrusted signature", serverVersion: "2.0.0", builtVersion: "2.0.0", otherKey: true, expectErr: "signature is invalid"},
+		{name: "Stale build", serverVersion: "2.0.0", builtVersion: "1.0.0", expectErr: "reports version 1.0.0, not 2.0.0"},
+		{name: "Build without a version", serverVersion: "2.0.0", expectErr: "doesn't report its version"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			keyPath, pubPath := writeUpdateKeys(t, t.TempDir())
+			if tc.otherKey {
+				_, pubPath = writeUpdateKeys(t, t.TempDir())
+			}
+			appConfig.UpdateSigningKey = keyPath
+			appConfig.AgentBinaryDir = t.TempDir()
+			newBuild := "#!/bin/sh\n# new build\n"
+			if tc.builtVersion != "" {
+				newBuild += "echo 'Version:  " + tc.builtVersion + "'\n"
+			}
+			os.WriteFile(filepath.Join(appConfig.AgentBinaryDir, "assimilator-"+runtime.GOOS+"-"+runtime.GOARCH), []byte(newBuild), 0755)
+			executable := filepath.Join(t.TempDir(), "assimilator")
+			os.WriteFile(executable, []byte("old build"), 0755)
+			publicKey, err := loadUpdatePublicKey(pubPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &AgentData{client: startTestServer(t, &AssimilatorServer{ServerVersion: ServerVersion{Version: tc.serverVersion}})}
+
+			// --- Act ---
+			err = a.selfUpdate(context.Background(), version.Must(version.NewVersion("1.0.0")), publicKey, executable)
+
+			// --- Assert ---
+			binary, _ := os.ReadFile(executable)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Errorf("Expected an error containing %q, but got: %v", tc.expectErr, err)
+				}
+				if string(binary) != "old build" {
+					t.Errorf("Expected the binary to be left alone, but got %q", binary)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if string(binary) != newBuild {
+				t.Errorf("Expected the binary to be replaced, but got %q", binary)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -28,9 +29,11 @@ import (
 type AssimilatorServer struct {
 	pb.UnimplementedAssimilatorServer
 	ServerVersion
-	PackageDir   string
-	desiredState *DesiredState
-	packages     map[string]*packageInfo
+	PackageDir     string
+	configRevision string // The commit of the config repository that was loaded
+	desiredState   *DesiredState
+	packages       map[string]*packageInfo
+	facts          *factStore // The latest facts reported by each agent
 }
 
 type ServerVersion struct {
@@ -249,6 +252,21 @@ func isUpdateAvailable(repoDir string) (bool, error) {
 	return false, nil
 }
 
+// repoRevision returns the commit hash of the repository's HEAD, or "" if it can't be read
+func repoRevision(repoDir string) string {
+	r, err := git.PlainOpen(repoDir)
+	if err != nil {
+		Error("error opening local repo: ", err)
+		return ""
+	}
+	head, err := r.Head()
+	if err != nil {
+		Error("error getting local repo HEAD: ", err)
+		return ""
+	}
+	return head.Hash().String()
+}
+
 // Start the server
 func Server() {
 	// Clone or pull the remote repository to the local one
@@ -265,6 +283,9 @@ func Server() {
 	if err != nil {
 		asslog.Unhandled("unable to load desired state: ", err)
 	}
+	if err := desiredState.secrets.decrypt(appConfig.SecretsIdentity); err != nil {
+		asslog.Unhandled("unable to decrypt the config's secrets: ", err)
+	}
 
 	// Make packages for machine and sync them with the desired state
 	packages, err := makePackages()
@@ -288,9 +309,11 @@ func Server() {
 			Commit:    appConfig.commit,
 			BuildDate: appConfig.buildDate,
 		},
-		PackageDir:   "/var/cache/assimilator/packages",
-		desiredState: desiredState,
-		packages:     packages,
+		PackageDir:     "/var/cache/assimilator/packages",
+		configRevision: repoRevision(repoDir),
+		desiredState:   desiredState,
+		packages:       packages,
+		facts:          newFactStore(filepath.Join(appConfig.StateDir, "facts")),
 	})
 	Info("Server listening on at ", lis.Addr())
 
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// factStore keeps the latest facts each agent reported. They're written to
+// disk so they survive the server restarting on a config change.
+type factStore struct {
+	mu    sync.Mutex
+	dir   string
+	facts map[string]*pb.Facts
+}
+
+// newFactStore loads the facts saved in dir
+func newFactStore(dir string) *factStore {
+	store := &factStore{dir: dir, facts: make(map[string]*pb.Facts)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Error("failed to read facts directory: ", err)
+		}
+		return store
+	}
+	for _, entry := range entries {
+		machineName, ok := cutJSONSuffix(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			Error("failed to read facts for ", machineName, ": ", err)
+			continue
+		}
+		facts := &pb.Facts{}
+		if err := protojson.Unmarshal(data, facts); err != nil {
+			Error("failed to parse facts for ", machineName, ": ", err)
+			continue
+		}
+		store.facts[machineName] = facts
+	}
+	Debug("Loaded facts for ", len(store.facts), " machines")
+	return store
+}
+
+func cutJSONSuffix(name string) (string, bool) {
+	if filepath.Ext(name) != ".json" {
+		return "", false
+	}
+	return name[:len(name)-len(".json")], true
+}
+
+// record stores the facts an agent reported for machineName
+func (f *factStore) record(machineName string, facts *pb.Facts) error {
+	if machineName == "" || machineName != filepath.Base(machineName) || machineName[0] == '.' {
+		return fmt.Errorf("invalid machine name %q", machineName)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.facts[machineName] = facts
+
+	data, err := protojson.MarshalOptions{Multiline: true}.Marshal(facts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal facts: %w", err)
+	}
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create facts directory: %w", err)
+	}
+	path := filepath.Join(f.dir, machineName+".json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write facts: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to replace facts: %w", err)
+	}
+	return nil
+}
+
+// get returns the last facts reported for machineName, or nil
+func (f *factStore) get(machineName string) *pb.Facts {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.facts[machineName]
+}
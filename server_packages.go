@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 
 	asslog "github.com/geogian28/Assimilator/assimilator_logger"
 )
@@ -49,7 +50,7 @@ func createPackageInfo(sourceDir string, cacheDir string) (map[string]*packageIn
 
 	packages := make(map[string]*packageInfo)
 	for _, entry := range entries {
-		if !entry.IsDir() {
+		if !entry.IsDir() || isConfigDir(entry.Name()) {
 			continue
 		}
 
@@ -209,6 +210,21 @@ func (p *packageInfo) makeTempFilesPermanent() error {
 	return nil
 }
 
+// withChecksums returns a copy of packages with each package's checksum set
+// on its first step, where toProtoPackageConfigMap reads it. Configs merged at
+// request time need it since syncChecksums only covers the loaded entries.
+func withChecksums(packages map[string][]PackageStep, packagesMap map[string]*packageInfo) map[string][]PackageStep {
+	synced := make(map[string][]PackageStep, len(packages))
+	for pkgName, pkgSteps := range packages {
+		pkgSteps = slices.Clone(pkgSteps)
+		if info, ok := packagesMap[pkgName]; ok && len(pkgSteps) > 0 {
+			pkgSteps[0].Checksum = info.checksum
+		}
+		synced[pkgName] = pkgSteps
+	}
+	return synced
+}
+
 func syncChecksums(desiredState *DesiredState, packagesMap map[string]*packageInfo) {
 	Info("Syncing calculated checksums to DesiredState...")
 
@@ -232,4 +248,14 @@ func syncChecksums(desiredState *DesiredState, packagesMap map[string]*packageIn
 			}
 		}
 	}
+	// 2. Sync Profile Packages, which fact profiles merge in at request time
+	for profileName, profileConfig := range desiredState.Profiles {
+		for pkgName, pkgConfig := range profileConfig.Packages {
+			if info, ok := packagesMap[pkgName]; ok && len(pkgConfig) > 0 {
+				pkgConfig[0].Checksum = info.checksum
+			} else {
+				Warning("Package ", pkgName, " in profile ", profileName, " not found in repo")
+			}
+		}
+	}
 }
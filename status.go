@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// agentStatus is what `assimilator status` reports
+type agentStatus struct {
+	Hostname       string          `json:"hostname"`
+	StatePath      string          `json:"state_path"`
+	LastCheckIn    *time.Time      `json:"last_check_in,omitempty"`
+	ServerVersion  string          `json:"server_version"`
+	ConfigRevision string          `json:"config_revision"`
+	Agent          *agentProgress  `json:"agent,omitempty"` // nil if the agent isn't running
+	Packages       []packageStatus `json:"packages"`
+}
+
+type packageStatus struct {
+	Package        string      `json:"package"`
+	Assigned       bool        `json:"assigned"`
+	ServerChecksum string      `json:"server_checksum"`
+	CachedChecksum string      `json:"cached_checksum"`
+	CacheMatches   bool        `json:"cache_matches_server"`
+	Steps          []StepState `json:"steps"`
+}
+
+// collectStatus builds the status report from the agent state and the package cache
+func collectStatus(state *AgentState) agentStatus {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	status := agentStatus{
+		Hostname:       appConfig.Hostname,
+		StatePath:      state.path,
+		ServerVersion:  state.ServerVersion,
+		ConfigRevision: state.ConfigRevision,
+		Packages:       make([]packageStatus, 0, len(state.Packages)),
+	}
+	if !state.LastCheckIn.IsZero() {
+		lastCheckIn := state.LastCheckIn
+		status.LastCheckIn = &lastCheckIn
+	}
+
+	for packageName, packageState := range state.Packages {
+		pkg := packageStatus{
+			Package:        packageName,
+			Assigned:       packageState.Assigned,
+			ServerChecksum: packageState.ServerChecksum,
+			Steps:          make([]StepState, 0, len(packageState.Steps)),
+		}
+		cachedPath := filepath.Join(appConfig.CacheDir, packageName, packageName+".tar.gz")
+		if fileExists(cachedPath) {
+			checksum, err := calculateChecksum(cachedPath)
+			if err != nil {
+				Error("failed to checksum ", cachedPath, ": ", err)
+			}
+			pkg.CachedChecksum = checksum
+		}
+		pkg.CacheMatches = pkg.CachedChecksum != "" && pkg.CachedChecksum == pkg.ServerChecksum
+		for _, step := range packageState.Steps {
+			pkg.Steps = append(pkg.Steps, *step)
+		}
+		slices.SortFunc(pkg.Steps, func(a, b StepState) int {
+			if a.Action == b.Action && a.RunAsUser == b.RunAsUser && a.AdHoc != b.AdHoc {
+				// An ad-hoc run goes after the config's step
+				if a.AdHoc {
+					return 1
+				}
+				return -1
+			}
+			return cmp.Compare(stepKey(a.Action, a.RunAsUser), stepKey(b.Action, b.RunAsUser))
+		})
+		status.Packages = append(status.Packages, pkg)
+	}
+	slices.SortFunc(status.Packages, func(a, b packageStatus) int {
+		return cmp.Compare(a.Package, b.Package)
+	})
+	return status
+}
+
+// shortChecksum trims a checksum down to something readable in a table
+func shortChecksum(checksum string) string {
+	if len(checksum) > 12 {
+		return checksum[:12]
+	}
+	if checksum == "" {
+		return "-"
+	}
+	return checksum
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func printStatus(w io.Writer, status agentStatus) error {
+	lastCheckIn := "never"
+	if status.LastCheckIn != nil {
+		lastCheckIn = formatTime(*status.LastCheckIn)
+	}
+	fmt.Fprintln(w, "Hostname:        ", status.Hostname)
+	fmt.Fprintln(w, "Last check-in:   ", lastCheckIn)
+	fmt.Fprintln(w, "Server version:  ", status.ServerVersion)
+	fmt.Fprintln(w, "Config revision: ", status.ConfigRevision)
+	fmt.Fprintln(w, "Agent:           ", formatProgress(status.Agent))
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tACTION\tUSER\tLAST RUN\tRESULT\tCHECKSUM\tCACHE")
+	for _, pkg := range status.Packages {
+		cache := "stale"
+		switch {
+		case pkg.CachedChecksum == "":
+			cache = "missing"
+		case pkg.CacheMatches:
+			cache = "matches server"
+		}
+		name := pkg.Package
+		if !pkg.Assigned {
+			name += " (unassigned)"
+		}
+		if len(pkg.Steps) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\tnever\t-\t%s\t%s\n", name, shortChecksum(pkg.ServerChecksum), cache)
+			continue
+		}
+		for _, step := range pkg.Steps {
+			result := step.Status
+			if step.Compliance != "" {
+				result += " (" + step.Compliance + ")"
+			}
+			if step.AdHoc {
+				result += " [ad-hoc]"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, step.Action, step.RunAsUser, formatTime(step.LastRunTime), result, shortChecksum(step.Checksum), cache)
+		}
+	}
+	return tw.Flush()
+}
+
+// formatProgress describes what the running agent is doing in one line
+func formatProgress(progress *agentProgress) string {
+	if progress == nil {
+		return "not running"
+	}
+	description := progress.State
+	if progress.State == "running" {
+		description += fmt.Sprintf(" (%d/%d packages done)", progress.PackagesDone, progress.PackagesTotal)
+		if progress.CurrentPackage != "" {
+			description += ", running " + progress.CurrentPackage + "/" + progress.CurrentAction
+		}
+	} else if progress.NextCheck != nil {
+		description += ", next check at " + formatTime(*progress.NextCheck)
+	}
+	if progress.LastCheckError != "" {
+		description += ", last check failed: " + progress.LastCheckError
+	}
+	return description
+}
+
+// statusCommand implements `assimilator status`
+func statusCommand(args []string) int {
+	flags := newCommandFlags("status", "")
+	asJSON := flags.Bool("json", false, "Print the status as JSON")
+	flags.Parse(args)
+
+	state, err := loadAgentState(appConfig.StateDir, appConfig.CacheDir, true)
+	if err != nil {
+		Error("error loading agent state: ", err)
+		return 1
+	}
+	status := collectStatus(state)
+	if resp, err := sendControlRequest(controlRequest{Command: controlProgress}); err == nil {
+		status.Agent = resp.Progress
+	} else {
+		Debug("Unable to get the agent's progress: ", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(status)
+	} else {
+		err = printStatus(os.Stdout, status)
+	}
+	if err != nil {
+		Error("error printing status: ", err)
+		return 1
+	}
+	return 0
+}
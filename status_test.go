@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectStatus(t *testing.T) {
+	defer func(cacheDir string) { appConfig.CacheDir = cacheDir }(appConfig.CacheDir)
+	appConfig.CacheDir = t.TempDir()
+
+	// vim's cache matches the server, git's is stale and curl has none
+	for packageName, content := range map[string]string{"vim": "vim tarball", "git": "old git tarball"} {
+		os.MkdirAll(filepath.Join(appConfig.CacheDir, packageName), 0755)
+		os.WriteFile(filepath.Join(appConfig.CacheDir, packageName, packageName+".tar.gz"), []byte(content), 0644)
+	}
+	vimChecksum, _ := calculateChecksum(filepath.Join(appConfig.CacheDir, "vim", "vim.tar.gz"))
+	state := newTestState()
+	state.LastCheckIn = time.Unix(1700000000, 0)
+	state.Packages = map[string]*PackageState{
+		"vim": {Assigned: true, ServerChecksum: vimChecksum, Steps: map[string]*StepState{
+			"install/root":   {Action: "install", RunAsUser: "root", Status: scriptStatusSuccess},
+			"configure/root": {Action: "configure", RunAsUser: "root", Status: scriptStatusSuccess, Compliance: complianceCompliant},
+		}},
+		"git":  {Assigned: true, ServerChecksum: "new", Steps: map[string]*StepState{}},
+		"curl": {Assigned: false, ServerChecksum: "abc", Steps: map[string]*StepState{"install/root": {Action: "install", RunAsUser: "root", AdHoc: true}}},
+	}
+
+	status := collectStatus(state)
+
+	var names []string
+	for _, pkg := range status.Packages {
+		names = append(names, pkg.Package)
+	}
+	if strings.Join(names, ",") != "curl,git,vim" {
+		t.Errorf("Expected the packages sorted by name, but got %v", names)
+	}
+	if status.LastCheckIn == nil || !status.LastCheckIn.Equal(state.LastCheckIn) {
+		t.Errorf("Expected the last check-in, but got %v", status.LastCheckIn)
+	}
+	vim := status.Packages[2]
+	if !vim.CacheMatches || vim.Steps[0].Action != "configure" {
+		t.Errorf("Expected vim's cache to match and its steps sorted, but got %+v", vim)
+	}
+	if git := status.Packages[1]; git.CacheMatches || git.CachedChecksum == "" {
+		t.Errorf("Expected git's cache to be stale, but got %+v", git)
+	}
+
+	var out bytes.Buffer
+	if err := printStatus(&out, status); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"curl (unassigned)",
+		"[ad-hoc]",
+		"success (compliant)",
+		"matches server",
+		"stale",
+		"missing",
+		"Agent:            not running",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected the status to contain %q, but got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestFormatProgress(t *testing.T) {
+	nextCheck := time.Unix(1700000000, 0)
+	testCases := []struct {
+		name     string
+		progress *agentProgress
+		expected string
+	}{
+		{name: "Not running", progress: nil, expected: "not running"},
+		{name: "Running", progress: &agentProgress{State: "running", PackagesDone: 1, PackagesTotal: 3, CurrentPackage: "vim", CurrentAction: "install"}, expected: "running (1/3 packages done), running vim/install"},
+		{name: "Idle", progress: &agentProgress{State: "idle", NextCheck: &nextCheck}, expected: "idle, next check at " + formatTime(nextCheck)},
+		{name: "Failed check", progress: &agentProgress{State: "idle", LastCheckError: "unreachable"}, expected: "idle, last check failed: unreachable"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatProgress(tc.progress); got != tc.expected {
+				t.Errorf("Expected %q, but got %q", tc.expected, got)
+			}
+		})
+	}
+}
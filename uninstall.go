@@ -0,0 +1,125 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+// defaultMaxRemovals is how many removed packages an agent uninstalls per
+// check when the server doesn't say, e.g. because it predates max_removals
+const defaultMaxRemovals = 5
+
+// maxRemovals returns the removal cap the server sent, or the default
+func maxRemovals(resp *pb.GetSpecificConfigResponse) int {
+	if resp.MaxRemovals == nil {
+		return defaultMaxRemovals
+	}
+	return int(resp.GetMaxRemovals())
+}
+
+// removedPackage is a package that disappeared from the served config and
+// opted in to being uninstalled
+type removedPackage struct {
+	name  string
+	users []string // the users its opted-in steps ran as
+}
+
+// removedPackages lists the unassigned packages with steps that ran as this agent's
+// user and opted in to uninstall_on_removal
+func (s *AgentState) removedPackages() []removedPackage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []removedPackage
+	for packageName, packageState := range s.Packages {
+		if packageState.Assigned {
+			continue
+		}
+		var users []string
+		for _, step := range packageState.Steps {
+			if step.UninstallOnRemoval && !step.AdHoc && step.RunAsUser == appConfig.RunAsUser && !slices.Contains(users, step.RunAsUser) {
+				users = append(users, step.RunAsUser)
+			}
+		}
+		if len(users) > 0 {
+			removed = append(removed, removedPackage{name: packageName, users: users})
+		}
+	}
+	slices.SortFunc(removed, func(a, b removedPackage) int {
+		return cmp.Compare(a.name, b.name)
+	})
+	return removed
+}
+
+// uninstallRemovedPackages runs uninstall.sh for packages removed from the config,
+// then clears their state and cache. Nothing is uninstalled if more packages were
+// removed than the server allows per check.
+func (a *AgentData) uninstallRemovedPackages(ctx context.Context) {
+	removed := a.state.removedPackages()
+	if len(removed) == 0 {
+		return
+	}
+	if len(removed) > a.maxRemovals {
+		names := make([]string, len(removed))
+		for i, pkg := range removed {
+			names[i] = pkg.name
+		}
+		Error(fmt.Sprintf("Refusing to uninstall %d removed packages in one check, the server allows %d: %v", len(removed), a.maxRemovals, names))
+		a.failureReports["uninstall"] = fmt.Sprintf("%d packages were removed from the config, more than the %d allowed per check", len(removed), a.maxRemovals)
+		return
+	}
+
+	for _, pkg := range removed {
+		if ctx.Err() != nil {
+			return
+		}
+		Info("Package ", pkg.name, " was removed from the config. Uninstalling it...")
+		if err := a.uninstallPackage(ctx, pkg); err != nil {
+			a.failureReports["uninstall "+pkg.name] = fmt.Sprintf("error uninstalling removed package %s: %s", pkg.name, err)
+			Error("error uninstalling removed package ", pkg.name, ": ", err)
+			continue
+		}
+		Success("Uninstalled removed package ", pkg.name)
+	}
+}
+
+func (a *AgentData) uninstallPackage(ctx context.Context, pkg removedPackage) error {
+	packageCacheDir := filepath.Join(appConfig.CacheDir, pkg.name)
+	tarballPath := filepath.Join(packageCacheDir, pkg.name+".tar.gz")
+	if fileExists(tarballPath) {
+		for _, runAsUser := range pkg.users {
+			p := &packageInfo{
+				cacheDir:  packageCacheDir,
+				name:      pkg.name,
+				path:      tarballPath,
+				action:    "uninstall",
+				runAsUser: runAsUser,
+			}
+			if err := p.extractPackage(); err != nil {
+				return err
+			}
+			if !fileExists(filepath.Join(p.extractDir, "uninstall.sh")) {
+				Info("Package ", pkg.name, " has no uninstall.sh. Only clearing its state and cache.")
+				break
+			}
+			if err := p.executePackageScript(ctx, a); err != nil {
+				return err
+			}
+		}
+	} else {
+		Warning("Package ", pkg.name, " is no longer cached, so uninstall.sh cannot run. Only clearing its state.")
+	}
+
+	if err := a.state.forgetPackage(pkg.name); err != nil {
+		return fmt.Errorf("failed to clear the package's state: %w", err)
+	}
+	if err := os.RemoveAll(packageCacheDir); err != nil {
+		return fmt.Errorf("failed to remove the package's cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMaxRemovals(t *testing.T) {
+	testCases := []struct {
+		name     string
+		resp     *pb.GetSpecificConfigResponse
+		expected int
+	}{
+		{name: "Older server", resp: &pb.GetSpecificConfigResponse{}, expected: defaultMaxRemovals},
+		{name: "Server cap", resp: &pb.GetSpecificConfigResponse{MaxRemovals: proto.Int32(2)}, expected: 2},
+		{name: "Server forbids removals", resp: &pb.GetSpecificConfigResponse{MaxRemovals: proto.Int32(0)}, expected: 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := maxRemovals(tc.resp); got != tc.expected {
+				t.Errorf("Expected %d, but got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRemovedPackages(t *testing.T) {
+	defer func(runAsUser string) { appConfig.RunAsUser = runAsUser }(appConfig.RunAsUser)
+	appConfig.RunAsUser = "root"
+	state := newTestState()
+	state.Packages = map[string]*PackageState{
+		"assigned":   {Assigned: true, Steps: map[string]*StepState{"install/root": {Action: "install", RunAsUser: "root", UninstallOnRemoval: true}}},
+		"opted-in":   {Steps: map[string]*StepState{"install/root": {Action: "install", RunAsUser: "root", UninstallOnRemoval: true}}},
+		"opted-out":  {Steps: map[string]*StepState{"install/root": {Action: "install", RunAsUser: "root"}}},
+		"ad-hoc":     {Steps: map[string]*StepState{"install/root": {Action: "install", RunAsUser: "root", UninstallOnRemoval: true, AdHoc: true}}},
+		"other-user": {Steps: map[string]*StepState{"install/alice": {Action: "install", RunAsUser: "alice", UninstallOnRemoval: true}}},
+		"a-two-steps": {Steps: map[string]*StepState{
+			"install/root":   {Action: "install", RunAsUser: "root", UninstallOnRemoval: true},
+			"configure/root": {Action: "configure", RunAsUser: "root", UninstallOnRemoval: true},
+		}},
+	}
+
+	removed := state.removedPackages()
+
+	var names []string
+	for _, pkg := range removed {
+		names = append(names, pkg.name+":"+strings.Join(pkg.users, ","))
+	}
+	if strings.Join(names, " ") != "a-two-steps:root opted-in:root" {
+		t.Errorf("Expected only the opted-in unassigned packages, once per user, but got %v", names)
+	}
+}
+
+func TestUninstallRemovedPackages(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(runAsUser, cacheDir string) {
+		appConfig.RunAsUser, appConfig.CacheDir = runAsUser, cacheDir
+	}(appConfig.RunAsUser, appConfig.CacheDir)
+	appConfig.RunAsUser = currentUser.Username
+
+	testCases := []struct {
+		name        string
+		removed     []string
+		maxRemovals int
+
+		expectUninstalled bool
+		expectFailure     string
+	}{
+		{name: "Within the cap", removed: []string{"uninstall-test-a", "uninstall-test-b"}, maxRemovals: 2, expectUninstalled: true},
+		{name: "Over the cap", removed: []string{"uninstall-test-a", "uninstall-test-b"}, maxRemovals: 1, expectFailure: "uninstall"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			appConfig.CacheDir = t.TempDir()
+			marker := filepath.Join(t.TempDir(), "uninstalled")
+			state := newTestState()
+			for _, packageName := range tc.removed {
+				writeTestTarball(t, filepath.Join(appConfig.CacheDir, packageName, packageName+".tar.gz"), map[string]string{
+					"uninstall.sh": "echo $ASSIMILATOR_PACKAGE >> " + marker,
+				})
+				state.Packages[packageName] = &PackageState{Steps: map[string]*StepState{
+					"install/" + currentUser.Username: {Action: "install", RunAsUser: currentUser.Username, UninstallOnRemoval: true},
+				}}
+				t.Cleanup(func() { os.RemoveAll(filepath.Join(os.TempDir(), "assimilator", currentUser.Username, packageName)) })
+			}
+			a := &AgentData{state: state, maxRemovals: tc.maxRemovals, failureReports: make(map[string]string)}
+
+			// --- Act ---
+			a.uninstallRemovedPackages(context.Background())
+
+			// --- Assert ---
+			ran, _ := os.ReadFile(marker)
+			for _, packageName := range tc.removed {
+				_, stillKnown := state.Packages[packageName]
+				cached := fileExists(filepath.Join(appConfig.CacheDir, packageName, packageName+".tar.gz"))
+				uninstalled := strings.Contains(string(ran), packageName)
+				if uninstalled != tc.expectUninstalled || stillKnown == tc.expectUninstalled || cached == tc.expectUninstalled {
+					t.Errorf("%s: expected uninstalled %v, but uninstall.sh ran %v, state kept %v, cache kept %v", packageName, tc.expectUninstalled, uninstalled, stillKnown, cached)
+				}
+			}
+			if _, ok := a.failureReports[tc.expectFailure]; tc.expectFailure != "" && !ok {
+				t.Errorf("Expected a %q failure report, but got %v", tc.expectFailure, a.failureReports)
+			}
+		})
+	}
+}
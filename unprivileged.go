@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+// An agent that isn't root runs in unprivileged mode: its config, state and
+// cache live in the user's XDG directories, it never writes outside $HOME and
+// it only runs the steps assigned to its own user.
+
+func isRoot() bool {
+	return os.Geteuid() == 0
+}
+
+// rootSteps lists the "package/action" steps in the config that must run as
+// root, which an unprivileged agent can't do
+func rootSteps(packages map[string]*pb.PackageConfig) []string {
+	var steps []string
+	for packageName, packageConfig := range packages {
+		for _, packageStep := range packageConfig.GetPackageSteps() {
+			if packageStep.GetRunasuser() == "root" {
+				steps = append(steps, packageName+"/"+packageStep.GetAction())
+			}
+		}
+	}
+	slices.Sort(steps)
+	return steps
+}
+
+// warnRootSteps explains which steps an unprivileged agent is leaving to a root
+// agent. It only warns when that list changes, so it doesn't repeat every check.
+func (a *AgentData) warnRootSteps(packages map[string]*pb.PackageConfig) {
+	if isRoot() {
+		return
+	}
+	steps := strings.Join(rootSteps(packages), ", ")
+	if steps == a.skippedRootSteps {
+		return
+	}
+	a.skippedRootSteps = steps
+	if steps != "" {
+		Warning("This agent runs as ", appConfig.CurrentUser, " and can't run steps that need root. They need an agent running as root: ", steps)
+	}
+}
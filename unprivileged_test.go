@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+func TestRootSteps(t *testing.T) {
+	packages := map[string]*pb.PackageConfig{
+		"vim":     {PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "root"}, {Action: "configure", Runasuser: "alice"}}},
+		"dotfile": {PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "_all"}}},
+		"docker":  {PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "root"}}},
+	}
+	expected := []string{"docker/install", "vim/install"}
+	if got := rootSteps(packages); !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, but got %v", expected, got)
+	}
+	if got := rootSteps(nil); len(got) != 0 {
+		t.Errorf("Expected no steps, but got %v", got)
+	}
+}
+
+func TestWarnRootSteps(t *testing.T) {
+	if isRoot() {
+		t.Skip("root agents run every step")
+	}
+	a := &AgentData{}
+	packages := map[string]*pb.PackageConfig{"vim": {PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "root"}}}}
+	a.warnRootSteps(packages)
+	if a.skippedRootSteps != "vim/install" {
+		t.Errorf("Expected vim/install to be remembered, but got %q", a.skippedRootSteps)
+	}
+	a.warnRootSteps(nil)
+	if a.skippedRootSteps != "" {
+		t.Errorf("Expected the list to be cleared, but got %q", a.skippedRootSteps)
+	}
+}
+
+func TestPackagesForUser(t *testing.T) {
+	defer func(runAsUser string) { appConfig.RunAsUser = runAsUser }(appConfig.RunAsUser)
+	appConfig.RunAsUser = "alice"
+	packages := map[string]*pb.PackageConfig{
+		"vim":     {Checksum: "abc", PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "root"}, {Action: "configure", Runasuser: "alice"}}},
+		"dotfile": {Checksum: "def", PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "_all"}}},
+		"docker":  {Checksum: "ghi", PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "root"}}},
+	}
+
+	names, filtered := PackagesForUser(packages)
+
+	if !slices.Equal(names, []string{"dotfile", "vim"}) {
+		t.Errorf("Expected only alice's packages, but got %v", names)
+	}
+	if p := filtered["vim"]; p == nil || p.action != "configure" || p.serverChecksum != "abc" {
+		t.Errorf("Expected vim's configure step as alice, but got %+v", p)
+	}
+	if p := filtered["dotfile"]; p == nil || p.runAsUser != "alice" {
+		t.Errorf("Expected _all to run as alice, but got %+v", p)
+	}
+}
+
+func TestPackagesForUserWithNoSteps(t *testing.T) {
+	defer func(runAsUser string) { appConfig.RunAsUser = runAsUser }(appConfig.RunAsUser)
+	appConfig.RunAsUser = "alice"
+	// Steps skipped by their when: leave a package with none
+	packages := map[string]*pb.PackageConfig{
+		"docker":  {Checksum: "ghi", PackageSteps: []*pb.PackageSteps{{Action: "install", Runasuser: "root"}}},
+		"vmtools": {},
+	}
+
+	names, filtered := PackagesForUser(packages)
+
+	if len(names) != 0 || len(filtered) != 0 {
+		t.Errorf("Expected no packages for alice, but got %v", names)
+	}
+}
+
+func TestScriptUser(t *testing.T) {
+	defer func(currentUser string) { appConfig.CurrentUser = currentUser }(appConfig.CurrentUser)
+	appConfig.CurrentUser = "alice"
+
+	testCases := []struct {
+		name      string
+		p         *packageInfo
+		expectErr bool
+	}{
+		{name: "Own user", p: &packageInfo{name: "vim", runAsUser: "alice", adhoc: true}},
+		{name: "The config's steps never switch", p: &packageInfo{name: "vim", runAsUser: "bob"}},
+		{name: "Ad-hoc as another user", p: &packageInfo{name: "vim", runAsUser: "nobody", adhoc: true}, expectErr: !isRoot()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.p.scriptUser()
+			if tc.expectErr {
+				if err == nil || !strings.Contains(err.Error(), "only root") {
+					t.Errorf("Expected only root to switch users, but got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Did not expect error, but got: %v", err)
+			}
+		})
+	}
+}
+
+func TestXDGStateHome(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "")
+	if got := xdgStateHome("/home/alice"); got != "/home/alice/.local/state" {
+		t.Errorf("Expected the default, but got %q", got)
+	}
+	t.Setenv("XDG_STATE_HOME", "relative/state")
+	if got := xdgStateHome("/home/alice"); got != "/home/alice/.local/state" {
+		t.Errorf("Expected a relative XDG_STATE_HOME to be ignored, but got %q", got)
+	}
+	t.Setenv("XDG_STATE_HOME", "/srv/state")
+	if got := xdgStateHome("/home/alice"); got != "/srv/state" {
+		t.Errorf("Expected XDG_STATE_HOME, but got %q", got)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+
+	pb "github.com/geogian28/Assimilator/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// configIssue is a problem validate found, at a position in the config file.
+// Line and column are 0 when the problem isn't tied to one place.
+type configIssue struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (i configIssue) format(filePath string) string {
+	if i.File != "" {
+		filePath = i.File
+	}
+	switch {
+	case i.Line == 0:
+		return fmt.Sprintf("%s: %s", filePath, i.Message)
+	case i.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", filePath, i.Line, i.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", filePath, i.Line, i.Column, i.Message)
+}
+
+// A runasuser is a username an agent can run as, or _all for every agent
+var usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+
+// An env key is a shell variable name
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validRunAsUser(runAsUser string) bool {
+	return runAsUser == "_all" || usernamePattern.MatchString(runAsUser)
+}
+
+// Strict decoding reports unknown keys as "line N: field X not found in type T"
+var unknownFieldPattern = regexp.MustCompile(`^line (\d+): field (\S+) not found`)
+
+// Syntax errors look like "yaml: line N: did not find expected key"
+var syntaxErrorPattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// configValidator checks a config.yaml against the package repository
+type configValidator struct {
+	file       configFile   // The file being checked
+	state      DesiredState // Every file merged, to look profiles up in
+	packages   []string     // The package directories in the repository
+	repoDir    string
+	foundCycle bool
+	issues     []configIssue
+}
+
+// validateConfig reads the config at configPath, and the files it brings in,
+// and returns every problem it finds, checking packages against the
+// directories in repoDir
+func validateConfig(configPath string, repoDir string) ([]configIssue, error) {
+	v := &configValidator{repoDir: repoDir}
+	var err error
+	if v.packages, err = packageDirs(repoDir); err != nil {
+		return nil, err
+	}
+
+	configDir := filepath.Dir(configPath)
+	files, err := loadConfigFiles(dirSource(configDir), filepath.Base(configPath))
+	var fileErr *configFileError
+	if errors.As(err, &fileErr) {
+		issue := syntaxIssue(fileErr.err)
+		issue.File = filepath.Join(configDir, fileErr.path)
+		return []configIssue{issue}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if files[0].root == nil {
+		return []configIssue{{Message: "the config is empty"}}, nil
+	}
+	// Duplicates are reported with their locations, but it's checked as far as it goes
+	state, err := mergeConfigFiles(files)
+	if state == nil {
+		return nil, err
+	}
+	v.state = *state
+	if err != nil {
+		var typeErr *yaml.TypeError
+		var duplicate *duplicateError
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			switch {
+			case errors.As(err, &typeErr):
+				// Reported by the strict decoding below
+			case errors.As(err, &duplicate):
+				v.issues = append(v.issues, configIssue{
+					File:    duplicate.path,
+					Line:    duplicate.line,
+					Column:  duplicate.column,
+					Message: fmt.Sprintf("%s is already defined in %s", duplicate.what, duplicate.first),
+				})
+			default:
+				v.issues = append(v.issues, configIssue{Message: err.Error()})
+			}
+		}
+	}
+
+	for _, file := range files {
+		if file.root == nil {
+			continue
+		}
+		v.file = file
+		v.decodeStrictly()
+		switch file.kind {
+		case configFileMachines:
+			v.checkMachines(file.root)
+		case configFileProfiles:
+			v.checkProfiles(file.root)
+		default:
+			_, profiles := mappingKey(file.root, "profiles")
+			v.checkProfiles(profiles)
+			_, machines := mappingKey(file.root, "machines")
+			v.checkMachines(machines)
+			v.checkFactProfiles(file.root)
+		}
+	}
+	// Anything else the server would refuse to load, like arguments using
+	// vars that don't exist
+	if len(v.issues) == 0 {
+		if _, err := desiredStateFromFiles(files); err != nil {
+			v.issues = append(v.issues, configIssue{Message: err.Error()})
+		}
+	}
+	for i := range v.issues {
+		if v.issues[i].File != "" {
+			v.issues[i].File = filepath.Join(configDir, v.issues[i].File)
+		}
+	}
+	slices.SortStableFunc(v.issues, func(a, b configIssue) int {
+		return cmp.Or(
+			cmp.Compare(a.File, b.File),
+			cmp.Compare(a.Line, b.Line),
+			cmp.Compare(a.Column, b.Column),
+		)
+	})
+	return v.issues, nil
+}
+
+// decodeStrictly decodes the file being checked, catching misspelt keys and
+// values of the wrong type
+func (v *configValidator) decodeStrictly() {
+	var target any
+	switch v.file.kind {
+	case configFileMachines:
+		target = &map[string]MachineConfig{}
+	case configFileProfiles:
+		target = &map[string]ProfileConfig{}
+	default:
+		target = &DesiredState{}
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(v.file.data))
+	decoder.KnownFields(true)
+	var typeErr *yaml.TypeError
+	if err := decoder.Decode(target); errors.As(err, &typeErr) {
+		for _, message := range typeErr.Errors {
+			v.issues = append(v.issues, v.decodeIssue(message))
+		}
+	}
+}
+
+// packageDirs lists the package directories in the repository
+func packageDirs(repoDir string) ([]string, error) {
+	entries, err := os.ReadDir(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the package repository: %w", err)
+	}
+	var packages []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name()[0] != '.' && !isConfigDir(entry.Name()) {
+			packages = append(packages, entry.Name())
+		}
+	}
+	return packages, nil
+}
+
+func syntaxIssue(err error) configIssue {
+	if match := syntaxErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return configIssue{Line: line, Message: match[2]}
+	}
+	return configIssue{Message: err.Error()}
+}
+
+// decodeIssue turns a strict decoding error into an issue, finding the column
+// of an unknown key in the document
+func (v *configValidator) decodeIssue(message string) configIssue {
+	match := unknownFieldPattern.FindStringSubmatch(message)
+	if match == nil {
+		issue := syntaxIssue(errors.New("yaml: " + message))
+		issue.File = v.file.path
+		return issue
+	}
+	line, _ := strconv.Atoi(match[1])
+	issue := configIssue{File: v.file.path, Line: line, Message: "unknown key " + strconv.Quote(match[2])}
+	if key := findKey(v.file.root, line, match[2]); key != nil {
+		issue.Column = key.Column
+	}
+	return issue
+}
+
+// findKey finds the mapping key on the given line
+func findKey(node *yaml.Node, line int, name string) *yaml.Node {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if key := node.Content[i]; key.Line == line && key.Value == name {
+				return key
+			}
+		}
+	}
+	for _, child := range node.Content {
+		if key := findKey(child, line, name); key != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+func (v *configValidator) addIssue(node *yaml.Node, format string, args ...any) {
+	v.issues = append(v.issues, configIssue{File: v.file.path, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *configValidator) checkProfiles(profiles *yaml.Node) {
+	for _, entry := range mappingEntries(profiles) {
+		v.checkAppliedProfiles(entry[1])
+		v.checkPackages(entry[1])
+		// Every profile in a cycle would report it, so only the first one does
+		if _, err := v.state.resolveProfiles([]string{entry[0].Value}); err != nil && !v.foundCycle {
+			v.addIssue(entry[0], "%s", err)
+			v.foundCycle = true
+		}
+	}
+}
+
+func (v *configValidator) checkMachines(machines *yaml.Node) {
+	for _, entry := range mappingEntries(machines) {
+		if _, err := parseMachineSelector(entry[0].Value); err != nil {
+			v.addIssue(entry[0], "%s", err)
+		}
+		v.checkAppliedProfiles(entry[1])
+		v.checkPackages(entry[1])
+	}
+}
+
+func (v *configValidator) checkFactProfiles(root *yaml.Node) {
+	_, factProfiles := mappingKey(root, "fact_profiles")
+	if factProfiles == nil || factProfiles.Kind != yaml.SequenceNode {
+		return
+	}
+	knownFacts := factValues(&pb.Facts{})
+	for _, factProfile := range factProfiles.Content {
+		_, match := mappingKey(factProfile, "match")
+		if len(mappingEntries(match)) == 0 {
+			v.addIssue(factProfile, "fact profile has no match, so it would apply to every machine")
+		}
+		for _, entry := range mappingEntries(match) {
+			if _, ok := knownFacts[entry[0].Value]; !ok {
+				v.addIssue(entry[0], "unknown fact %q", entry[0].Value)
+			}
+		}
+		v.checkAppliedProfiles(factProfile)
+	}
+}
+
+// checkAppliedProfiles checks that every profile in a node's applied_profiles exists
+func (v *configValidator) checkAppliedProfiles(node *yaml.Node) {
+	_, appliedProfiles := mappingKey(node, "applied_profiles")
+	if appliedProfiles == nil || appliedProfiles.Kind != yaml.SequenceNode {
+		return
+	}
+	for _, profile := range appliedProfiles.Content {
+		if _, ok := v.state.Profiles[profile.Value]; !ok {
+			v.addIssue(profile, "unknown profile %q", profile.Value)
+		}
+	}
+}
+
+// checkPackages checks a node's packages against the repository
+func (v *configValidator) checkPackages(node *yaml.Node) {
+	_, packages := mappingKey(node, "packages")
+	for _, entry := range mappingEntries(packages) {
+		packageName := entry[0].Value
+		hasDir := slices.Contains(v.packages, packageName)
+		if !hasDir {
+			v.addIssue(entry[0], "package %q has no directory in %s", packageName, v.repoDir)
+		}
+		if entry[1].Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, step := range entry[1].Content {
+			_, action := mappingKey(step, "action")
+			switch {
+			case action == nil:
+				v.addIssue(step, "package %q has a step without an action", packageName)
+			case hasDir && !fileExists(filepath.Join(v.repoDir, packageName, action.Value+".sh")):
+				v.addIssue(action, "package %q has no %s.sh for its %s action", packageName, action.Value, action.Value)
+			}
+			if _, runAsUser := mappingKey(step, "runasuser"); runAsUser != nil && !validRunAsUser(runAsUser.Value) {
+				v.addIssue(runAsUser, "invalid runasuser %q: it must be a username or _all", runAsUser.Value)
+			}
+			if _, when := mappingKey(step, "when"); when != nil {
+				if _, err := parseWhen(when.Value); err != nil {
+					v.addIssue(when, "invalid when: %s", err)
+				}
+			}
+			_, env := mappingKey(step, "env")
+			for _, entry := range mappingEntries(env) {
+				if !envKeyPattern.MatchString(entry[0].Value) {
+					v.addIssue(entry[0], "invalid env name %q", entry[0].Value)
+				}
+			}
+		}
+	}
+}
+
+// validateCommand implements `assimilator validate`, which checks a
+// config.yaml, and the files it brings in, and exits non-zero if it has problems, e.g. in a pre-commit hook
+func validateCommand(args []string) int {
+	flags := newCommandFlags("validate", "")
+	configPath := flags.String("config", defaultConfigPath(), "The config.yaml to check")
+	repoDir := flags.String("repo", "", "The package repository to check packages against. Defaults to the config's directory")
+	flags.Parse(args)
+	if *repoDir == "" {
+		*repoDir = filepath.Dir(*configPath)
+	}
+
+	issues, err := validateConfig(*configPath, *repoDir)
+	if err != nil {
+		Error("error validating ", *configPath, ": ", err)
+		return 1
+	}
+	for _, issue := range issues {
+		fmt.Println(issue.format(*configPath))
+	}
+	if len(issues) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(issues))
+		return 1
+	}
+	fmt.Println(*configPath, "is valid")
+	return 0
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	testCases := []struct {
+		name     string
+		files    map[string]string
+		expected []string // Formatted issues, relative to the repo
+	}{
+		{
+			name: "Valid",
+			files: map[string]string{"config.yaml": `
+profiles:
+  base:
+    packages:
+      vim:
+        - action: install
+          runasuser: _all
+          when: distro == "debian"
+          env: {EDITOR: vim}
+machines:
+  web01:
+    applied_profiles: [base]
+`},
+		},
+		{
+			name: "Misspelt key",
+			files: map[string]string{"config.yaml": `
+machines:
+  web01:
+    aplied_profiles: [base]
+`},
+			expected: []string{`config.yaml:4:5: unknown key "aplied_profiles"`},
+		},
+		{
+			name: "Wrong type",
+			files: map[string]string{"config.yaml": `
+machines:
+  web01:
+    packages:
+      vim:
+        - action: install
+          timeout: soon
+`},
+			expected: []string{"config.yaml:7: cannot unmarshal !!str `soon` into int64"},
+		},
+		{
+			name: "Steps",
+			files: map[string]string{"config.yaml": `
+machines:
+  web01:
+    applied_profiles: [missing]
+    packages:
+      vim:
+        - action: configure
+        - runasuser: Bad User
+          when: distro ==
+          env: {1BAD: x}
+      emacs:
+        - action: install
+`},
+			expected: []string{
+				`config.yaml:4:24: unknown profile "missing"`,
+				`config.yaml:7:19: package "vim" has no configure.sh for its configure action`,
+				`config.yaml:8:11: package "vim" has a step without an action`,
+				`config.yaml:8:22: invalid runasuser "Bad User": it must be a username or _all`,
+				`config.yaml:9:17: invalid when: expected a fact, var or string at column 10, found the end`,
+				`config.yaml:10:17: invalid env name "1BAD"`,
+				`config.yaml:11:7: package "emacs" has no directory in <repo>`,
+			},
+		},
+		{
+			name: "Selectors and fact profiles",
+			files: map[string]string{"config.yaml": `
+machines:
+  /lab-(/: {}
+fact_profiles:
+  - match: {archh: arm64}
+`},
+			expected: []string{
+				"config.yaml:3:3: invalid machine regex /lab-(/: error parsing regexp: missing closing ): `lab-(`",
+				`config.yaml:5:13: unknown fact "archh"`,
+			},
+		},
+		{
+			name: "Profile cycle reported once",
+			files: map[string]string{"config.yaml": `
+profiles:
+  a: {applied_profiles: [b]}
+  b: {applied_profiles: [a]}
+`},
+			expected: []string{"config.yaml:3:3: profile cycle: a -> b -> a"},
+		},
+		{
+			name:     "Syntax error",
+			files:    map[string]string{"config.yaml": "machines:\n  web01: [\n"},
+			expected: []string{"config.yaml:2: did not find expected node content"},
+		},
+		{
+			name: "Files in config.d",
+			files: map[string]string{
+				"config.yaml":              "include: [machines/*.yaml]\n",
+				"machines/web.yaml":        "web01:\n  applied_profiles: [nope]\n",
+				"profiles/placeholder.txt": "",
+			},
+			expected: []string{`machines/web.yaml:2:22: unknown profile "nope"`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			configPath := writeTestConfig(t, tc.files)
+			repoDir := filepath.Dir(configPath)
+			os.MkdirAll(filepath.Join(repoDir, "vim"), 0755)
+			os.WriteFile(filepath.Join(repoDir, "vim", "install.sh"), []byte("#!/bin/sh\n"), 0755)
+
+			// --- Act ---
+			issues, err := validateConfig(configPath, repoDir)
+
+			// --- Assert ---
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			var got []string
+			for _, issue := range issues {
+				formatted := strings.TrimPrefix(issue.format(configPath), repoDir+"/")
+				got = append(got, strings.ReplaceAll(formatted, repoDir, "<repo>"))
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.expected, "\n") {
+				t.Errorf("Expected:\n%s\nbut got:\n%s", strings.Join(tc.expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidRunAsUser(t *testing.T) {
+	for _, runAsUser := range []string{"root", "_all", "alice", "deploy_bot", "svc-web.1"} {
+		if !validRunAsUser(runAsUser) {
+			t.Errorf("Expected %q to be valid", runAsUser)
+		}
+	}
+	for _, runAsUser := range []string{"", "Alice", "1user", "bad user", "x/../y"} {
+		if validRunAsUser(runAsUser) {
+			t.Errorf("Expected %q to be invalid", runAsUser)
+		}
+	}
+}
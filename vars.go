@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+// Step arguments and env values are text/template templates. They can use:
+//
+//	{{ .vars.name }}   a var from `vars:`, merged from the global ones, then
+//	                   the machine's profiles, then its `machines:` entries
+//	{{ .hostname }}    the machine's hostname
+//	{{ .commit }}      the config revision the server is serving
+//	{{ .facts.arch }}  a fact the agent reported. Facts with several values,
+//	                   like ip_addresses, are joined with commas
+//
+// Using a var or fact that doesn't exist is an error.
+
+// mergeVars merges the global vars with the profiles' and then the entries',
+// so the last one to set a var wins
+func (d *DesiredState) mergeVars(profileNames []string, entries []string) map[string]string {
+	vars := make(map[string]string)
+	maps.Copy(vars, d.Vars)
+	for _, profileName := range profileNames {
+		maps.Copy(vars, d.Profiles[profileName].Vars)
+	}
+	for _, entry := range entries {
+		maps.Copy(vars, d.Machines[entry].Vars)
+	}
+	return vars
+}
+
+// templateData is what step arguments are rendered against
+func templateData(vars map[string]string, hostname string, commit string, facts map[string][]string) map[string]any {
+	flatFacts := make(map[string]string, len(facts))
+	for name, values := range facts {
+		flatFacts[name] = strings.Join(values, ",")
+	}
+	return map[string]any{
+		"vars":     vars,
+		"hostname": hostname,
+		"commit":   commit,
+		"facts":    flatFacts,
+	}
+}
+
+// renderArgument renders a single step argument
+func renderArgument(argument string, data map[string]any) (string, error) {
+	if !strings.Contains(argument, "{{") {
+		return argument, nil
+	}
+	tmpl, err := template.New("argument").Option("missingkey=error").Parse(argument)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// renderArguments returns a copy of packages with every argument and env value rendered
+func renderArguments(packages map[string][]PackageStep, data map[string]any) (map[string][]PackageStep, error) {
+	rendered := make(map[string][]PackageStep, len(packages))
+	for pkgName, pkgSteps := range packages {
+		steps := slices.Clone(pkgSteps)
+		for i := range steps {
+			arguments := slices.Clone(steps[i].Arguments)
+			for j, argument := range arguments {
+				var err error
+				if arguments[j], err = renderArgument(argument, data); err != nil {
+					return nil, fmt.Errorf("package %s %s step: %w", pkgName, steps[i].Action, err)
+				}
+			}
+			steps[i].Arguments = arguments
+			env := maps.Clone(steps[i].Env)
+			for key, value := range env {
+				var err error
+				if env[key], err = renderArgument(value, data); err != nil {
+					return nil, fmt.Errorf("package %s %s step env %s: %w", pkgName, steps[i].Action, key, err)
+				}
+			}
+			steps[i].Env = env
+		}
+		rendered[pkgName] = steps
+	}
+	return rendered, nil
+}
+
+// checkTemplates renders every machine's arguments, and those of the profiles
+// fact_profiles apply, and checks the vars in their steps' `when:` conditions,
+// so a missing var fails when the config loads rather than on an agent.
+// Hostnames, commits and facts are left empty, since they're only known when
+// an agent checks in.
+//
+// Each `machines:` entry is checked on its own. A host matching several
+// entries gets their vars merged, which only adds to the vars each entry has,
+// so a var has to resolve from the entry itself, its profiles or the global
+// vars. One set only by another entry the host may also match is an error.
+func (d *DesiredState) checkTemplates() error {
+	noFacts := factValues(&pb.Facts{})
+	for _, machineName := range slices.Sorted(maps.Keys(d.Machines)) {
+		machine := d.Machines[machineName]
+		if _, err := renderArguments(machine.Packages, templateData(machine.vars, "", "", noFacts)); err != nil {
+			return fmt.Errorf("machine %s: %w", machineName, err)
+		}
+		if err := checkConditions(machine.Packages, machine.vars); err != nil {
+			return fmt.Errorf("machine %s: %w", machineName, err)
+		}
+	}
+	for i, factProfile := range d.FactProfiles {
+		profileNames, err := d.resolveProfiles(factProfile.AppliedProfiles)
+		if err != nil {
+			return err
+		}
+		packages, _ := d.mergePackages(fmt.Sprintf("fact_profiles[%d]", i), profileNames, nil)
+		vars := d.mergeVars(profileNames, nil)
+		if _, err := renderArguments(packages, templateData(vars, "", "", noFacts)); err != nil {
+			return fmt.Errorf("fact_profiles[%d]: %w", i, err)
+		}
+		if err := checkConditions(packages, vars); err != nil {
+			return fmt.Errorf("fact_profiles[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
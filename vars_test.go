@@ -0,0 +1,171 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMergeVars(t *testing.T) {
+	desiredState := &DesiredState{
+		Vars: map[string]string{"a": "global", "b": "global", "c": "global", "d": "global"},
+		Profiles: map[string]ProfileConfig{
+			"base": {Vars: map[string]string{"b": "base", "c": "base", "d": "base"}},
+			"web":  {Vars: map[string]string{"c": "web", "d": "web"}},
+		},
+		Machines: map[string]MachineConfig{
+			"web*":  {Vars: map[string]string{"d": "web*"}},
+			"web01": {},
+		},
+	}
+
+	vars := desiredState.mergeVars([]string{"base", "web"}, []string{"web*", "web01"})
+
+	// The last to set a var wins: global, then profiles, then entries
+	expected := map[string]string{"a": "global", "b": "base", "c": "web", "d": "web*"}
+	for name, value := range expected {
+		if vars[name] != value {
+			t.Errorf("Expected %s to be %q, but got %q", name, value, vars[name])
+		}
+	}
+	if desiredState.Vars["d"] != "global" {
+		t.Errorf("Expected the global vars to be left alone, but got %v", desiredState.Vars)
+	}
+}
+
+func TestRenderArgument(t *testing.T) {
+	data := templateData(map[string]string{"domain": "example.com"}, "web01", "abc123", map[string][]string{"ip_addresses": {"10.0.0.1", "10.0.0.2"}})
+
+	testCases := []struct {
+		name      string
+		argument  string
+		expected  string
+		expectErr string
+	}{
+		{name: "Plain", argument: "--yes", expected: "--yes"},
+		{name: "Var", argument: "--domain={{ .vars.domain }}", expected: "--domain=example.com"},
+		{name: "Hostname and commit", argument: "{{ .hostname }}@{{ .commit }}", expected: "web01@abc123"},
+		{name: "Multi-value fact", argument: "{{ .facts.ip_addresses }}", expected: "10.0.0.1,10.0.0.2"},
+		{name: "Missing var", argument: "{{ .vars.typo }}", expectErr: `map has no entry for key "typo"`},
+		{name: "Missing fact", argument: "{{ .facts.gpu }}", expectErr: `map has no entry for key "gpu"`},
+		{name: "Invalid template", argument: "{{ .vars.domain", expectErr: "unclosed action"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rendered, err := renderArgument(tc.argument, data)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Errorf("Expected an error containing %q, but got %q, %v", tc.expectErr, rendered, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if rendered != tc.expected {
+				t.Errorf("Expected %q, but got %q", tc.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestRenderArguments(t *testing.T) {
+	packages := map[string][]PackageStep{
+		"nginx": {{Action: "install", Arguments: []string{"--name={{ .hostname }}"}, Env: map[string]string{"DOMAIN": "{{ .vars.domain }}"}}},
+	}
+	rendered, err := renderArguments(packages, templateData(map[string]string{"domain": "example.com"}, "web01", "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := rendered["nginx"][0]
+	if !slices.Equal(step.Arguments, []string{"--name=web01"}) || step.Env["DOMAIN"] != "example.com" {
+		t.Errorf("Expected the arguments and env to be rendered, but got %+v", step)
+	}
+	if original := packages["nginx"][0]; original.Arguments[0] != "--name={{ .hostname }}" || original.Env["DOMAIN"] != "{{ .vars.domain }}" {
+		t.Errorf("Expected the config's steps to be left alone, but got %+v", original)
+	}
+
+	_, err = renderArguments(packages, templateData(nil, "web01", "", nil))
+	if err == nil || !strings.Contains(err.Error(), "package nginx install step env DOMAIN") {
+		t.Errorf("Expected the missing var's step to be named, but got: %v", err)
+	}
+}
+
+func TestCheckTemplates(t *testing.T) {
+	testCases := []struct {
+		name      string
+		config    string
+		expectErr string
+	}{
+		{
+			name: "Vars from the entry, its profiles and the globals",
+			config: `
+vars: {domain: example.com}
+profiles:
+  web:
+    vars: {port: "80"}
+    packages:
+      nginx: [{action: install, arguments: ["{{ .vars.domain }}:{{ .vars.port }}", "{{ .vars.name }}"]}]
+machines:
+  web*:
+    applied_profiles: [web]
+    vars: {name: web}
+`,
+		},
+		{
+			name: "Var set only by another entry the host may match",
+			config: `
+machines:
+  web*:
+    vars: {name: web}
+  web01:
+    packages:
+      nginx: [{action: install, arguments: ["{{ .vars.name }}"]}]
+`,
+			expectErr: `machine web01: package nginx install step`,
+		},
+		{
+			name: "Var in a profile that another entry sets",
+			config: `
+profiles:
+  web:
+    packages:
+      nginx: [{action: install, arguments: ["{{ .vars.name }}"]}]
+machines:
+  web*:
+    applied_profiles: [web]
+    vars: {name: web}
+  web01:
+    applied_profiles: [web]
+`,
+			expectErr: `machine web01: package nginx install step`,
+		},
+		{
+			name: "Fact profile's own vars",
+			config: `
+profiles:
+  arm:
+    packages:
+      firmware: [{action: install, arguments: ["{{ .vars.board }}"]}]
+fact_profiles:
+  - match: {arch: arm64}
+    applied_profiles: [arm]
+`,
+			expectErr: `fact_profiles[0]: package firmware install step`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadDesiredState(writeTestConfig(t, map[string]string{"config.yaml": tc.config}))
+			if tc.expectErr == "" {
+				if err != nil {
+					t.Errorf("Did not expect error, but got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) || !strings.Contains(err.Error(), "map has no entry") {
+				t.Errorf("Expected an error containing %q, but got: %v", tc.expectErr, err)
+			}
+		})
+	}
+}
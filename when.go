@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	pb "github.com/geogian28/Assimilator/proto"
+)
+
+// A step's `when:` decides whether it applies to a machine. It's evaluated by
+// the server against the facts the agent reported and the machine's vars:
+//
+//	when: distro == "fedora" && arch == "arm64"
+//	when: !(vars.role == "db" || is_container)
+//
+// A bare name is a fact, and can also be written facts.name. Vars are
+// vars.name. Comparisons are == and != between names and "string literals".
+// A fact with several values, like ip_addresses, equals a string if any of
+// its values do. A name on its own is true when its value is "true", so
+// is_vm works as a condition. &&, || and ! combine them, with ! binding
+// tightest and && before ||, and parentheses group. A fact the agent didn't
+// report, or reported empty, makes the whole condition false, however it's
+// negated, so a step that depends on it waits until the fact is known.
+//
+// A step whose condition is false isn't served to the agent, which shows it
+// as not applied. Its package is still served, even with no steps left, so it
+// stays assigned and isn't uninstalled as removed.
+
+// whenNode is a parsed `when:` expression
+type whenNode interface {
+	eval(w *whenEval) (bool, error)
+	// operands lists every fact, var and literal in the expression
+	operands() []whenOperand
+}
+
+// whenOperand is a fact, var or string literal
+type whenOperand struct {
+	literal   string
+	isLiteral bool
+	namespace string // "facts" or "vars"
+	name      string
+	pos       int
+}
+
+// whenCompare is an == or != comparison
+type whenCompare struct {
+	left, right whenOperand
+	negate      bool
+}
+
+type whenNot struct {
+	operand whenNode
+}
+
+// whenLogical is an && or || between two expressions
+type whenLogical struct {
+	left, right whenNode
+	and         bool
+}
+
+// whenTruthy is an operand on its own
+type whenTruthy struct {
+	operand whenOperand
+}
+
+// whenEval holds what an expression is evaluated against, and remembers the
+// values it looked at so a false condition can say why
+type whenEval struct {
+	facts map[string][]string
+	vars  map[string]string
+	seen  map[string]string
+}
+
+func (o whenOperand) String() string {
+	if o.isLiteral {
+		return strconv.Quote(o.literal)
+	}
+	if o.namespace == "vars" {
+		return "vars." + o.name
+	}
+	return o.name
+}
+
+func (o whenOperand) values(w *whenEval) ([]string, error) {
+	if o.isLiteral {
+		return []string{o.literal}, nil
+	}
+	var values []string
+	if o.namespace == "vars" {
+		value, ok := w.vars[o.name]
+		if !ok {
+			return nil, fmt.Errorf("var %q at column %d is not set", o.name, o.pos+1)
+		}
+		values = []string{value}
+	} else {
+		values = w.facts[o.name]
+		if !slices.ContainsFunc(values, func(value string) bool { return value != "" }) {
+			return nil, &whenNoValue{name: o.name, pos: o.pos}
+		}
+	}
+	w.seen[o.String()] = redactSecrets(strings.Join(values, ","))
+	return values, nil
+}
+
+func (c whenCompare) eval(w *whenEval) (bool, error) {
+	left, err := c.left.values(w)
+	if err != nil {
+		return false, err
+	}
+	right, err := c.right.values(w)
+	if err != nil {
+		return false, err
+	}
+	equal := slices.ContainsFunc(left, func(value string) bool {
+		return slices.Contains(right, value)
+	})
+	return equal != c.negate, nil
+}
+
+func (n whenNot) eval(w *whenEval) (bool, error) {
+	result, err := n.operand.eval(w)
+	return !result, err
+}
+
+func (l whenLogical) eval(w *whenEval) (bool, error) {
+	left, err := l.left.eval(w)
+	if err != nil || left != l.and {
+		return left, err
+	}
+	return l.right.eval(w)
+}
+
+func (t whenTruthy) eval(w *whenEval) (bool, error) {
+	values, err := t.operand.values(w)
+	return slices.Contains(values, "true"), err
+}
+
+func (c whenCompare) operands() []whenOperand {
+	return []whenOperand{c.left, c.right}
+}
+
+func (n whenNot) operands() []whenOperand {
+	return n.operand.operands()
+}
+
+func (l whenLogical) operands() []whenOperand {
+	return append(l.left.operands(), l.right.operands()...)
+}
+
+func (t whenTruthy) operands() []whenOperand {
+	return []whenOperand{t.operand}
+}
+
+// whenNoValue is the error for a fact the machine has no value for. It stops
+// the evaluation, and evalWhen turns it into a false condition.
+type whenNoValue struct {
+	name string
+	pos  int
+}
+
+func (e *whenNoValue) Error() string {
+	return fmt.Sprintf("fact %q at column %d has no value for this machine", e.name, e.pos+1)
+}
+
+type whenToken struct {
+	text      string // The operator or name, or the literal's value
+	isLiteral bool
+	pos       int
+}
+
+// tokenizeWhen splits an expression into operators, names and string literals
+func tokenizeWhen(expression string) ([]whenToken, error) {
+	var tokens []whenToken
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(expression[i:], "=="), strings.HasPrefix(expression[i:], "!="),
+			strings.HasPrefix(expression[i:], "&&"), strings.HasPrefix(expression[i:], "||"):
+			tokens = append(tokens, whenToken{text: expression[i : i+2], pos: i})
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, whenToken{text: string(c), pos: i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expression) && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at column %d", i+1)
+			}
+			value, err := strconv.Unquote(expression[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at column %d: %w", i+1, err)
+			}
+			tokens = append(tokens, whenToken{text: value, isLiteral: true, pos: i})
+			i = end + 1
+		case isNameChar(c):
+			end := i
+			for end < len(expression) && (isNameChar(expression[end]) || expression[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, whenToken{text: expression[i:end], pos: i})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q at column %d", c, i+1)
+		}
+	}
+	return tokens, nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// whenParser is a recursive descent parser over:
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" or ")" | operand [ ( "==" | "!=" ) operand ]
+type whenParser struct {
+	tokens []whenToken
+	next   int
+	end    int // The expression's length, for errors at its end
+}
+
+// parseWhen parses a `when:` expression, checking that every fact it uses exists
+func parseWhen(expression string) (whenNode, error) {
+	tokens, err := tokenizeWhen(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &whenParser{tokens: tokens, end: len(expression)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %s at column %d", token.describe(), token.pos+1)
+	}
+	return node, nil
+}
+
+func (t whenToken) describe() string {
+	if t.isLiteral {
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+func (p *whenParser) peek() (whenToken, bool) {
+	if p.next >= len(p.tokens) {
+		return whenToken{}, false
+	}
+	return p.tokens[p.next], true
+}
+
+// accept consumes the next token if it's the operator op
+func (p *whenParser) accept(op string) bool {
+	if token, ok := p.peek(); ok && !token.isLiteral && token.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *whenParser) parseOr() (whenNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right whenNode
+		right, err = p.parseAnd()
+		left = whenLogical{left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *whenParser) parseAnd() (whenNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right whenNode
+		right, err = p.parseUnary()
+		left = whenLogical{left: left, right: right, and: true}
+	}
+	return left, err
+}
+
+func (p *whenParser) parseUnary() (whenNode, error) {
+	switch {
+	case p.accept("!"):
+		operand, err := p.parseUnary()
+		return whenNot{operand: operand}, err
+	case p.accept("("):
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.expected("')'")
+		}
+		return node, nil
+	}
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	negate := false
+	switch {
+	case p.accept("=="):
+	case p.accept("!="):
+		negate = true
+	default:
+		if left.isLiteral {
+			return nil, p.expected("'==' or '!='")
+		}
+		return whenTruthy{operand: left}, nil
+	}
+	right, err := p.parseOperand()
+	return whenCompare{left: left, right: right, negate: negate}, err
+}
+
+func (p *whenParser) parseOperand() (whenOperand, error) {
+	token, ok := p.peek()
+	if !ok || (!token.isLiteral && !isNameChar(token.text[0])) {
+		return whenOperand{}, p.expected("a fact, var or string")
+	}
+	p.next++
+	if token.isLiteral {
+		return whenOperand{literal: token.text, isLiteral: true, pos: token.pos}, nil
+	}
+	namespace, name, ok := strings.Cut(token.text, ".")
+	if !ok {
+		namespace, name = "facts", token.text
+	}
+	switch namespace {
+	case "facts":
+		if _, known := factValues(&pb.Facts{})[name]; !known {
+			return whenOperand{}, fmt.Errorf("unknown fact %q at column %d", name, token.pos+1)
+		}
+	case "vars":
+	default:
+		return whenOperand{}, fmt.Errorf("unknown name %q at column %d: use a fact, facts.name or vars.name", token.text, token.pos+1)
+	}
+	if name == "" || strings.Contains(name, ".") {
+		return whenOperand{}, fmt.Errorf("invalid name %q at column %d", token.text, token.pos+1)
+	}
+	return whenOperand{namespace: namespace, name: name, pos: token.pos}, nil
+}
+
+// expected is the error for a missing token where the parser is
+func (p *whenParser) expected(what string) error {
+	if token, ok := p.peek(); ok {
+		return fmt.Errorf("expected %s at column %d, found %s", what, token.pos+1, token.describe())
+	}
+	return fmt.Errorf("expected %s at column %d, found the end", what, p.end+1)
+}
+
+// checkWhen parses a `when:` expression and checks that every var it uses is
+// set. It doesn't evaluate it: facts are only known once an agent reports
+// them, and && and || would stop before a var on their right.
+func checkWhen(expression string, vars map[string]string) error {
+	node, err := parseWhen(expression)
+	if err != nil {
+		return err
+	}
+	for _, operand := range node.operands() {
+		if _, ok := vars[operand.name]; operand.namespace == "vars" && !ok {
+			return fmt.Errorf("var %q at column %d is not set", operand.name, operand.pos+1)
+		}
+	}
+	return nil
+}
+
+// checkConditions checks every step's `when:` with checkWhen
+func checkConditions(packages map[string][]PackageStep, vars map[string]string) error {
+	for _, pkgName := range slices.Sorted(maps.Keys(packages)) {
+		for _, step := range packages[pkgName] {
+			if step.When == "" {
+				continue
+			}
+			if err := checkWhen(step.When, vars); err != nil {
+				return fmt.Errorf("package %s %s step: invalid when: %w", pkgName, step.Action, err)
+			}
+		}
+	}
+	return nil
+}
+
+// skippedStep is a step left out of a machine's config because its `when:` is false
+type skippedStep struct {
+	Package string
+	Index   int // Its position in the package's steps
+	Action  string
+	Reason  string
+}
+
+// evalWhen evaluates a step's condition. When it's false, the reason says
+// which values made it so.
+func evalWhen(expression string, vars map[string]string, facts map[string][]string) (bool, string, error) {
+	node, err := parseWhen(expression)
+	if err != nil {
+		return false, "", err
+	}
+	w := &whenEval{facts: facts, vars: vars, seen: make(map[string]string)}
+	ok, err := node.eval(w)
+	var noValue *whenNoValue
+	if errors.As(err, &noValue) {
+		return false, fmt.Sprintf("when %s is false (%s has no value for this machine)", expression, noValue.name), nil
+	}
+	if err != nil || ok {
+		return ok, "", err
+	}
+	values := make([]string, 0, len(w.seen))
+	for _, name := range slices.Sorted(maps.Keys(w.seen)) {
+		values = append(values, fmt.Sprintf("%s is %q", name, w.seen[name]))
+	}
+	reason := fmt.Sprintf("when %s is false", expression)
+	if len(values) > 0 {
+		reason += " (" + strings.Join(values, ", ") + ")"
+	}
+	return false, reason, nil
+}
+
+// applyWhen returns a copy of packages without the steps whose `when:` is
+// false for the machine, and the steps it left out. Packages left without
+// steps are kept, so the agent doesn't take them as removed.
+func applyWhen(packages map[string][]PackageStep, vars map[string]string, facts map[string][]string) (map[string][]PackageStep, []skippedStep, error) {
+	applied := make(map[string][]PackageStep, len(packages))
+	var skipped []skippedStep
+	for _, pkgName := range slices.Sorted(maps.Keys(packages)) {
+		var steps []PackageStep
+		for i, step := range packages[pkgName] {
+			if step.When == "" {
+				steps = append(steps, step)
+				continue
+			}
+			ok, reason, err := evalWhen(step.When, vars, facts)
+			if err != nil {
+				return nil, nil, fmt.Errorf("package %s %s step: invalid when: %w", pkgName, step.Action, err)
+			}
+			if !ok {
+				skipped = append(skipped, skippedStep{Package: pkgName, Index: i, Action: step.Action, Reason: reason})
+				continue
+			}
+			steps = append(steps, step)
+		}
+		applied[pkgName] = steps
+	}
+	return applied, skipped, nil
+}
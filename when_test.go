@@ -0,0 +1,344 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeWhen(t *testing.T) {
+	testCases := []struct {
+		name       string
+		expression string
+		expected   []string // Each token, with literals quoted
+		expectErr  string
+	}{
+		{name: "Comparison", expression: `distro=="fedora"`, expected: []string{"distro", "==", `"fedora"`}},
+		{name: "Whitespace", expression: " arch\t!= \"arm64\"\n", expected: []string{"arch", "!=", `"arm64"`}},
+		{name: "Operators", expression: `!(a&&b)||c`, expected: []string{"!", "(", "a", "&&", "b", ")", "||", "c"}},
+		{name: "Dotted names", expression: `vars.role == facts.distro`, expected: []string{"vars.role", "==", "facts.distro"}},
+		{name: "Escapes in a string", expression: `x == "a \"b\" \\"`, expected: []string{"x", "==", `"a \"b\" \\"`}},
+		{name: "Unterminated string", expression: `distro == "fedora`, expectErr: "unterminated string at column 11"},
+		{name: "Invalid escape", expression: `distro == "\q"`, expectErr: "invalid string at column 11"},
+		{name: "Single =", expression: `distro = "fedora"`, expectErr: `unexpected '=' at column 8`},
+		{name: "Single &", expression: `a & b`, expectErr: `unexpected '&' at column 3`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := tokenizeWhen(tc.expression)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Errorf("Expected error %q, but got: %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			var got []string
+			for _, token := range tokens {
+				if token.isLiteral {
+					got = append(got, `"`+strings.ReplaceAll(strings.ReplaceAll(token.text, `\`, `\\`), `"`, `\"`)+`"`)
+					continue
+				}
+				got = append(got, token.text)
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("Expected %q, but got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseWhenErrors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		expression string
+		expectErr  string
+	}{
+		{name: "Empty", expression: ``, expectErr: "expected a fact, var or string at column 1, found the end"},
+		{name: "Missing right operand", expression: `distro ==`, expectErr: "expected a fact, var or string at column 10, found the end"},
+		{name: "Missing right side of &&", expression: `is_vm && `, expectErr: "expected a fact, var or string at column 10, found the end"},
+		{name: "Unclosed parenthesis", expression: `(is_vm || is_container`, expectErr: "expected ')' at column 23, found the end"},
+		{name: "Extra closing parenthesis", expression: `is_vm)`, expectErr: "unexpected ')' at column 6"},
+		{name: "Two operands", expression: `is_vm is_container`, expectErr: "unexpected 'is_container' at column 7"},
+		{name: "Literal on its own", expression: `"true"`, expectErr: `expected '==' or '!=' at column 7, found the end`},
+		{name: "Operator as an operand", expression: `distro == &&`, expectErr: "expected a fact, var or string at column 11, found '&&'"},
+		{name: "Unknown fact", expression: `arch == "x86_64" && distr == "fedora"`, expectErr: `unknown fact "distr" at column 21`},
+		{name: "Unknown namespace", expression: `env.HOME == "/root"`, expectErr: `unknown name "env.HOME" at column 1: use a fact, facts.name or vars.name`},
+		{name: "Empty var name", expression: `vars. == "x"`, expectErr: `invalid name "vars." at column 1`},
+		{name: "Nested var name", expression: `vars.a.b == "x"`, expectErr: `invalid name "vars.a.b" at column 1`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseWhen(tc.expression)
+			if err == nil || err.Error() != tc.expectErr {
+				t.Errorf("Expected error %q, but got: %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestEvalWhen(t *testing.T) {
+	facts := map[string][]string{
+		"distro":       {"fedora"},
+		"arch":         {"arm64"},
+		"is_vm":        {"true"},
+		"is_container": {"false"},
+		"ip_addresses": {"10.0.0.5", "192.168.1.5"},
+		"distro_like":  {},
+		"cpu_model":    {""},
+	}
+	vars := map[string]string{"role": "db", "enabled": "true"}
+
+	testCases := []struct {
+		name           string
+		expression     string
+		expected       bool
+		expectedReason string
+		expectErr      string
+	}{
+		{name: "Equal", expression: `distro == "fedora"`, expected: true},
+		{name: "Not equal", expression: `distro != "fedora"`, expectedReason: `when distro != "fedora" is false (distro is "fedora")`},
+		{name: "Facts namespace", expression: `facts.arch == "arm64"`, expected: true},
+		{name: "Literal on the left", expression: `"arm64" == arch`, expected: true},
+		{name: "Var", expression: `vars.role == "db"`, expected: true},
+		{name: "Truthy fact", expression: `is_vm`, expected: true},
+		{name: "Falsy fact", expression: `is_container`, expectedReason: `when is_container is false (is_container is "false")`},
+		{name: "Truthy var", expression: `vars.enabled`, expected: true},
+		{name: "Multi-value fact matches any", expression: `ip_addresses == "192.168.1.5"`, expected: true},
+		{name: "Multi-value fact matches none", expression: `ip_addresses == "10.0.0.6"`, expectedReason: `when ip_addresses == "10.0.0.6" is false (ip_addresses is "10.0.0.5,192.168.1.5")`},
+		{name: "Multi-value fact not equal", expression: `ip_addresses != "10.0.0.5"`, expectedReason: `when ip_addresses != "10.0.0.5" is false (ip_addresses is "10.0.0.5,192.168.1.5")`},
+
+		// ! binds tightest, then &&, then ||
+		{name: "! before &&", expression: `!is_container && is_vm`, expected: true},
+		{name: "! before ==", expression: `!distro == "debian"`, expected: true},
+		{name: "&& before ||", expression: `is_vm || is_container && distro == "debian"`, expected: true},
+		{name: "&& before || on the left", expression: `is_container && is_vm || distro == "fedora"`, expected: true},
+		{name: "Parentheses group", expression: `(is_vm || is_container) && distro == "debian"`, expectedReason: `when (is_vm || is_container) && distro == "debian" is false (distro is "fedora", is_vm is "true")`},
+		{name: "! on a group", expression: `!(vars.role == "db" || is_container)`, expectedReason: `when !(vars.role == "db" || is_container) is false (vars.role is "db")`},
+		{name: "Double !", expression: `!!is_vm`, expected: true},
+
+		// Reasons list what was looked at, sorted
+		{name: "Reason for &&", expression: `arch == "arm64" && distro == "debian"`, expectedReason: `when arch == "arm64" && distro == "debian" is false (arch is "arm64", distro is "fedora")`},
+
+		// Missing and empty facts make the whole condition false, even negated
+		{name: "Unreported fact", expression: `virtualization == "kvm"`, expectedReason: `when virtualization == "kvm" is false (virtualization has no value for this machine)`},
+		{name: "Unreported fact with !=", expression: `virtualization != "kvm"`, expectedReason: `when virtualization != "kvm" is false (virtualization has no value for this machine)`},
+		{name: "Empty fact", expression: `is_vm && cpu_model != "x"`, expectedReason: `when is_vm && cpu_model != "x" is false (cpu_model has no value for this machine)`},
+		{name: "Fact with no values", expression: `!(distro_like == "rhel")`, expectedReason: `when !(distro_like == "rhel") is false (distro_like has no value for this machine)`},
+		{name: "Unreported fact after a true ||", expression: `is_vm || virtualization == "kvm"`, expected: true},
+		{name: "Unset var", expression: `distro == "fedora" && vars.tier == "1"`, expectErr: `var "tier" at column 23 is not set`},
+		{name: "Parse error", expression: `distro ==`, expectErr: "expected a fact, var or string at column 10, found the end"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, reason, err := evalWhen(tc.expression, vars, facts)
+			if tc.expectErr != "" {
+				if err == nil || err.Error() != tc.expectErr {
+					t.Errorf("Expected error %q, but got: %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			if ok != tc.expected || reason != tc.expectedReason {
+				t.Errorf("Expected %v with reason %q, but got %v with %q", tc.expected, tc.expectedReason, ok, reason)
+			}
+		})
+	}
+}
+
+func TestEvalWhenRedactsSecrets(t *testing.T) {
+	vars := map[string]string{"token": "--token=" + secretPlaceholder(0)}
+	_, reason, err := evalWhen(`vars.token == "x"`, vars, nil)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	if expected := `when vars.token == "x" is false (vars.token is "--token=<secret>")`; reason != expected {
+		t.Errorf("Expected %q, but got %q", expected, reason)
+	}
+}
+
+func TestCheckWhen(t *testing.T) {
+	vars := map[string]string{"role": "db"}
+	testCases := []struct {
+		name       string
+		expression string
+		expectErr  string
+	}{
+		{name: "Known var", expression: `vars.role == "db"`},
+		{name: "Facts aren't needed", expression: `distro == "fedora" && !is_vm`},
+		// Evaluating would stop before the typo on the right
+		{name: "Typo after ||", expression: `vars.role == "db" || vars.rol == "web"`, expectErr: `var "rol" at column 22 is not set`},
+		{name: "Typo after &&", expression: `is_container && vars.rol == "web"`, expectErr: `var "rol" at column 17 is not set`},
+		{name: "Typo under !", expression: `!(vars.tier)`, expectErr: `var "tier" at column 3 is not set`},
+		{name: "Typo on the right of ==", expression: `"db" == vars.rol`, expectErr: `var "rol" at column 9 is not set`},
+		{name: "Parse error", expression: `vars.role ==`, expectErr: "expected a fact, var or string at column 13, found the end"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkWhen(tc.expression, vars)
+			if tc.expectErr == "" {
+				if err != nil {
+					t.Errorf("Did not expect error, but got: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.expectErr {
+				t.Errorf("Expected error %q, but got: %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckTemplatesWhen(t *testing.T) {
+	configPath := writeTestConfig(t, map[string]string{"config.yaml": `
+vars:
+  role: db
+machines:
+  web01:
+    packages:
+      nginx:
+        - action: install
+          when: vars.role == "db" || vars.rol == "web"
+`})
+	_, err := LoadDesiredState(configPath)
+	if expected := `machine web01: package nginx install step: invalid when: var "rol" at column 22 is not set`; err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected error %q, but got: %v", expected, err)
+	}
+}
+
+func TestApplyWhen(t *testing.T) {
+	packages := map[string][]PackageStep{
+		"nginx": {
+			{Action: "install"},
+			{Action: "configure", When: `distro == "debian"`},
+			{Action: "tune", When: `is_vm`},
+		},
+		"vmtools": {{Action: "install", When: `!is_vm`, UninstallOnRemoval: true}},
+	}
+	facts := map[string][]string{"distro": {"fedora"}, "is_vm": {"true"}}
+
+	applied, skipped, err := applyWhen(packages, nil, facts)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+
+	var actions []string
+	for _, step := range applied["nginx"] {
+		actions = append(actions, step.Action)
+	}
+	if !slices.Equal(actions, []string{"install", "tune"}) {
+		t.Errorf("Expected the install and tune steps, but got %v", actions)
+	}
+	if steps, ok := applied["vmtools"]; !ok || len(steps) != 0 {
+		t.Errorf("Expected vmtools to be kept without steps, but got %v", steps)
+	}
+	expected := []skippedStep{
+		{Package: "nginx", Index: 1, Action: "configure", Reason: `when distro == "debian" is false (distro is "fedora")`},
+		{Package: "vmtools", Index: 0, Action: "install", Reason: `when !is_vm is false (is_vm is "true")`},
+	}
+	if !slices.Equal(skipped, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, skipped)
+	}
+
+	if _, _, err := applyWhen(packages, map[string]string{}, facts); err != nil {
+		t.Errorf("Did not expect error, but got: %v", err)
+	}
+	packages["nginx"][2].When = `vars.tier == "1"`
+	if _, _, err := applyWhen(packages, map[string]string{}, facts); err == nil || err.Error() != `package nginx tune step: invalid when: var "tier" at column 1 is not set` {
+		t.Errorf("Expected an error for the unset var, but got: %v", err)
+	}
+}
+
+func TestApplyWhenMissingFacts(t *testing.T) {
+	packages := map[string][]PackageStep{
+		"kvm-tools": {{Action: "install", When: `virtualization == "kvm"`}},
+		"debian":    {{Action: "install", When: `distro_like == "debian" || distro == "debian"`}},
+		"vim":       {{Action: "install"}},
+	}
+	testCases := []struct {
+		name            string
+		facts           map[string][]string
+		expectedApplied []string // package/action
+		expectedSkipped []string // package: reason
+	}{
+		{
+			// Debian has no ID_LIKE, and bare metal no virtualization
+			name:            "Debian on bare metal",
+			facts:           map[string][]string{"distro": {"debian"}, "distro_like": nil, "virtualization": {""}},
+			expectedApplied: []string{"vim/install"},
+			expectedSkipped: []string{
+				`debian: when distro_like == "debian" || distro == "debian" is false (distro_like has no value for this machine)`,
+				`kvm-tools: when virtualization == "kvm" is false (virtualization has no value for this machine)`,
+			},
+		},
+		{
+			name:            "Agent that reports no facts",
+			expectedApplied: []string{"vim/install"},
+			expectedSkipped: []string{
+				`debian: when distro_like == "debian" || distro == "debian" is false (distro_like has no value for this machine)`,
+				`kvm-tools: when virtualization == "kvm" is false (virtualization has no value for this machine)`,
+			},
+		},
+		{
+			name:            "All facts reported",
+			facts:           map[string][]string{"distro": {"ubuntu"}, "distro_like": {"debian"}, "virtualization": {"kvm"}},
+			expectedApplied: []string{"debian/install", "kvm-tools/install", "vim/install"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			applied, skipped, err := applyWhen(packages, nil, tc.facts)
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %v", err)
+			}
+			var gotApplied, gotSkipped []string
+			for _, pkgName := range slices.Sorted(maps.Keys(applied)) {
+				for _, step := range applied[pkgName] {
+					gotApplied = append(gotApplied, pkgName+"/"+step.Action)
+				}
+			}
+			for _, step := range skipped {
+				gotSkipped = append(gotSkipped, step.Package+": "+step.Reason)
+			}
+			if !slices.Equal(gotApplied, tc.expectedApplied) {
+				t.Errorf("Expected applied %v, but got %v", tc.expectedApplied, gotApplied)
+			}
+			if !slices.Equal(gotSkipped, tc.expectedSkipped) {
+				t.Errorf("Expected skipped %q, but got %q", tc.expectedSkipped, gotSkipped)
+			}
+		})
+	}
+}
+
+func TestSkippedPackageStaysAssigned(t *testing.T) {
+	defer func(runAsUser string) { appConfig.RunAsUser = runAsUser }(appConfig.RunAsUser)
+	appConfig.RunAsUser = "root"
+	state := newTestState()
+	state.Packages["vmtools"] = &PackageState{
+		Assigned: true,
+		Steps:    map[string]*StepState{"install/root": {Action: "install", RunAsUser: "root", UninstallOnRemoval: true}},
+	}
+	packages := map[string][]PackageStep{"vmtools": {{Action: "install", When: `!is_vm`, UninstallOnRemoval: true}}}
+
+	// The host became a VM, so the only step no longer applies
+	applied, skipped, err := applyWhen(packages, nil, map[string][]string{"is_vm": {"true"}})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %v", err)
+	}
+	state.applyCheckIn("", "", toProtoPackageConfigMap(&applied))
+
+	if len(skipped) != 1 {
+		t.Errorf("Expected the install step to be skipped, but got %+v", skipped)
+	}
+	if !state.Packages["vmtools"].Assigned {
+		t.Errorf("Expected vmtools to stay assigned")
+	}
+	if removed := state.removedPackages(); len(removed) != 0 {
+		t.Errorf("Expected nothing to be uninstalled, but got %+v", removed)
+	}
+}